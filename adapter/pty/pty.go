@@ -36,7 +36,7 @@ type Instance struct {
 	config Config
 }
 
-func (instance *Instance) Connect(auth chan bool, callback func(question string)) error {
+func (instance *Instance) Connect(auth chan bool, callback func(question string), info func(info core.InfoDesc)) error {
 	auth <- true
 	return nil
 }
@@ -79,7 +79,7 @@ func (h *ConfigHelper) StoreConfig(config interface{}) []byte {
 	return ret
 }
 
-func (h *ConfigHelper) New(config interface{}) core.ServeInstance {
+func (h *ConfigHelper) New(id uint64, config interface{}) core.ServeInstance {
 	return &Instance{
 		config: *config.(*Config),
 	}
@@ -0,0 +1,193 @@
+package raw
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+	"wterm/core"
+)
+
+const dialTimeout = 10 * time.Second
+
+const (
+	NEWLINE_CR   = "cr"
+	NEWLINE_LF   = "lf"
+	NEWLINE_CRLF = "crlf"
+)
+
+type Config struct {
+	core.ConfigBase
+	Network string `json:"network"` // "tcp" or "unix"
+	Address string `json:"address"` // host:port or socket path
+	TLS     bool   `json:"tls"`
+	// skip verifying the server certificate of a tls connection
+	Insecure bool `json:"insecure,omitempty"`
+	// sent for the enter key, "cr"(default)/"lf"/"crlf"
+	Newline string `json:"newline"`
+	// show every received LF as CRLF
+	ImplicitCR bool `json:"implicitCR"`
+}
+
+type Instance struct {
+	config Config
+	infoCB func(info core.InfoDesc)
+}
+
+func (instance *Instance) Connect(auth chan bool, callback func(question string), info func(info core.InfoDesc)) error {
+	instance.infoCB = info
+	auth <- true
+	return nil
+}
+
+func (instance *Instance) Auth(info core.AuthDesc) {}
+
+func (instance *Instance) dial() (net.Conn, error) {
+	network := instance.config.Network
+	if network == "" {
+		network = "tcp"
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if instance.config.TLS {
+		return tls.DialWithDialer(dialer, network, instance.config.Address, &tls.Config{
+			InsecureSkipVerify: instance.config.Insecure,
+		})
+	}
+	return dialer.Dial(network, instance.config.Address)
+}
+
+func (instance *Instance) NewShell(id uint16) core.ShellSession {
+	conn, err := instance.dial()
+	if err != nil {
+		instance.infoCB(core.InfoDesc{
+			Type: "ERROR",
+			Info: fmt.Sprintf("[RAW] %s", err.Error()),
+		})
+		return nil
+	}
+	newline := []byte("\r")
+	switch instance.config.Newline {
+	case NEWLINE_LF:
+		newline = []byte("\n")
+	case NEWLINE_CRLF:
+		newline = []byte("\r\n")
+	}
+	return &ShellSession{
+		conn:       conn,
+		newline:    newline,
+		implicitCR: instance.config.ImplicitCR,
+	}
+}
+
+func (instance *Instance) NewFS(id uint16) core.FilesystemSession {
+	return nil
+}
+
+func (*Instance) IsWindowsPath() bool {
+	return false
+}
+
+type ShellSession struct {
+	conn       net.Conn
+	newline    []byte
+	implicitCR bool
+	lastCR     bool
+	transfer   int32 // set while a modem transfer runs, the data is not translated then
+}
+
+// SetTransfer implements core.TransferSession.
+func (s *ShellSession) SetTransfer(active bool) {
+	var value int32
+	if active {
+		value = 1
+	}
+	atomic.StoreInt32(&s.transfer, value)
+}
+
+func (s *ShellSession) transferring() bool {
+	return atomic.LoadInt32(&s.transfer) != 0
+}
+
+func (s *ShellSession) Read(p []byte) (n int, err error) {
+	if !s.implicitCR || len(p) < 2 || s.transferring() {
+		return s.conn.Read(p)
+	}
+	// half of p is left for the inserted CRs
+	buf := make([]byte, len(p)/2)
+	count, err := s.conn.Read(buf)
+	for _, b := range buf[:count] {
+		if b == '\n' && !s.lastCR {
+			p[n] = '\r'
+			n++
+		}
+		p[n] = b
+		n++
+		s.lastCR = b == '\r'
+	}
+	return n, err
+}
+
+func (s *ShellSession) Write(p []byte) (n int, err error) {
+	data := p
+	if !bytes.Equal(s.newline, []byte("\r")) && !s.transferring() {
+		data = bytes.ReplaceAll(p, []byte("\r"), s.newline)
+	}
+	_, err = s.conn.Write(data)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *ShellSession) Close() error {
+	return s.conn.Close()
+}
+
+func (s *ShellSession) Resize(rows int, cols int) {}
+
+type ConfigHelper struct {
+}
+
+func (helper *ConfigHelper) LoadConfig(data []byte) interface{} {
+	ret := Config{}
+	err := json.Unmarshal(data, &ret)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if ret.Network != "" && ret.Network != "tcp" && ret.Network != "unix" {
+		log.Println("unknown network:", ret.Network)
+		return nil
+	}
+	return &ret
+}
+
+func (helper *ConfigHelper) StoreConfig(config interface{}) []byte {
+	ret, err := json.Marshal(config)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return ret
+}
+
+func (helper *ConfigHelper) New(id uint64, config interface{}) core.ServeInstance {
+	return &Instance{
+		config: *config.(*Config),
+	}
+}
+
+func (helper *ConfigHelper) Info(host string, id uint64, config interface{}) core.ConnectionInfo {
+	cased := config.(*Config)
+	return core.ConnectionInfo{
+		Id:       int(id),
+		Name:     cased.Name,
+		URL:      fmt.Sprintf("%s/ws?id=%d", host, id),
+		Protocol: "standard",
+		FixSize:  false,
+	}
+}
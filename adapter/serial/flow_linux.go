@@ -0,0 +1,26 @@
+package serial
+
+import (
+	"go.bug.st/serial"
+	"golang.org/x/sys/unix"
+)
+
+func setFlowControl(port serial.Port, flow string) error {
+	fd, err := portHandle(port)
+	if err != nil {
+		return err
+	}
+	termios, err := unix.IoctlGetTermios(int(fd), unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	termios.Cflag &^= unix.CRTSCTS
+	termios.Iflag &^= unix.IXON | unix.IXOFF | unix.IXANY
+	switch flow {
+	case FLOW_RTSCTS:
+		termios.Cflag |= unix.CRTSCTS
+	case FLOW_XONXOFF:
+		termios.Iflag |= unix.IXON | unix.IXOFF
+	}
+	return unix.IoctlSetTermios(int(fd), unix.TCSETS, termios)
+}
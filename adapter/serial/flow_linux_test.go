@@ -0,0 +1,56 @@
+package serial
+
+import (
+	"github.com/creack/pty"
+	"go.bug.st/serial"
+	"golang.org/x/sys/unix"
+	"testing"
+)
+
+// a pty stands in for the device, so the pinned serial package is checked without hardware
+func TestSetFlowControl(t *testing.T) {
+	master, slave, err := pty.Open()
+	if err != nil {
+		t.Skip("no pty:", err)
+	}
+	defer master.Close()
+	name := slave.Name()
+	slave.Close()
+	port, err := serial.Open(name, &serial.Mode{BaudRate: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	fd, err := portHandle(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		flow   string
+		cflag  uint32
+		iflag  uint32
+		absent uint32
+	}{
+		{FLOW_RTSCTS, unix.CRTSCTS, 0, unix.IXON | unix.IXOFF},
+		{FLOW_XONXOFF, 0, unix.IXON | unix.IXOFF, 0},
+		{FLOW_NONE, 0, 0, unix.IXON | unix.IXOFF},
+	}
+	for _, test := range tests {
+		if err := setFlowControl(port, test.flow); err != nil {
+			t.Fatalf("%q: %v", test.flow, err)
+		}
+		termios, err := unix.IoctlGetTermios(int(fd), unix.TCGETS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if termios.Cflag&test.cflag != test.cflag || termios.Iflag&test.iflag != test.iflag || termios.Iflag&test.absent != 0 {
+			t.Errorf("%q: cflag %#x iflag %#x", test.flow, termios.Cflag, termios.Iflag)
+		}
+	}
+}
+
+func TestPortHandleUnsupported(t *testing.T) {
+	if _, err := portHandle(nil); err == nil {
+		t.Error("nil port has a handle")
+	}
+}
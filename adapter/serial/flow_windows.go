@@ -0,0 +1,69 @@
+package serial
+
+import (
+	"go.bug.st/serial"
+	"golang.org/x/sys/windows"
+	"unsafe"
+)
+
+var (
+	kernel32         = windows.NewLazySystemDLL("kernel32.dll")
+	procGetCommState = kernel32.NewProc("GetCommState")
+	procSetCommState = kernel32.NewProc("SetCommState")
+)
+
+type dcb struct {
+	DCBlength  uint32
+	BaudRate   uint32
+	Flags      uint32
+	wReserved  uint16
+	XonLim     uint16
+	XoffLim    uint16
+	ByteSize   byte
+	Parity     byte
+	StopBits   byte
+	XonChar    byte
+	XoffChar   byte
+	ErrorChar  byte
+	EofChar    byte
+	EvtChar    byte
+	wReserved1 uint16
+}
+
+const (
+	dcbOutxCtsFlow     = 0x00000004
+	dcbOutX            = 0x00000100
+	dcbInX             = 0x00000200
+	dcbRtsControlMask  = 0x00003000
+	dcbRtsControlOn    = 0x00001000
+	dcbRtsControlShake = 0x00002000
+)
+
+func setFlowControl(port serial.Port, flow string) error {
+	handle, err := portHandle(port)
+	if err != nil {
+		return err
+	}
+	state := dcb{}
+	state.DCBlength = uint32(unsafe.Sizeof(state))
+	if r, _, err := procGetCommState.Call(handle, uintptr(unsafe.Pointer(&state))); r == 0 {
+		return err
+	}
+	state.Flags &^= dcbOutxCtsFlow | dcbOutX | dcbInX | dcbRtsControlMask
+	switch flow {
+	case FLOW_RTSCTS:
+		state.Flags |= dcbOutxCtsFlow | dcbRtsControlShake
+	case FLOW_XONXOFF:
+		state.Flags |= dcbOutX | dcbInX | dcbRtsControlOn
+		state.XonChar = 0x11
+		state.XoffChar = 0x13
+		state.XonLim = 2048
+		state.XoffLim = 512
+	default:
+		state.Flags |= dcbRtsControlOn
+	}
+	if r, _, err := procSetCommState.Call(handle, uintptr(unsafe.Pointer(&state))); r == 0 {
+		return err
+	}
+	return nil
+}
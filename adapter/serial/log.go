@@ -0,0 +1,115 @@
+package serial
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"wterm/core"
+)
+
+const (
+	LOG_TIME_WALL     = "wall"
+	LOG_TIME_RELATIVE = "relative"
+)
+
+const hexWidth = 16
+
+// Logger writes the received data to a file, every line or hex row is prefixed with a timestamp.
+type Logger struct {
+	lock      sync.Mutex
+	file      *os.File
+	start     time.Time
+	relative  bool
+	hex       bool
+	lineStart bool
+}
+
+func NewLogger(title string, ssid uint16, timeMode string, hex bool) (*Logger, error) {
+	now := time.Now()
+	file, err := core.CreateSessionFile(core.MainConfig.Settings.LogDir, title, ssid, now, ".log")
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{
+		file:      file,
+		start:     now,
+		relative:  timeMode == LOG_TIME_RELATIVE,
+		hex:       hex,
+		lineStart: true,
+	}, nil
+}
+
+func (l *Logger) Name() string {
+	return l.file.Name()
+}
+
+func (l *Logger) stamp(now time.Time) string {
+	if l.relative {
+		return fmt.Sprintf("[%10.3f] ", now.Sub(l.start).Seconds())
+	}
+	return now.Format("[2006-01-02 15:04:05.000] ")
+}
+
+// hexDump writes p in rows of hexWidth bytes, each read starts a new row so packets stay apart.
+func (l *Logger) hexDump(buf *bytes.Buffer, stamp string, p []byte) {
+	for len(p) > 0 {
+		row := p
+		if len(row) > hexWidth {
+			row = row[:hexWidth]
+		}
+		p = p[len(row):]
+		buf.WriteString(stamp)
+		for i := 0; i < hexWidth; i++ {
+			if i < len(row) {
+				fmt.Fprintf(buf, "%02x ", row[i])
+			} else {
+				buf.WriteString("   ")
+			}
+		}
+		buf.WriteString(" |")
+		for _, b := range row {
+			if b < ' ' || b > '~' {
+				b = '.'
+			}
+			buf.WriteByte(b)
+		}
+		buf.WriteString("|\n")
+	}
+}
+
+func (l *Logger) Write(p []byte) (n int, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	stamp := l.stamp(time.Now())
+	buf := &bytes.Buffer{}
+	if l.hex {
+		l.hexDump(buf, stamp, p)
+	} else {
+		for _, b := range p {
+			if l.lineStart {
+				buf.WriteString(stamp)
+				l.lineStart = false
+			}
+			buf.WriteByte(b)
+			if b == '\n' {
+				l.lineStart = true
+			}
+		}
+	}
+	_, err = l.file.Write(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (l *Logger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.hex && !l.lineStart {
+		_, _ = l.file.Write([]byte("\n"))
+	}
+	return l.file.Close()
+}
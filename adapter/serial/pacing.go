@@ -0,0 +1,203 @@
+package serial
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	WAIT_NONE   = ""
+	WAIT_ECHO   = "echo"
+	WAIT_PROMPT = "prompt"
+)
+
+const defaultWaitTimeout = 2000
+
+// only the latest received data is kept for matching the echo or prompt
+const pacerReceived = 4096
+
+// pacedChunk is queued input, sent is closed once it went out.
+type pacedChunk struct {
+	data []byte
+	sent chan struct{}
+}
+
+// pacer sends the input in the background with delays between characters and lines,
+// so a paste does not overrun a slow target or block the websocket.
+type pacer struct {
+	config    *Config
+	write     func(p []byte) (int, error)
+	queue     chan pacedChunk
+	done      chan struct{}
+	lock      sync.Mutex
+	received  []byte // data received since the current line started
+	changed   chan struct{}
+	lineStart bool
+}
+
+func newPacer(config *Config, write func(p []byte) (int, error), done chan struct{}) *pacer {
+	p := &pacer{
+		config:    config,
+		write:     write,
+		queue:     make(chan pacedChunk, 64),
+		done:      done,
+		changed:   make(chan struct{}),
+		lineStart: true,
+	}
+	go p.run()
+	return p
+}
+
+func (c *Config) paced() bool {
+	return c.CharDelay > 0 || c.LineDelay > 0 || c.LineWait != WAIT_NONE
+}
+
+func (p *pacer) feed(data []byte) {
+	p.lock.Lock()
+	p.received = append(p.received, data...)
+	if len(p.received) > pacerReceived {
+		p.received = p.received[len(p.received)-pacerReceived:]
+	}
+	close(p.changed)
+	p.changed = make(chan struct{})
+	p.lock.Unlock()
+}
+
+func (p *pacer) reset() {
+	p.lock.Lock()
+	p.received = p.received[:0]
+	p.lock.Unlock()
+}
+
+// waitFor returns once expect was received, the wait times out or the session closes.
+func (p *pacer) waitFor(expect []byte) {
+	timeout := p.config.WaitTimeout
+	if timeout <= 0 {
+		timeout = defaultWaitTimeout
+	}
+	timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+	defer timer.Stop()
+	for {
+		p.lock.Lock()
+		found := bytes.Contains(p.received, expect)
+		changed := p.changed
+		p.lock.Unlock()
+		if found {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *pacer) sleep(ms int) bool {
+	if ms <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+func (p *pacer) send(data []byte) bool {
+	if p.config.CharDelay <= 0 {
+		_, _ = p.write(data)
+		return true
+	}
+	for i := range data {
+		_, _ = p.write(data[i : i+1])
+		if !p.sleep(p.config.CharDelay) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *pacer) run() {
+	line := []byte{}
+	for {
+		var queued pacedChunk
+		select {
+		case <-p.done:
+			return
+		case queued = <-p.queue:
+		}
+		chunk := queued.data
+		for len(chunk) > 0 {
+			end := bytes.IndexAny(chunk, "\r\n")
+			part := chunk
+			if end >= 0 {
+				// CR LF is one line end
+				if chunk[end] == '\r' && end+1 < len(chunk) && chunk[end+1] == '\n' {
+					end++
+				}
+				part = chunk[:end+1]
+			}
+			chunk = chunk[len(part):]
+			if p.lineStart {
+				p.reset()
+				line = line[:0]
+				p.lineStart = false
+			}
+			if !p.send(part) {
+				return
+			}
+			if end < 0 {
+				line = append(line, part...)
+				continue
+			}
+			line = append(line, bytes.TrimRight(part, "\r\n")...)
+			p.lineStart = true
+			switch p.config.LineWait {
+			case WAIT_ECHO:
+				if len(line) > 0 {
+					p.waitFor(line)
+				}
+			case WAIT_PROMPT:
+				p.waitFor([]byte(p.config.Prompt))
+			}
+			if !p.sleep(p.config.LineDelay) {
+				return
+			}
+		}
+		if queued.sent != nil {
+			close(queued.sent)
+		}
+	}
+}
+
+// Write queues a copy of data, it only blocks when the queue is full.
+func (p *pacer) Write(data []byte) (int, error) {
+	chunk := pacedChunk{data: append([]byte{}, data...)}
+	select {
+	case p.queue <- chunk:
+	case <-p.done:
+	}
+	return len(data), nil
+}
+
+// writeWait queues a copy of data and returns once it was sent, after the input queued before it.
+func (p *pacer) writeWait(data []byte) error {
+	chunk := pacedChunk{data: append([]byte{}, data...), sent: make(chan struct{})}
+	select {
+	case p.queue <- chunk:
+	case <-p.done:
+		return io.ErrClosedPipe
+	}
+	select {
+	case <-chunk.sent:
+		return nil
+	case <-p.done:
+		return io.ErrClosedPipe
+	}
+}
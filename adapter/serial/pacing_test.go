@@ -0,0 +1,47 @@
+package serial
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacerWriteWait(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		min    time.Duration
+	}{
+		{"char delay", Config{CharDelay: 5}, 45 * time.Millisecond},
+		{"line delay", Config{LineDelay: 30}, 60 * time.Millisecond},
+		{"prompt timeout", Config{LineWait: WAIT_PROMPT, Prompt: "> ", WaitTimeout: 30}, 60 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lock := sync.Mutex{}
+			sent := &bytes.Buffer{}
+			done := make(chan struct{})
+			defer close(done)
+			p := newPacer(&test.config, func(data []byte) (int, error) {
+				lock.Lock()
+				defer lock.Unlock()
+				return sent.Write(data)
+			}, done)
+			start := time.Now()
+			_, _ = p.Write([]byte("ab\n"))
+			if err := p.writeWait([]byte("cdefg\n")); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < test.min {
+				t.Errorf("sent in %v, want at least %v", elapsed, test.min)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			// the input queued before is sent first
+			if sent.String() != "ab\ncdefg\n" {
+				t.Errorf("sent %q, want %q", sent.String(), "ab\ncdefg\n")
+			}
+		})
+	}
+}
@@ -2,23 +2,215 @@ package serial
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+	"io"
 	"log"
+	"reflect"
+	"sync"
+	"time"
 	"wterm/core"
 )
 
+const (
+	FLOW_NONE    = "none"
+	FLOW_RTSCTS  = "rtscts"
+	FLOW_XONXOFF = "xonxoff"
+)
+
+var parities = map[string]serial.Parity{
+	"none":  serial.NoParity,
+	"odd":   serial.OddParity,
+	"even":  serial.EvenParity,
+	"mark":  serial.MarkParity,
+	"space": serial.SpaceParity,
+}
+
+var stopBits = map[string]serial.StopBits{
+	"1":   serial.OneStopBit,
+	"1.5": serial.OnePointFiveStopBits,
+	"2":   serial.TwoStopBits,
+}
+
+const reconnectInterval = time.Second
+
+var errDisconnected = errors.New("serial port is disconnected")
+
 type Config struct {
 	core.ConfigBase
-	Serial string `json:"serial"`
-	Rate   int    `json:"rate"`
+	Serial   string `json:"serial"`
+	Rate     int    `json:"rate"`
+	DataBits int    `json:"dataBits"` // 5-8, default is 8
+	Parity   string `json:"parity"`   // "none"(default)/"odd"/"even"/"mark"/"space"
+	StopBits string `json:"stopBits"` // "1"(default)/"1.5"/"2"
+	Flow     string `json:"flow"`     // "none"(default)/"rtscts"/"xonxoff"
+	// keep the session when the device goes away and reopen it once it is back
+	Reconnect bool `json:"reconnect,omitempty"`
+	// bind to the usb device with this serial number instead of the Serial path
+	USBSerial string `json:"usbSerial,omitempty"`
+	// log the received data from the start, logging can also be started at runtime
+	Log     bool   `json:"log,omitempty"`
+	LogTime string `json:"logTime,omitempty"` // "wall"(default)/"relative"
+	LogHex  bool   `json:"logHex,omitempty"`  // hex dump instead of text lines
+	// pacing of the input in milliseconds, for targets that drop bytes
+	CharDelay   int    `json:"charDelay,omitempty"`
+	LineDelay   int    `json:"lineDelay,omitempty"`
+	LineWait    string `json:"lineWait,omitempty"`    // wait for "echo" of the line or the "prompt" before the next line
+	Prompt      string `json:"prompt,omitempty"`      // prompt waited for
+	WaitTimeout int    `json:"waitTimeout,omitempty"` // default is 2000
+}
+
+// check fills the defaults and validates the line settings.
+func (c *Config) check() error {
+	if c.Serial == "" && c.USBSerial == "" {
+		return errors.New("no serial port")
+	}
+	if c.Rate <= 0 {
+		return fmt.Errorf("invalid rate: %d", c.Rate)
+	}
+	if c.DataBits == 0 {
+		c.DataBits = 8
+	}
+	if c.DataBits < 5 || c.DataBits > 8 {
+		return fmt.Errorf("invalid data bits: %d", c.DataBits)
+	}
+	if c.Parity == "" {
+		c.Parity = "none"
+	}
+	if _, ok := parities[c.Parity]; !ok {
+		return fmt.Errorf("invalid parity: %s", c.Parity)
+	}
+	if c.StopBits == "" {
+		c.StopBits = "1"
+	}
+	if _, ok := stopBits[c.StopBits]; !ok {
+		return fmt.Errorf("invalid stop bits: %s", c.StopBits)
+	}
+	if c.Flow == "" {
+		c.Flow = FLOW_NONE
+	}
+	if c.Flow != FLOW_NONE && c.Flow != FLOW_RTSCTS && c.Flow != FLOW_XONXOFF {
+		return fmt.Errorf("invalid flow control: %s", c.Flow)
+	}
+	if c.LogTime == "" {
+		c.LogTime = LOG_TIME_WALL
+	}
+	if c.LogTime != LOG_TIME_WALL && c.LogTime != LOG_TIME_RELATIVE {
+		return fmt.Errorf("invalid log time: %s", c.LogTime)
+	}
+	if c.CharDelay < 0 || c.LineDelay < 0 || c.WaitTimeout < 0 {
+		return errors.New("invalid pacing delay")
+	}
+	if c.LineWait != WAIT_NONE && c.LineWait != WAIT_ECHO && c.LineWait != WAIT_PROMPT {
+		return fmt.Errorf("invalid line wait: %s", c.LineWait)
+	}
+	if c.LineWait == WAIT_PROMPT && c.Prompt == "" {
+		return errors.New("no prompt to wait for")
+	}
+	return nil
+}
+
+type PortInfo struct {
+	Name         string `json:"name"`
+	IsUSB        bool   `json:"isUSB"`
+	VID          string `json:"vid"`
+	PID          string `json:"pid"`
+	SerialNumber string `json:"serialNumber"`
+	Product      string `json:"product"`
+}
+
+func ListPorts() ([]PortInfo, error) {
+	list, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil, err
+	}
+	ret := []PortInfo{}
+	for _, port := range list {
+		ret = append(ret, PortInfo{
+			Name:         port.Name,
+			IsUSB:        port.IsUSB,
+			VID:          port.VID,
+			PID:          port.PID,
+			SerialNumber: port.SerialNumber,
+			Product:      port.Product,
+		})
+	}
+	return ret, nil
+}
+
+// portName returns the path of the configured port, a usb serial number is looked up every time.
+func (c *Config) portName() (string, error) {
+	if c.USBSerial == "" {
+		return c.Serial, nil
+	}
+	list, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", err
+	}
+	for _, port := range list {
+		if port.IsUSB && port.SerialNumber == c.USBSerial {
+			return port.Name, nil
+		}
+	}
+	return "", fmt.Errorf("usb serial %s not found", c.USBSerial)
+}
+
+// open opens the configured port with its mode and flow control.
+func (c *Config) open() (serial.Port, error) {
+	name, err := c.portName()
+	if err != nil {
+		return nil, err
+	}
+	port, err := serial.Open(name, &serial.Mode{
+		BaudRate: c.Rate,
+		DataBits: c.DataBits,
+		Parity:   parities[c.Parity],
+		StopBits: stopBits[c.StopBits],
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if c.Flow != FLOW_NONE {
+		if err := setFlowControl(port, c.Flow); err != nil {
+			port.Close()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return port, nil
+}
+
+// portHandle returns the os handle of port, the serial package does not expose flow control.
+// It reads the unexported handle field of the port, so go.mod pins go.bug.st/serial to the
+// version it was written against and an upgrade that changes the field fails here.
+func portHandle(port serial.Port) (uintptr, error) {
+	value := reflect.ValueOf(port)
+	if value.Kind() == reflect.Pointer {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return 0, fmt.Errorf("unsupported serial port type %T", port)
+	}
+	field := value.FieldByName("handle")
+	switch field.Kind() {
+	case reflect.Int:
+		return uintptr(field.Int()), nil
+	case reflect.Uintptr:
+		return uintptr(field.Uint()), nil
+	case reflect.Invalid:
+		return 0, fmt.Errorf("serial port type %T has no handle field, flow control does not support this go.bug.st/serial version", port)
+	}
+	return 0, fmt.Errorf("handle of serial port type %T is a %s, flow control does not support this go.bug.st/serial version", port, field.Kind())
 }
 
 type Instance struct {
 	config Config
+	infoCB func(info core.InfoDesc)
 }
 
-func (instance *Instance) Connect(auth chan bool, callback func(question string)) error {
+func (instance *Instance) Connect(auth chan bool, callback func(question string), info func(info core.InfoDesc)) error {
+	instance.infoCB = info
 	auth <- true
 	return nil
 }
@@ -26,15 +218,37 @@ func (instance *Instance) Connect(auth chan bool, callback func(question string)
 func (instance *Instance) Auth(info core.AuthDesc) {}
 
 func (instance *Instance) NewShell(id uint16) core.ShellSession {
-	port, err := serial.Open(instance.config.Serial, &serial.Mode{
-		BaudRate: instance.config.Rate,
-	})
-	if err != nil {
+	port, err := instance.config.open()
+	if err != nil && !instance.config.Reconnect {
+		instance.infoCB(core.InfoDesc{
+			Type: "ERROR",
+			Info: fmt.Sprintf("[SERIAL] %s", err.Error()),
+		})
 		return nil
 	}
-	return &ShellSession{
+	ss := &ShellSession{
+		config:  &instance.config,
+		ssid:    id,
 		session: port,
+		done:    make(chan struct{}),
+		dtr:     true,
+		rts:     true,
+	}
+	if err != nil {
+		ss.notice = []byte(fmt.Sprintf("[serial] %s, waiting for the device...\r\n", err.Error()))
 	}
+	if instance.config.paced() {
+		ss.pacer = newPacer(ss.config, ss.writePort, ss.done)
+	}
+	if instance.config.Log {
+		if err := ss.StartLog(); err != nil {
+			instance.infoCB(core.InfoDesc{
+				Type: "ERROR",
+				Info: fmt.Sprintf("[SERIAL LOG] %s", err.Error()),
+			})
+		}
+	}
+	return ss
 }
 
 func (instance *Instance) NewFS(id uint16) core.FilesystemSession {
@@ -46,19 +260,248 @@ func (*Instance) IsWindowsPath() bool {
 }
 
 type ShellSession struct {
-	session serial.Port
+	config   *Config
+	ssid     uint16
+	lock     sync.Mutex
+	session  serial.Port // nil while waiting for the device to come back
+	closed   bool
+	done     chan struct{}
+	dtr      bool // the port cannot read back the output lines, they are on after open
+	rts      bool
+	notice   []byte // status lines shown before the next output
+	logger   *Logger
+	pacer    *pacer // nil when the input is sent at once
+	transfer bool   // a modem transfer runs, its data bypasses the pacer
+}
+
+// SetTransfer implements core.TransferSession.
+func (s *ShellSession) SetTransfer(active bool) {
+	s.lock.Lock()
+	s.transfer = active
+	s.lock.Unlock()
+}
+
+func (s *ShellSession) port() serial.Port {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.session
 }
 
 func (s *ShellSession) Read(p []byte) (n int, err error) {
-	return s.session.Read(p)
+	for {
+		s.lock.Lock()
+		if len(s.notice) > 0 {
+			n = copy(p, s.notice)
+			s.notice = s.notice[n:]
+			s.lock.Unlock()
+			return n, nil
+		}
+		port := s.session
+		s.lock.Unlock()
+		if port == nil {
+			if !s.reopen() {
+				return 0, io.EOF
+			}
+			continue
+		}
+		n, err = port.Read(p)
+		if n > 0 {
+			s.log(p[:n])
+			if s.pacer != nil {
+				s.pacer.feed(p[:n])
+			}
+		}
+		if err == nil || !s.config.Reconnect {
+			return n, err
+		}
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			return n, err
+		}
+		port.Close()
+		s.session = nil
+		s.notice = append(s.notice, fmt.Sprintf("\r\n[serial] %s, waiting for the device...\r\n", err.Error())...)
+		s.lock.Unlock()
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// reopen polls until the device is back and opens it with the same mode, it fails once the session is closed.
+func (s *ShellSession) reopen() bool {
+	for {
+		select {
+		case <-s.done:
+			return false
+		case <-time.After(reconnectInterval):
+		}
+		port, err := s.config.open()
+		if err != nil {
+			continue
+		}
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			port.Close()
+			return false
+		}
+		_ = port.SetDTR(s.dtr)
+		_ = port.SetRTS(s.rts)
+		s.session = port
+		s.notice = append(s.notice, "[serial] reconnected\r\n"...)
+		s.lock.Unlock()
+		return true
+	}
 }
 
 func (s *ShellSession) Write(p []byte) (n int, err error) {
-	return s.session.Write(p)
+	s.lock.Lock()
+	transfer := s.transfer
+	s.lock.Unlock()
+	if s.pacer != nil && !transfer {
+		return s.pacer.Write(p)
+	}
+	return s.writePort(p)
+}
+
+// SendPaced implements core.PacedSession, a file sent as text is paced like typed input.
+func (s *ShellSession) SendPaced(data []byte) error {
+	if s.pacer == nil {
+		_, err := s.writePort(data)
+		return err
+	}
+	return s.pacer.writeWait(data)
+}
+
+func (s *ShellSession) writePort(p []byte) (n int, err error) {
+	port := s.port()
+	if port == nil {
+		// input is dropped while the device is away
+		return len(p), nil
+	}
+	n, err = port.Write(p)
+	if err != nil && s.config.Reconnect {
+		return len(p), nil
+	}
+	return n, err
+}
+
+func (s *ShellSession) log(p []byte) {
+	s.lock.Lock()
+	logger := s.logger
+	s.lock.Unlock()
+	if logger != nil {
+		_, _ = logger.Write(p)
+	}
+}
+
+func (s *ShellSession) StartLog() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.logger != nil {
+		return nil
+	}
+	logger, err := NewLogger(s.config.Name, s.ssid, s.config.LogTime, s.config.LogHex)
+	if err != nil {
+		return err
+	}
+	s.logger = logger
+	return nil
+}
+
+func (s *ShellSession) StopLog() error {
+	s.lock.Lock()
+	logger := s.logger
+	s.logger = nil
+	s.lock.Unlock()
+	if logger == nil {
+		return nil
+	}
+	return logger.Close()
 }
 
 func (s *ShellSession) Close() error {
-	return s.session.Close()
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	port := s.session
+	s.lock.Unlock()
+	_ = s.StopLog()
+	if port == nil {
+		return nil
+	}
+	return port.Close()
+}
+
+func (s *ShellSession) Break(duration time.Duration) error {
+	port := s.port()
+	if port == nil {
+		return errDisconnected
+	}
+	return port.Break(duration)
+}
+
+func (s *ShellSession) SetDTR(dtr bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.session == nil {
+		return errDisconnected
+	}
+	err := s.session.SetDTR(dtr)
+	if err == nil {
+		s.dtr = dtr
+	}
+	return err
+}
+
+func (s *ShellSession) SetRTS(rts bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.session == nil {
+		return errDisconnected
+	}
+	err := s.session.SetRTS(rts)
+	if err == nil {
+		s.rts = rts
+	}
+	return err
+}
+
+func (s *ShellSession) SerialStatus() (core.SerialStatusDesc, error) {
+	var bits *serial.ModemStatusBits
+	var err error
+	port := s.port()
+	if port != nil {
+		bits, err = port.GetModemStatusBits()
+	}
+	if bits == nil {
+		if err != nil && !s.config.Reconnect {
+			return core.SerialStatusDesc{}, err
+		}
+		// only the output lines are known while the device is away
+		bits = &serial.ModemStatusBits{}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	log := ""
+	if s.logger != nil {
+		log = s.logger.Name()
+	}
+	return core.SerialStatusDesc{
+		DTR: s.dtr,
+		RTS: s.rts,
+		CTS: bits.CTS,
+		DSR: bits.DSR,
+		RI:  bits.RI,
+		DCD: bits.DCD,
+		Log: log,
+	}, nil
 }
 
 func (s *ShellSession) Resize(rows int, cols int) {
@@ -75,6 +518,11 @@ func (helper *ConfigHelper) LoadConfig(data []byte) interface{} {
 		log.Println(err)
 		return nil
 	}
+	err = ret.check()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
 	return &ret
 }
 
@@ -87,7 +535,7 @@ func (helper *ConfigHelper) StoreConfig(config interface{}) []byte {
 	return ret
 }
 
-func (helper *ConfigHelper) New(config interface{}) core.ServeInstance {
+func (helper *ConfigHelper) New(id uint64, config interface{}) core.ServeInstance {
 	return &Instance{
 		config: *config.(*Config),
 	}
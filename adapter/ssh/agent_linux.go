@@ -0,0 +1,15 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+func dialAgent() (net.Conn, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("SSH_AUTH_SOCK not set")
+	}
+	return net.Dial("unix", sock)
+}
@@ -0,0 +1,15 @@
+package ssh
+
+import (
+	"github.com/Microsoft/go-winio"
+	"net"
+	"os"
+)
+
+func dialAgent() (net.Conn, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		sock = `\\.\pipe\openssh-ssh-agent`
+	}
+	return winio.DialPipe(sock, nil)
+}
@@ -0,0 +1,132 @@
+package ssh
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	AUTH_PUBLICKEY            = "publickey"
+	AUTH_AGENT                = "agent"
+	AUTH_PASSWORD             = "password"
+	AUTH_KEYBOARD_INTERACTIVE = "keyboard-interactive"
+)
+
+var defaultAuthMethods = []string{AUTH_PUBLICKEY, AUTH_AGENT, AUTH_PASSWORD, AUTH_KEYBOARD_INTERACTIVE}
+
+func expandHome(name string) string {
+	if name == "~" || strings.HasPrefix(name, "~/") {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			return filepath.Join(home, name[1:])
+		}
+	}
+	return name
+}
+
+// ask sends question to the client and waits for the answer,
+// without a client it replies with the answer remembered from the first login.
+func (instance *Instance) ask(question string) string {
+	if instance.authCB == nil {
+		return instance.answers[question]
+	}
+	instance.authCB(question)
+	answer := <-instance.answerChan
+	instance.answers[question] = answer
+	return answer
+}
+
+func (instance *Instance) keySigner(conf *Config, label string) ssh.Signer {
+	data, err := os.ReadFile(expandHome(conf.KeyFile))
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	missing := &ssh.PassphraseMissingError{}
+	if errors.As(err, &missing) {
+		passphrase := conf.Passphrase
+		if passphrase == "" {
+			passphrase = instance.ask("passphrase" + label)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return signer
+}
+
+// publicKeys collects key file and agent signers in configured order,
+// they share one method because the client tries every method name only once.
+func (instance *Instance) publicKeys(conf *Config, order []string, label string) func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
+		signers := []ssh.Signer{}
+		for _, name := range order {
+			if name == AUTH_PUBLICKEY && conf.KeyFile != "" {
+				if signer := instance.keySigner(conf, label); signer != nil {
+					signers = append(signers, signer)
+				}
+			} else if name == AUTH_AGENT {
+				conn, err := dialAgent()
+				if err != nil {
+					continue
+				}
+				instance.closers = append(instance.closers, conn)
+				list, err := agent.NewClient(conn).Signers()
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				signers = append(signers, list...)
+			}
+		}
+		return signers, nil
+	}
+}
+
+func (instance *Instance) challenge(label string) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := []string{}
+		for _, question := range questions {
+			answers = append(answers, instance.ask(strings.TrimSpace(question)+label))
+		}
+		return answers, nil
+	}
+}
+
+// authMethods builds auth methods of conf, label tells the user which hop a question belongs to.
+func (instance *Instance) authMethods(conf *Config, label string) []ssh.AuthMethod {
+	order := conf.AuthMethods
+	if len(order) == 0 {
+		order = defaultAuthMethods
+	}
+	authMethods := []ssh.AuthMethod{}
+	hasPublicKey := false
+	for _, name := range order {
+		switch name {
+		case AUTH_PUBLICKEY, AUTH_AGENT:
+			if !hasPublicKey {
+				hasPublicKey = true
+				authMethods = append(authMethods, ssh.PublicKeysCallback(instance.publicKeys(conf, order, label)))
+			}
+		case AUTH_PASSWORD:
+			if conf.Password != "" {
+				authMethods = append(authMethods, ssh.Password(conf.Password))
+			} else {
+				authMethods = append(authMethods, ssh.PasswordCallback(func() (secret string, err error) {
+					return instance.ask("password" + label), nil
+				}))
+			}
+		case AUTH_KEYBOARD_INTERACTIVE:
+			authMethods = append(authMethods, ssh.KeyboardInteractive(instance.challenge(label)))
+		}
+	}
+	return authMethods
+}
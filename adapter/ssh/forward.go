@@ -0,0 +1,354 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"wterm/core"
+)
+
+const (
+	FORWARD_LOCAL   = "local"
+	FORWARD_REMOTE  = "remote"
+	FORWARD_DYNAMIC = "dynamic"
+)
+
+type ForwardConfig struct {
+	Type   string `json:"type"`   // "local"/"remote"/"dynamic"
+	Bind   string `json:"bind"`   // listen address, on the remote side for remote forwards
+	Target string `json:"target"` // destination address, unused for dynamic forwards
+}
+
+type ForwardInfo struct {
+	Id uint64 `json:"id"`
+	ForwardConfig
+	Active   int64  `json:"active"`
+	Total    int64  `json:"total"`
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+}
+
+type Forward struct {
+	id       uint64
+	config   ForwardConfig
+	lock     sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool // nil once closed
+	active   int64
+	total    int64
+	sent     uint64
+	received uint64
+}
+
+func (f *Forward) Info() ForwardInfo {
+	return ForwardInfo{
+		Id:            f.id,
+		ForwardConfig: f.config,
+		Active:        atomic.LoadInt64(&f.active),
+		Total:         atomic.LoadInt64(&f.total),
+		Sent:          atomic.LoadUint64(&f.sent),
+		Received:      atomic.LoadUint64(&f.received),
+	}
+}
+
+func (f *Forward) track(conn net.Conn) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.conns == nil {
+		conn.Close()
+		return false
+	}
+	f.conns[conn] = true
+	return true
+}
+
+func (f *Forward) untrack(conn net.Conn) {
+	f.lock.Lock()
+	if f.conns != nil {
+		delete(f.conns, conn)
+	}
+	f.lock.Unlock()
+	conn.Close()
+}
+
+func (f *Forward) Close() error {
+	f.lock.Lock()
+	listener := f.listener
+	conns := f.conns
+	f.listener = nil
+	f.conns = nil
+	f.lock.Unlock()
+	var err error
+	if listener != nil {
+		err = listener.Close()
+	}
+	for conn := range conns {
+		conn.Close()
+	}
+	return err
+}
+
+// start swaps in listener and serves it, a closed forward closes it instead.
+func (f *Forward) start(listener net.Listener, dial func(conn net.Conn) (net.Conn, error)) {
+	f.lock.Lock()
+	if f.conns == nil {
+		f.lock.Unlock()
+		listener.Close()
+		return
+	}
+	old := f.listener
+	f.listener = listener
+	f.lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	go f.serve(listener, dial)
+}
+
+type countWriter struct {
+	io.Writer
+	counter *uint64
+}
+
+func (w *countWriter) Write(p []byte) (n int, err error) {
+	n, err = w.Writer.Write(p)
+	atomic.AddUint64(w.counter, uint64(n))
+	return n, err
+}
+
+// pipe copies between the accepted conn and the dialed conn until either side closes.
+func (f *Forward) pipe(accepted net.Conn, dial func() (net.Conn, error)) {
+	atomic.AddInt64(&f.total, 1)
+	atomic.AddInt64(&f.active, 1)
+	defer atomic.AddInt64(&f.active, -1)
+	if !f.track(accepted) {
+		return
+	}
+	defer f.untrack(accepted)
+	dialed, err := dial()
+	if err != nil {
+		return
+	}
+	if !f.track(dialed) {
+		return
+	}
+	defer f.untrack(dialed)
+	// sent counts bytes leaving this machine
+	outbound, inbound := &f.sent, &f.received
+	if f.config.Type == FORWARD_REMOTE {
+		outbound, inbound = inbound, outbound
+	}
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(&countWriter{dialed, outbound}, accepted)
+		done <- true
+	}()
+	go func() {
+		io.Copy(&countWriter{accepted, inbound}, dialed)
+		done <- true
+	}()
+	<-done
+}
+
+func (f *Forward) serve(listener net.Listener, dial func(conn net.Conn) (net.Conn, error)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.pipe(conn, func() (net.Conn, error) {
+			return dial(conn)
+		})
+	}
+}
+
+// socks5Handshake answers a SOCKS5 CONNECT request without auth and returns the requested address.
+func socks5Handshake(conn net.Conn) (string, error) {
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 5 {
+		return "", errors.New("unsupported socks version")
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return "", err
+	}
+	if buf[1] != 1 {
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return "", errors.New("unsupported socks command")
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(conn, buf[:net.IPv4len]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return "", err
+		}
+		length := int(buf[0])
+		if _, err := io.ReadFull(conn, buf[:length]); err != nil {
+			return "", err
+		}
+		host = string(buf[:length])
+	case 4:
+		if _, err := io.ReadFull(conn, buf[:net.IPv6len]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	default:
+		conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return "", errors.New("unsupported socks address type")
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func (c *Client) dial(address string) (net.Conn, error) {
+	client := c.current()
+	if client == nil {
+		return nil, errors.New("not connected")
+	}
+	return client.Dial("tcp", address)
+}
+
+// listen opens the listener of config and returns how its connections are dialed,
+// remote listeners belong to the current client.
+func (c *Client) listen(config ForwardConfig) (net.Listener, func(conn net.Conn) (net.Conn, error), error) {
+	switch config.Type {
+	case FORWARD_LOCAL:
+		listener, err := net.Listen("tcp", config.Bind)
+		return listener, func(conn net.Conn) (net.Conn, error) {
+			return c.dial(config.Target)
+		}, err
+	case FORWARD_REMOTE:
+		client := c.current()
+		if client == nil {
+			return nil, nil, errors.New("not connected")
+		}
+		listener, err := client.Listen("tcp", config.Bind)
+		return listener, func(conn net.Conn) (net.Conn, error) {
+			return net.Dial("tcp", config.Target)
+		}, err
+	case FORWARD_DYNAMIC:
+		listener, err := net.Listen("tcp", config.Bind)
+		return listener, func(conn net.Conn) (net.Conn, error) {
+			address, err := socks5Handshake(conn)
+			if err != nil {
+				return nil, err
+			}
+			dialed, err := c.dial(address)
+			if err != nil {
+				conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+				return nil, err
+			}
+			_, err = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			if err != nil {
+				dialed.Close()
+				return nil, err
+			}
+			return dialed, nil
+		}, err
+	default:
+		return nil, nil, fmt.Errorf("unknown forward type: %s", config.Type)
+	}
+}
+
+func (c *Client) startForward(config ForwardConfig) (*Forward, error) {
+	listener, dial, err := c.listen(config)
+	if err != nil {
+		return nil, err
+	}
+	forward := &Forward{
+		id:     atomic.AddUint64(&c.forwardName, 1),
+		config: config,
+		conns:  map[net.Conn]bool{},
+	}
+	forward.start(listener, dial)
+	c.forwardLock.Lock()
+	c.forwards = append(c.forwards, forward)
+	c.forwardLock.Unlock()
+	return forward, nil
+}
+
+// restartForwards listens again for remote forwards, their listeners died with the old client.
+// The listeners are opened outside forwardLock, a forward removed meanwhile closes its new one.
+func (c *Client) restartForwards() {
+	c.forwardLock.Lock()
+	remote := []*Forward{}
+	for _, forward := range c.forwards {
+		if forward.config.Type == FORWARD_REMOTE {
+			remote = append(remote, forward)
+		}
+	}
+	c.forwardLock.Unlock()
+	for _, forward := range remote {
+		listener, dial, err := c.listen(forward.config)
+		if err != nil {
+			go c.info(core.InfoDesc{
+				Type: "ERROR",
+				Info: fmt.Sprintf("[SSH FORWARD] %s %s: %s", forward.config.Type, forward.config.Bind, err.Error()),
+			})
+			continue
+		}
+		forward.start(listener, dial)
+	}
+}
+
+func (c *Client) AddForward(config ForwardConfig) (ForwardInfo, error) {
+	forward, err := c.startForward(config)
+	if err != nil {
+		return ForwardInfo{}, err
+	}
+	return forward.Info(), nil
+}
+
+func (c *Client) RemoveForward(id uint64) bool {
+	c.forwardLock.Lock()
+	defer c.forwardLock.Unlock()
+	for index, forward := range c.forwards {
+		if forward.id == id {
+			forward.Close()
+			c.forwards = append(c.forwards[:index:index], c.forwards[index+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) Forwards() []ForwardInfo {
+	c.forwardLock.Lock()
+	defer c.forwardLock.Unlock()
+	ret := []ForwardInfo{}
+	for _, forward := range c.forwards {
+		ret = append(ret, forward.Info())
+	}
+	return ret
+}
+
+func (c *Client) closeForwards() {
+	c.forwardLock.Lock()
+	forwards := c.forwards
+	c.forwards = nil
+	c.forwardLock.Unlock()
+	for _, forward := range forwards {
+		forward.Close()
+	}
+}
@@ -0,0 +1,48 @@
+package ssh
+
+import (
+	"net"
+	"testing"
+)
+
+func TestForwardStart(t *testing.T) {
+	listen := func() net.Listener {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip("cannot listen:", err)
+		}
+		return listener
+	}
+	// closed tells whether a listener was closed, it no longer accepts once it is
+	closed := func(listener net.Listener) bool {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return true
+		}
+		conn.Close()
+		return false
+	}
+	dial := func(conn net.Conn) (net.Conn, error) {
+		return nil, net.ErrClosed
+	}
+	f := &Forward{conns: map[net.Conn]bool{}}
+	first := listen()
+	f.start(first, dial)
+	second := listen()
+	f.start(second, dial)
+	if !closed(first) {
+		t.Error("the swapped out listener is still open")
+	}
+	if closed(second) {
+		t.Error("the swapped in listener is closed")
+	}
+	f.Close()
+	if !closed(second) {
+		t.Error("the listener is open after Close")
+	}
+	third := listen()
+	f.start(third, dial)
+	if !closed(third) {
+		t.Error("a closed forward kept a new listener")
+	}
+}
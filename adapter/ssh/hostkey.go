@@ -0,0 +1,182 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"wterm/core"
+)
+
+// KnownHostsFile is managed by wterm, accepted keys are appended here.
+var KnownHostsFile = ""
+
+func knownHostsFiles() []string {
+	files := []string{}
+	home, err := os.UserHomeDir()
+	if err == nil {
+		files = append(files, filepath.Join(home, ".ssh", "known_hosts"))
+	}
+	if KnownHostsFile != "" {
+		files = append(files, KnownHostsFile)
+	}
+	ret := []string{}
+	for _, name := range files {
+		if _, err := os.Stat(name); err == nil {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+func trustHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if KnownHostsFile == "" {
+		return errors.New("no known hosts file to save host key")
+	}
+	file, err := os.OpenFile(KnownHostsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	addresses := []string{knownhosts.Normalize(hostname)}
+	// connections through a jump host have no real remote address
+	if tcpAddr, ok := remote.(*net.TCPAddr); ok && !tcpAddr.IP.IsUnspecified() {
+		if address := knownhosts.Normalize(remote.String()); address != addresses[0] {
+			addresses = append(addresses, address)
+		}
+	}
+	_, err = file.WriteString(knownhosts.Line(addresses, key) + "\n")
+	return err
+}
+
+// defaultHostKeyAlgorithms is the preference order of x/crypto, known key types are moved in front of it.
+var defaultHostKeyAlgorithms = []string{
+	ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+	ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+	ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+
+	ssh.KeyAlgoED25519,
+}
+
+// probeKey matches no known key, checking it lists every known key of a host.
+type probeKey struct{}
+
+func (probeKey) Type() string {
+	return "wterm-probe"
+}
+
+func (probeKey) Marshal() []byte {
+	return []byte("wterm-probe")
+}
+
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error {
+	return errors.New("probe key")
+}
+
+// knownHostKeys returns the keys saved for hostname, one for each key type.
+func knownHostKeys(hostname string) []knownhosts.KnownKey {
+	files := knownHostsFiles()
+	if len(files) == 0 {
+		return nil
+	}
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil
+	}
+	keyErr := &knownhosts.KeyError{}
+	if !errors.As(callback(hostname, &net.TCPAddr{IP: net.IPv4zero}, probeKey{}), &keyErr) {
+		return nil
+	}
+	return keyErr.Want
+}
+
+// hostKeyAlgorithms prefers the key types saved for hostname, so a host known by its ed25519 key
+// is not asked for the ecdsa key x/crypto prefers, the others stay as a fallback.
+func hostKeyAlgorithms(hostname string) []string {
+	known := map[string]bool{}
+	for _, want := range knownHostKeys(hostname) {
+		switch keyType := want.Key.Type(); keyType {
+		case ssh.KeyAlgoRSA:
+			known[ssh.KeyAlgoRSASHA512] = true
+			known[ssh.KeyAlgoRSASHA256] = true
+			known[ssh.KeyAlgoRSA] = true
+		default:
+			known[keyType] = true
+		}
+	}
+	if len(known) == 0 {
+		return nil
+	}
+	ret := []string{}
+	for _, algo := range defaultHostKeyAlgorithms {
+		if known[algo] {
+			ret = append(ret, algo)
+		}
+	}
+	for _, algo := range defaultHostKeyAlgorithms {
+		if !known[algo] {
+			ret = append(ret, algo)
+		}
+	}
+	return ret
+}
+
+func (instance *Instance) hostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+	// types of the keys known for the host, a server offering only another type could be a man-in-the-middle
+	knownTypes := []string{}
+	files := knownHostsFiles()
+	if len(files) > 0 {
+		callback, err := knownhosts.New(files...)
+		if err != nil {
+			return err
+		}
+		err = callback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		keyErr := &knownhosts.KeyError{}
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		// only a different key of the same type is a change, a host only known by keys of
+		// other types is asked like an unknown host
+		for _, want := range keyErr.Want {
+			if want.Key.Type() != key.Type() {
+				knownTypes = append(knownTypes, want.Key.Type())
+				continue
+			}
+			instance.infoCB(core.InfoDesc{
+				Type: "ERROR",
+				Info: fmt.Sprintf("[SSH] host key of %s has changed to %s %s, it does not match the key at %s:%d, someone could be eavesdropping (man-in-the-middle attack), remove the old key if the change is expected",
+					hostname, key.Type(), fingerprint, want.Filename, want.Line),
+			})
+			return err
+		}
+	}
+	question := fmt.Sprintf("unknown host key of %s: %s %s, input yes to trust", hostname, key.Type(), fingerprint)
+	if len(knownTypes) > 0 {
+		question = fmt.Sprintf("unknown host key of %s: %s %s, WARNING: keys of a different type are already known for this host (%s), someone could be eavesdropping, input yes to trust",
+			hostname, key.Type(), fingerprint, strings.Join(knownTypes, ", "))
+	}
+	answer := instance.ask(question)
+	if answer != "yes" {
+		return errors.New("host key rejected")
+	}
+	err := trustHostKey(hostname, remote, key)
+	if err != nil {
+		instance.infoCB(core.InfoDesc{
+			Type: "ERROR",
+			Info: fmt.Sprintf("[SSH] cannot save host key: %s", err.Error()),
+		})
+	}
+	return nil
+}
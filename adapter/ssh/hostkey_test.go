@@ -0,0 +1,199 @@
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"wterm/core"
+)
+
+func testPublicKey(t *testing.T, keyType string) ssh.PublicKey {
+	var raw interface{}
+	var err error
+	switch keyType {
+	case ssh.KeyAlgoED25519:
+		raw, _, err = ed25519.GenerateKey(rand.Reader)
+	case ssh.KeyAlgoECDSA256:
+		var key *ecdsa.PrivateKey
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err == nil {
+			raw = &key.PublicKey
+		}
+	case ssh.KeyAlgoRSA:
+		var key *rsa.PrivateKey
+		key, err = rsa.GenerateKey(rand.Reader, 1024)
+		if err == nil {
+			raw = &key.PublicKey
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// useKnownHosts points the known hosts files at a temporary directory holding lines.
+func useKnownHosts(t *testing.T, lines ...string) string {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("USERPROFILE", dir)
+	old := KnownHostsFile
+	KnownHostsFile = filepath.Join(dir, "known_hosts")
+	t.Cleanup(func() {
+		KnownHostsFile = old
+	})
+	content := ""
+	for _, line := range lines {
+		content += line + "\n"
+	}
+	if err := os.WriteFile(KnownHostsFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return KnownHostsFile
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	ed := testPublicKey(t, ssh.KeyAlgoED25519)
+	ec := testPublicKey(t, ssh.KeyAlgoECDSA256)
+	rsaKey := testPublicKey(t, ssh.KeyAlgoRSA)
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string // expected head of the list
+	}{
+		{"unknown host", nil, nil},
+		{"other host", []string{knownhosts.Line([]string{"other.example.com"}, ed)}, nil},
+		{"ed25519 first", []string{knownhosts.Line([]string{"a.example.com"}, ed)}, []string{ssh.KeyAlgoED25519}},
+		{"rsa covers its signatures", []string{knownhosts.Line([]string{"a.example.com"}, rsaKey)},
+			[]string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}},
+		{"keeps the default order", []string{
+			knownhosts.Line([]string{"a.example.com"}, ed),
+			knownhosts.Line([]string{"a.example.com"}, ec),
+		}, []string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoED25519}},
+		{"non default port", []string{knownhosts.Line([]string{"[a.example.com]:2222"}, ed)}, nil},
+	}
+	for _, test := range tests {
+		useKnownHosts(t, test.lines...)
+		got := hostKeyAlgorithms("a.example.com:22")
+		if test.want == nil {
+			if got != nil {
+				t.Errorf("%s: got %v", test.name, got)
+			}
+			continue
+		}
+		if len(got) != len(defaultHostKeyAlgorithms) || !reflect.DeepEqual(got[:len(test.want)], test.want) {
+			t.Errorf("%s: got %v, want it to start with %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	ed := testPublicKey(t, ssh.KeyAlgoED25519)
+	ec := testPublicKey(t, ssh.KeyAlgoECDSA256)
+	otherEd := testPublicKey(t, ssh.KeyAlgoED25519)
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+	tests := []struct {
+		name    string
+		lines   []string
+		key     ssh.PublicKey
+		answer  string
+		asked   bool
+		warned  bool // the question warns of keys of another type
+		err     bool
+		changed bool // reported as a changed key
+		saved   bool // a line was appended
+	}{
+		{"known key", []string{knownhosts.Line([]string{"a.example.com"}, ed)}, ed, "", false, false, false, false, false},
+		{"changed key of the same type", []string{knownhosts.Line([]string{"a.example.com"}, ed)}, otherEd, "yes", false, false, true, true, false},
+		{"key of another type is asked", []string{knownhosts.Line([]string{"a.example.com"}, ec)}, ed, "yes", true, true, false, false, true},
+		{"key of another type rejected", []string{knownhosts.Line([]string{"a.example.com"}, ec)}, ed, "no", true, true, true, false, false},
+		{"unknown host trusted", nil, ed, "yes", true, false, false, false, true},
+		{"unknown host rejected", nil, ed, "no", true, false, true, false, false},
+		{"revoked key", []string{"@revoked " + knownhosts.Line([]string{"*"}, ed)}, ed, "yes", false, false, true, false, false},
+	}
+	for _, test := range tests {
+		filename := useKnownHosts(t, test.lines...)
+		infos := []core.InfoDesc{}
+		asked := ""
+		instance := &Instance{
+			answerChan: make(chan string, 1),
+			answers:    map[string]string{},
+			authCB: func(question string) {
+				asked = question
+			},
+			infoCB: func(info core.InfoDesc) {
+				infos = append(infos, info)
+			},
+		}
+		instance.answerChan <- test.answer
+		err := instance.hostKeyCallback("a.example.com:22", remote, test.key)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+		if (asked != "") != test.asked || strings.Contains(asked, "different type") != test.warned {
+			t.Errorf("%s: asked %q", test.name, asked)
+		}
+		changed := len(infos) > 0 && strings.Contains(infos[0].Info, "has changed")
+		if changed != test.changed {
+			t.Errorf("%s: reported %+v", test.name, infos)
+		}
+		data, _ := os.ReadFile(filename)
+		saved := strings.Count(string(data), "\n") > len(test.lines)
+		if saved != test.saved {
+			t.Errorf("%s: known_hosts is %q", test.name, data)
+		}
+		if saved {
+			// the saved line is accepted on the next connection
+			callback, err := knownhosts.New(filename)
+			if err == nil {
+				err = callback("a.example.com:22", remote, test.key)
+			}
+			if err != nil {
+				t.Errorf("%s: saved key not accepted: %v", test.name, err)
+			}
+		}
+	}
+}
+
+func TestTrustHostKeyAddresses(t *testing.T) {
+	key := testPublicKey(t, ssh.KeyAlgoED25519)
+	tests := []struct {
+		name     string
+		hostname string
+		remote   net.Addr
+		want     []string
+	}{
+		{"hostname and address", "a.example.com:22", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}, []string{"a.example.com", "10.0.0.1"}},
+		{"same address once", "10.0.0.1:22", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}, []string{"10.0.0.1"}},
+		{"through a jump host", "a.example.com:2222", &net.TCPAddr{IP: net.IPv4zero}, []string{"[a.example.com]:2222"}},
+	}
+	for _, test := range tests {
+		filename := useKnownHosts(t)
+		if err := trustHostKey(test.hostname, test.remote, key); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		data, _ := os.ReadFile(filename)
+		want := knownhosts.Line(test.want, key) + "\n"
+		if string(data) != want {
+			t.Errorf("%s: saved %q, want %q", test.name, data, want)
+		}
+	}
+	KnownHostsFile = ""
+	if err := trustHostKey("a.example.com:22", nil, key); err == nil {
+		t.Error("saved without a known hosts file")
+	}
+}
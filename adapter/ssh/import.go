@@ -0,0 +1,256 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type openSSHBlock struct {
+	patterns []string // nil for a Match block, which is never applied
+	options  [][2]string
+}
+
+const maxIncludeDepth = 16
+
+// splitOpenSSHLine splits a config line into keyword and arguments, it accepts both "key value" and "key=value".
+func splitOpenSSHLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil
+	}
+	index := strings.IndexAny(line, " \t=")
+	if index < 0 {
+		return strings.ToLower(line), nil
+	}
+	key := strings.ToLower(line[:index])
+	rest := strings.TrimLeft(line[index:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+	args := []string{}
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				args = append(args, rest[1:])
+				break
+			}
+			args = append(args, rest[1:end+1])
+			rest = rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, " \t")
+			if end < 0 {
+				args = append(args, rest)
+				break
+			}
+			args = append(args, rest[:end])
+			rest = rest[end:]
+		}
+	}
+	return key, args
+}
+
+// readOpenSSHConfig appends the blocks of filename, options before its first Host belong to current,
+// the block the file is included from.
+func readOpenSSHConfig(filename string, depth int, blocks []*openSSHBlock, current *openSSHBlock) ([]*openSSHBlock, error) {
+	if depth > maxIncludeDepth {
+		return nil, errors.New("too many nested includes")
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, args := splitOpenSSHLine(scanner.Text())
+		if key == "" {
+			continue
+		}
+		switch key {
+		case "host":
+			current = &openSSHBlock{patterns: args}
+			blocks = append(blocks, current)
+		case "match":
+			current = &openSSHBlock{}
+			blocks = append(blocks, current)
+		case "include":
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(expandHome("~/.ssh"), pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return nil, err
+				}
+				for _, name := range matches {
+					blocks, err = readOpenSSHConfig(name, depth+1, blocks, current)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		default:
+			if len(args) == 0 {
+				continue
+			}
+			if blocks[len(blocks)-1] != current {
+				// blocks of an included file came in between, continue current after them to keep the order
+				current = &openSSHBlock{patterns: current.patterns}
+				blocks = append(blocks, current)
+			}
+			current.options = append(current.options, [2]string{key, strings.Join(args, " ")})
+		}
+	}
+	return blocks, scanner.Err()
+}
+
+func (block *openSSHBlock) match(alias string) bool {
+	if block.patterns == nil {
+		return false
+	}
+	matched := false
+	for _, pattern := range block.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		ok, _ := path.Match(pattern, alias)
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// lookup applies every matching block in order, the first value of a keyword wins like in OpenSSH.
+func lookupOpenSSH(blocks []*openSSHBlock, alias string) map[string]string {
+	ret := map[string]string{}
+	for _, block := range blocks {
+		if !block.match(alias) {
+			continue
+		}
+		for _, option := range block.options {
+			if _, ok := ret[option[0]]; !ok {
+				ret[option[0]] = option[1]
+			}
+		}
+	}
+	return ret
+}
+
+func openSSHHost(blocks []*openSSHBlock, alias string, depth int) (*Config, error) {
+	options := lookupOpenSSH(blocks, alias)
+	conf := &Config{
+		Host:     alias,
+		Port:     22,
+		Username: options["user"],
+	}
+	conf.Type = "ssh"
+	conf.Name = alias
+	conf.Import = alias
+	if hostname, ok := options["hostname"]; ok {
+		conf.Host = strings.ReplaceAll(hostname, "%h", alias)
+	}
+	if port, ok := options["port"]; ok {
+		value, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+		conf.Port = value
+	}
+	if identity, ok := options["identityfile"]; ok && identity != "none" {
+		conf.KeyFile = identity
+	}
+	if proxyJump, ok := options["proxyjump"]; ok && proxyJump != "none" {
+		if depth >= maxJumps {
+			return nil, errors.New("too many jump hosts")
+		}
+		for _, hop := range strings.Split(proxyJump, ",") {
+			jump, err := openSSHJump(blocks, strings.TrimSpace(hop), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			conf.Jumps = append(conf.Jumps, jump...)
+		}
+	}
+	return conf, nil
+}
+
+// openSSHJump turns a ProxyJump entry "[user@]host[:port]" into jump hosts, aliases bring their own jumps.
+func openSSHJump(blocks []*openSSHBlock, hop string, depth int) ([]JumpConfig, error) {
+	username := ""
+	if index := strings.LastIndexByte(hop, '@'); index >= 0 {
+		username = hop[:index]
+		hop = hop[index+1:]
+	}
+	port := 0
+	if index := strings.LastIndexByte(hop, ':'); index >= 0 && !strings.Contains(hop[:index], ":") {
+		value, err := strconv.Atoi(hop[index+1:])
+		if err != nil {
+			return nil, err
+		}
+		port = value
+		hop = hop[:index]
+	}
+	conf, err := openSSHHost(blocks, hop, depth)
+	if err != nil {
+		return nil, err
+	}
+	if username != "" {
+		conf.Username = username
+	}
+	if port != 0 {
+		conf.Port = port
+	}
+	return append(conf.Jumps, JumpConfig{
+		Host:     conf.Host,
+		Port:     conf.Port,
+		Username: conf.Username,
+		KeyFile:  conf.KeyFile,
+	}), nil
+}
+
+// ImportOpenSSH reads an OpenSSH client config file and returns a config for every concrete Host alias.
+func ImportOpenSSH(filename string) ([]*Config, error) {
+	global := &openSSHBlock{patterns: []string{"*"}}
+	blocks, err := readOpenSSHConfig(expandHome(filename), 0, []*openSSHBlock{global}, global)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*Config{}
+	seen := map[string]bool{}
+	for _, block := range blocks {
+		for _, alias := range block.patterns {
+			if seen[alias] || strings.ContainsAny(alias, "*?!") {
+				continue
+			}
+			seen[alias] = true
+			conf, err := openSSHHost(blocks, alias, 0)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, conf)
+		}
+	}
+	return ret, nil
+}
+
+// MergeImport updates c with an imported OpenSSH config, which stays the source of what it sets:
+// Host, Port and Jumps are always replaced, Username and KeyFile when the import sets them.
+// The name, secrets, auth methods, forwards and keepalive edited in wterm are kept.
+func (c *Config) MergeImport(imported *Config) {
+	c.Import = imported.Import
+	c.Host = imported.Host
+	c.Port = imported.Port
+	if imported.Username != "" {
+		c.Username = imported.Username
+	}
+	if imported.KeyFile != "" {
+		c.KeyFile = imported.KeyFile
+	}
+	c.Jumps = imported.Jumps
+}
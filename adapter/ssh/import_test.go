@@ -0,0 +1,232 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitOpenSSHLine(t *testing.T) {
+	tests := []struct {
+		line string
+		key  string
+		args []string
+	}{
+		{"", "", nil},
+		{"   # comment", "", nil},
+		{"Host a b", "host", []string{"a", "b"}},
+		{"  HostName=example.com", "hostname", []string{"example.com"}},
+		{"Port = 2222", "port", []string{"2222"}},
+		{"User\troot", "user", []string{"root"}},
+		{`IdentityFile "~/my keys/id"`, "identityfile", []string{"~/my keys/id"}},
+		{`IdentityFile "unterminated path`, "identityfile", []string{"unterminated path"}},
+		{"Compression", "compression", nil},
+	}
+	for _, test := range tests {
+		key, args := splitOpenSSHLine(test.line)
+		if key != test.key || (len(args) != 0 || len(test.args) != 0) && !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%q: got %q %q, want %q %q", test.line, key, args, test.key, test.args)
+		}
+	}
+}
+
+// writeConfigs writes files into a temporary directory, "DIR" in the contents is replaced with it.
+func writeConfigs(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		content = strings.ReplaceAll(content, "DIR", dir)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestImportOpenSSH(t *testing.T) {
+	type host struct {
+		host     string
+		port     int
+		username string
+		keyFile  string
+		jumps    []JumpConfig
+	}
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  map[string]host
+	}{
+		{
+			name: "defaults and first value wins",
+			files: map[string]string{"config": `
+Host a
+  HostName a.example.com
+  Port 2200
+  User alice
+Host a
+  User other
+Host *
+  User everyone
+  IdentityFile ~/.ssh/id_ed25519
+`},
+			want: map[string]host{
+				"a": {"a.example.com", 2200, "alice", "~/.ssh/id_ed25519", nil},
+			},
+		},
+		{
+			name: "patterns and negation",
+			files: map[string]string{"config": `
+Host web1 web2 db
+Host web* !web2
+  User deploy
+Host db
+  HostName %h.internal
+`},
+			want: map[string]host{
+				"web1": {"web1", 22, "deploy", "", nil},
+				"web2": {"web2", 22, "", "", nil},
+				"db":   {"db.internal", 22, "", "", nil},
+			},
+		},
+		{
+			name: "match blocks are skipped",
+			files: map[string]string{"config": `
+Match user root
+  User nobody
+Host a
+`},
+			want: map[string]host{
+				"a": {"a", 22, "", "", nil},
+			},
+		},
+		{
+			name: "include inside a host block is scoped to it",
+			files: map[string]string{
+				"config": `
+Host a
+  Include DIR/extra
+  Port 2200
+Host b
+`,
+				"extra": `
+User fromextra
+Host c
+  User carol
+`,
+			},
+			want: map[string]host{
+				"a": {"a", 2200, "fromextra", "", nil},
+				"b": {"b", 22, "", "", nil},
+				"c": {"c", 22, "carol", "", nil},
+			},
+		},
+		{
+			name: "included globs at the top level",
+			files: map[string]string{
+				"config": `
+Include DIR/conf.*
+Host c
+  User late
+`,
+				"conf.1": "Host a\n  Port 1\n",
+				"conf.2": "Host b\n  Port 2\n",
+			},
+			want: map[string]host{
+				"a": {"a", 1, "", "", nil},
+				"b": {"b", 2, "", "", nil},
+				"c": {"c", 22, "late", "", nil},
+			},
+		},
+		{
+			name: "proxy jump through an alias and a literal",
+			files: map[string]string{"config": `
+Host bastion
+  HostName bastion.example.com
+  User jump
+  IdentityFile ~/.ssh/jump
+Host inner
+  ProxyJump bastion,admin@10.0.0.1:2222
+`},
+			want: map[string]host{
+				"bastion": {"bastion.example.com", 22, "jump", "~/.ssh/jump", nil},
+				"inner": {"inner", 22, "", "", []JumpConfig{
+					{Host: "bastion.example.com", Port: 22, Username: "jump", KeyFile: "~/.ssh/jump"},
+					{Host: "10.0.0.1", Port: 2222, Username: "admin"},
+				}},
+			},
+		},
+		{
+			name: "proxy jump none",
+			files: map[string]string{"config": `
+Host a
+  ProxyJump none
+  IdentityFile none
+`},
+			want: map[string]host{
+				"a": {"a", 22, "", "", nil},
+			},
+		},
+	}
+	for _, test := range tests {
+		dir := writeConfigs(t, test.files)
+		configs, err := ImportOpenSSH(filepath.Join(dir, "config"))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got := map[string]host{}
+		for _, conf := range configs {
+			if conf.Type != "ssh" || conf.Name != conf.Import {
+				t.Errorf("%s: %s has type %q and name %q", test.name, conf.Import, conf.Type, conf.Name)
+			}
+			got[conf.Import] = host{conf.Host, conf.Port, conf.Username, conf.KeyFile, conf.Jumps}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestImportOpenSSHErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"bad port", map[string]string{"config": "Host a\n  Port many\n"}},
+		{"include loop", map[string]string{"config": "Include DIR/config\n"}},
+		{"jump loop", map[string]string{"config": "Host a\n  ProxyJump b\nHost b\n  ProxyJump a\n"}},
+	}
+	for _, test := range tests {
+		dir := writeConfigs(t, test.files)
+		if _, err := ImportOpenSSH(filepath.Join(dir, "config")); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestMergeImport(t *testing.T) {
+	local := Config{
+		Host:     "old",
+		Port:     22,
+		Username: "edited",
+		Password: "kept",
+		KeyFile:  "~/.ssh/old",
+		Import:   "a",
+		Jumps:    []JumpConfig{{Host: "gone"}},
+	}
+	local.Name = "renamed in wterm"
+	imported := &Config{Host: "new", Port: 2200, Import: "a", KeyFile: "~/.ssh/new"}
+	local.MergeImport(imported)
+	want := Config{
+		Host:     "new",
+		Port:     2200,
+		Username: "edited",
+		Password: "kept",
+		KeyFile:  "~/.ssh/new",
+		Import:   "a",
+	}
+	want.Name = "renamed in wterm"
+	if !reflect.DeepEqual(local, want) {
+		t.Errorf("got %+v\nwant %+v", local, want)
+	}
+}
@@ -0,0 +1,109 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"wterm/core"
+)
+
+// JumpConfig is a jump host, either inline or a reference to a saved ssh config.
+type JumpConfig struct {
+	Ref         uint64   `json:"ref,omitempty"` // id of a saved ssh config
+	Host        string   `json:"host,omitempty"`
+	Port        int      `json:"port,omitempty"`
+	Username    string   `json:"username,omitempty"`
+	Password    string   `json:"password,omitempty" secret:"true"`
+	KeyFile     string   `json:"keyFile,omitempty"`
+	Passphrase  string   `json:"passphrase,omitempty" secret:"true"`
+	AuthMethods []string `json:"authMethods,omitempty"`
+}
+
+const maxJumps = 16
+
+func loadRef(id uint64) (*Config, error) {
+	core.ConfigLock.RLock()
+	defer core.ConfigLock.RUnlock()
+	for _, item := range core.Configs {
+		if item.Id == id {
+			if cased, ok := item.Full.(*Config); ok {
+				conf := *cased
+				return &conf, nil
+			}
+			return nil, fmt.Errorf("jump host %d is not a ssh config", id)
+		}
+	}
+	return nil, fmt.Errorf("jump host %d not found", id)
+}
+
+// resolveJumps flattens the jump hosts of conf, referenced configs bring their own jump hosts first.
+func resolveJumps(conf *Config, depth int) ([]*Config, error) {
+	hops := []*Config{}
+	for _, jump := range conf.Jumps {
+		if len(hops)+depth >= maxJumps {
+			return nil, errors.New("too many jump hosts")
+		}
+		if jump.Ref != 0 {
+			ref, err := loadRef(jump.Ref)
+			if err != nil {
+				return nil, err
+			}
+			sub, err := resolveJumps(ref, depth+len(hops)+1)
+			if err != nil {
+				return nil, err
+			}
+			hops = append(hops, sub...)
+			hops = append(hops, ref)
+		} else {
+			hops = append(hops, &Config{
+				Host:        jump.Host,
+				Port:        jump.Port,
+				Username:    jump.Username,
+				Password:    jump.Password,
+				KeyFile:     jump.KeyFile,
+				Passphrase:  jump.Passphrase,
+				AuthMethods: jump.AuthMethods,
+			})
+		}
+	}
+	return hops, nil
+}
+
+func hopLabel(conf *Config) string {
+	return fmt.Sprintf(" for %s@%s", conf.Username, hopAddress(conf))
+}
+
+func hopAddress(conf *Config) string {
+	port := conf.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(conf.Host, strconv.Itoa(port))
+}
+
+// dial connects to conf, through via when it is not nil.
+func (instance *Instance) dial(conf *Config, via *ssh.Client, label string) (*ssh.Client, error) {
+	address := hopAddress(conf)
+	clientConf := &ssh.ClientConfig{
+		Config:            ssh.Config{},
+		User:              conf.Username,
+		Auth:              instance.authMethods(conf, label),
+		HostKeyCallback:   instance.hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms(address),
+	}
+	if via == nil {
+		return ssh.Dial("tcp", address, clientConf)
+	}
+	conn, err := via.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, clientConf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
@@ -0,0 +1,285 @@
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"sync"
+	"time"
+	"wterm/core"
+)
+
+const defaultKeepAlive = 30
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// Client is an authenticated ssh client shared by every instance of one config.
+// It sends keepalives and dials again with backoff when the link drops.
+type Client struct {
+	key         poolKey
+	config      Config
+	answers     map[string]string // answers of the first login, reused when reconnecting
+	lock        sync.Mutex
+	client      *ssh.Client
+	jumps       []*ssh.Client
+	users       map[*Instance]bool
+	closed      bool
+	done        chan struct{}
+	forwardLock sync.Mutex
+	forwards    []*Forward
+	forwardName uint64
+}
+
+// poolKey tells pooled clients apart, the revision changes when the config is edited,
+// so a client dialed with the old host, user or auth is not shared with new sessions.
+type poolKey struct {
+	id       uint64
+	revision string
+}
+
+var pool = map[poolKey]*Client{}
+var poolLock = sync.Mutex{}
+
+// configRevision hashes what the connection depends on, including jump hosts referenced by id.
+func configRevision(conf Config) string {
+	hops, _ := resolveJumps(&conf, 0)
+	conf.ConfigBase = core.ConfigBase{}
+	conf.TermType = ""
+	data, err := json.Marshal(struct {
+		Config Config
+		Hops   []*Config
+	}{conf, hops})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// acquirePool returns the pooled client of key and adds instance to its users.
+func acquirePool(key poolKey, instance *Instance) *Client {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	c, ok := pool[key]
+	if !ok {
+		return nil
+	}
+	c.lock.Lock()
+	c.users[instance] = true
+	c.lock.Unlock()
+	return c
+}
+
+// rekeyPool moves the pooled client c to key once the saved config changed in a way its connection keeps,
+// it stays under the old key if a client was already pooled under the new one.
+func rekeyPool(c *Client, key poolKey) {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed || c.key == key || pool[c.key] != c {
+		return
+	}
+	if _, ok := pool[key]; ok {
+		return
+	}
+	delete(pool, c.key)
+	c.key = key
+	pool[key] = c
+}
+
+// storePool pools a freshly connected client, it gives the client up if another login won the race.
+func storePool(key poolKey, instance *Instance, conf Config, answers map[string]string, client *ssh.Client, jumps []*ssh.Client) *Client {
+	poolLock.Lock()
+	if c, ok := pool[key]; ok {
+		c.lock.Lock()
+		c.users[instance] = true
+		c.lock.Unlock()
+		poolLock.Unlock()
+		client.Close()
+		closeClients(jumps)
+		return c
+	}
+	c := &Client{
+		key:     key,
+		config:  conf,
+		answers: answers,
+		client:  client,
+		jumps:   jumps,
+		users:   map[*Instance]bool{instance: true},
+		done:    make(chan struct{}),
+	}
+	pool[key] = c
+	poolLock.Unlock()
+	go c.watch(client)
+	go c.keepalive()
+	for _, forward := range conf.Forwards {
+		_, err := c.startForward(forward)
+		if err != nil {
+			c.info(core.InfoDesc{
+				Type: "ERROR",
+				Info: fmt.Sprintf("[SSH FORWARD] %s %s: %s", forward.Type, forward.Bind, err.Error()),
+			})
+		}
+	}
+	return c
+}
+
+func closeClients(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
+
+// release removes instance from the users, the last user closes the client.
+func (c *Client) release(instance *Instance) {
+	poolLock.Lock()
+	c.lock.Lock()
+	delete(c.users, instance)
+	last := len(c.users) == 0
+	if last {
+		c.closed = true
+		if pool[c.key] == c {
+			delete(pool, c.key)
+		}
+	}
+	client, jumps := c.client, c.jumps
+	c.lock.Unlock()
+	poolLock.Unlock()
+	if !last {
+		return
+	}
+	close(c.done)
+	c.closeForwards()
+	if client != nil {
+		client.Close()
+	}
+	closeClients(jumps)
+}
+
+func (c *Client) current() *ssh.Client {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.client
+}
+
+func (c *Client) info(info core.InfoDesc) {
+	c.lock.Lock()
+	users := []*Instance{}
+	for user := range c.users {
+		users = append(users, user)
+	}
+	c.lock.Unlock()
+	for _, user := range users {
+		if user.infoCB != nil {
+			user.infoCB(info)
+		}
+	}
+}
+
+func (c *Client) keepalive() {
+	interval := c.config.KeepAlive
+	if interval == 0 {
+		interval = defaultKeepAlive
+	}
+	if interval < 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		client := c.current()
+		if client == nil {
+			continue
+		}
+		result := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			result <- err
+		}()
+		select {
+		case <-result:
+			// any reply, even a failure, shows the link is alive
+		case <-time.After(time.Duration(interval) * time.Second):
+			// no reply, close the client so watch starts to reconnect
+			client.Close()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// watch waits until client is gone and reconnects with backoff while the pool is in use.
+func (c *Client) watch(client *ssh.Client) {
+	_ = client.Wait()
+	c.lock.Lock()
+	if c.closed || c.client != client {
+		c.lock.Unlock()
+		return
+	}
+	c.client = nil
+	jumps := c.jumps
+	c.jumps = nil
+	c.lock.Unlock()
+	closeClients(jumps)
+	c.info(core.InfoDesc{
+		Type: "ERROR",
+		Info: fmt.Sprintf("[SSH] connection to %s lost, reconnecting", hopAddress(&c.config)),
+	})
+	backoff := minBackoff
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(backoff):
+		}
+		client, jumps, err := c.redial()
+		if err == nil {
+			c.lock.Lock()
+			if c.closed {
+				c.lock.Unlock()
+				client.Close()
+				closeClients(jumps)
+				return
+			}
+			c.client = client
+			c.jumps = jumps
+			c.lock.Unlock()
+			c.restartForwards()
+			c.info(core.InfoDesc{
+				Type: "INFO",
+				Info: fmt.Sprintf("[SSH] reconnected to %s", hopAddress(&c.config)),
+			})
+			go c.watch(client)
+			return
+		}
+		c.info(core.InfoDesc{
+			Type: "ERROR",
+			Info: fmt.Sprintf("[SSH] reconnect to %s failed (attempt %d): %s", hopAddress(&c.config), attempt, err.Error()),
+		})
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// redial logs in again without asking, only answers of the first login are used.
+func (c *Client) redial() (*ssh.Client, []*ssh.Client, error) {
+	dialer := &Instance{
+		config:  c.config,
+		answers: c.answers,
+		infoCB:  c.info,
+	}
+	return dialer.dialAll()
+}
@@ -0,0 +1,45 @@
+package ssh
+
+import "testing"
+
+func TestRekeyPool(t *testing.T) {
+	conf := Config{Host: "example.com", Port: 22}
+	asked := conf
+	asked.Username = "root"
+	oldKey := poolKey{1, configRevision(conf)}
+	newKey := poolKey{1, configRevision(asked)}
+	if oldKey == newKey {
+		t.Fatal("the username is not part of the revision")
+	}
+	tests := []struct {
+		name   string
+		closed bool
+		taken  bool
+		moved  bool
+	}{
+		{"moved", false, false, true},
+		{"closed", true, false, false},
+		{"taken", false, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Client{key: oldKey, closed: test.closed}
+			other := &Client{key: newKey}
+			pool[oldKey] = c
+			if test.taken {
+				pool[newKey] = other
+			}
+			defer func() {
+				delete(pool, oldKey)
+				delete(pool, newKey)
+			}()
+			rekeyPool(c, newKey)
+			if moved := pool[newKey] == c && pool[oldKey] == nil && c.key == newKey; moved != test.moved {
+				t.Errorf("moved %v, want %v", moved, test.moved)
+			}
+			if test.taken && pool[newKey] != other {
+				t.Error("the client pooled under the new key was replaced")
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package ssh
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/hack-pad/hackpadfs"
 	"github.com/pkg/sftp"
@@ -9,7 +10,6 @@ import (
 	"io"
 	"io/fs"
 	"log"
-	"net"
 	"path"
 	"wterm/core"
 )
@@ -19,52 +19,123 @@ type Config struct {
 	TermType string `json:"termType"`
 	Host     string `json:"host"`
 	Port     int    `json:"port"`
-	Username string `json:"username"` // optional
-	Password string `json:"password"` // optional
+	Username string `json:"username"`               // optional
+	Password string `json:"password" secret:"true"` // optional
+	// key file and its passphrase, both optional
+	KeyFile    string `json:"keyFile"`
+	Passphrase string `json:"passphrase" secret:"true"`
+	// auth methods to try in order, default is publickey, agent, password, keyboard-interactive
+	AuthMethods []string `json:"authMethods"`
+	// jump hosts to dial through in order
+	Jumps []JumpConfig `json:"jumps,omitempty"`
+	// port forwards started once connected
+	Forwards []ForwardConfig `json:"forwards,omitempty"`
+	// seconds between keepalives, default is 30, < 0 disables it
+	KeepAlive int `json:"keepAlive,omitempty"`
+	// Host alias of an imported OpenSSH config, importing again updates the config with it
+	Import string `json:"import,omitempty"`
+}
+
+// SetCredentials keeps the non-empty credentials answered at an auth prompt.
+func (c *Config) SetCredentials(username string, password string) {
+	if username != "" {
+		c.Username = username
+	}
+	if password != "" {
+		c.Password = password
+	}
 }
 
 type Instance struct {
-	client       *ssh.Client
+	id           uint64
+	key          poolKey
+	pool         *Client
 	config       Config
+	saved        Config // config as saved when connecting, key hashes it
 	authChan     chan bool
 	authCB       func(question string)
-	passwordChan chan string
-	updateConfig func(username string, password string) // TODO:
+	infoCB       func(info core.InfoDesc)
+	answerChan   chan string
+	answers      map[string]string
+	closers      []io.Closer
+	updateConfig func(username string, password string)
+	saveUsername bool
+	savePassword bool
 }
 
-func (instance *Instance) connectImpl() {
-	authMethods := []ssh.AuthMethod{}
-	// TODO: support key file here
-	if instance.config.Password != "" {
-		authMethods = append(authMethods, ssh.Password(instance.config.Password))
-	} else {
-		authMethods = append(authMethods, ssh.PasswordCallback(func() (secret string, err error) {
-			instance.authCB("password")
-			password := <-instance.passwordChan
-			return password, nil
-		}))
+// dialAll dials every jump host and then the target, the jump clients are returned in dial order.
+func (instance *Instance) dialAll() (*ssh.Client, []*ssh.Client, error) {
+	defer func() {
+		for _, closer := range instance.closers {
+			closer.Close()
+		}
+		instance.closers = nil
+	}()
+	hops, err := resolveJumps(&instance.config, 0)
+	if err != nil {
+		return nil, nil, err
 	}
-	clientConf := &ssh.ClientConfig{
-		Config: ssh.Config{},
-		User:   instance.config.Username,
-		Auth:   authMethods,
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
-		},
+	var client *ssh.Client
+	jumps := []*ssh.Client{}
+	for _, hop := range hops {
+		if hop.Username == "" {
+			hop.Username = instance.ask(fmt.Sprintf("username for %s", hopAddress(hop)))
+		}
+		client, err = instance.dial(hop, client, hopLabel(hop))
+		if err != nil {
+			closeClients(jumps)
+			return nil, nil, err
+		}
+		jumps = append(jumps, client)
+	}
+	client, err = instance.dial(&instance.config, client, "")
+	if err != nil {
+		closeClients(jumps)
+		return nil, nil, err
 	}
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", instance.config.Host, instance.config.Port), clientConf)
+	return client, jumps, nil
+}
+
+func (instance *Instance) connectImpl() {
+	client, jumps, err := instance.dialAll()
 	if err != nil {
+		instance.infoCB(core.InfoDesc{
+			Type: "ERROR",
+			Info: fmt.Sprintf("[SSH] %s", err.Error()),
+		})
 		instance.authChan <- false
-		// TODO:
 		return
 	}
-	instance.client = client
+	instance.pool = storePool(instance.key, instance, instance.config, instance.answers, client, jumps)
+	if instance.updateConfig != nil && (instance.saveUsername || instance.savePassword) {
+		// only credentials that worked are saved
+		username, password := "", ""
+		if instance.saveUsername {
+			username = instance.config.Username
+		}
+		if instance.savePassword {
+			password = instance.config.Password
+		}
+		instance.updateConfig(username, password)
+		// sessions opened with the updated config share the client
+		saved := instance.saved
+		saved.SetCredentials(username, password)
+		rekeyPool(instance.pool, poolKey{instance.id, configRevision(saved)})
+	}
 	instance.authChan <- true
 }
 
-func (instance *Instance) Connect(auth chan bool, callback func(question string)) error {
+func (instance *Instance) Connect(auth chan bool, callback func(question string), info func(info core.InfoDesc)) error {
 	instance.authChan = auth
 	instance.authCB = callback
+	instance.infoCB = info
+	instance.saved = instance.config
+	instance.key = poolKey{instance.id, configRevision(instance.config)}
+	if pooled := acquirePool(instance.key, instance); pooled != nil {
+		instance.pool = pooled
+		auth <- true
+		return nil
+	}
 	if instance.config.Username == "" {
 		go func() {
 			callback("username")
@@ -79,20 +150,30 @@ func (instance *Instance) Connect(auth chan bool, callback func(question string)
 func (instance *Instance) Auth(info core.AuthDesc) {
 	if info.Question == "username" {
 		instance.config.Username = info.Password
-		// TODO: proc save
+		instance.saveUsername = info.Saved
 		go instance.connectImpl()
 	} else if info.Question == "password" {
 		instance.config.Password = info.Password
-		// TODO: proc save
-		instance.passwordChan <- instance.config.Password
+		instance.savePassword = info.Saved
+		instance.answerChan <- instance.config.Password
+	} else {
+		instance.answerChan <- info.Password
 	}
 }
 
+func (instance *Instance) client() *ssh.Client {
+	if instance.pool == nil {
+		return nil
+	}
+	return instance.pool.current()
+}
+
 func (instance *Instance) NewShell(id uint16) core.ShellSession {
-	if instance.client == nil {
+	client := instance.client()
+	if client == nil {
 		return nil
 	}
-	session, err := instance.client.NewSession()
+	session, err := client.NewSession()
 	if err != nil {
 		// TODO:
 		return nil
@@ -119,6 +200,11 @@ func (instance *Instance) NewShell(id uint16) core.ShellSession {
 		// TODO:
 		return nil
 	}
+	go func() {
+		// end the reader when the shell exits or the connection drops
+		_ = session.Wait()
+		soutw.Close()
+	}()
 	return &ShellSession{
 		session: session,
 		reader:  soutr,
@@ -127,7 +213,11 @@ func (instance *Instance) NewShell(id uint16) core.ShellSession {
 }
 
 func (instance *Instance) NewFS(id uint16) core.FilesystemSession {
-	client, err := sftp.NewClient(instance.client)
+	sshClient := instance.client()
+	if sshClient == nil {
+		return nil
+	}
+	client, err := sftp.NewClient(sshClient)
 	if err != nil {
 		// TODO:
 		return nil
@@ -139,6 +229,35 @@ func (*Instance) IsWindowsPath() bool {
 	return false
 }
 
+func (instance *Instance) Close() error {
+	if instance.pool != nil {
+		instance.pool.release(instance)
+		instance.pool = nil
+	}
+	return nil
+}
+
+func (instance *Instance) Forwards() []ForwardInfo {
+	if instance.pool == nil {
+		return []ForwardInfo{}
+	}
+	return instance.pool.Forwards()
+}
+
+func (instance *Instance) AddForward(config ForwardConfig) (ForwardInfo, error) {
+	if instance.pool == nil {
+		return ForwardInfo{}, errors.New("not connected")
+	}
+	return instance.pool.AddForward(config)
+}
+
+func (instance *Instance) RemoveForward(id uint64) bool {
+	if instance.pool == nil {
+		return false
+	}
+	return instance.pool.RemoveForward(id)
+}
+
 type ShellSession struct {
 	session *ssh.Session
 	reader  io.Reader
@@ -183,14 +302,17 @@ func (helper *ConfigHelper) StoreConfig(config interface{}) []byte {
 	return ret
 }
 
-func (helper *ConfigHelper) New(config interface{}) core.ServeInstance {
+func (helper *ConfigHelper) New(id uint64, config interface{}) core.ServeInstance {
 	return &Instance{
-		client:       nil,
+		id:           id,
+		pool:         nil,
 		config:       *config.(*Config),
 		authChan:     nil,
 		authCB:       nil,
-		passwordChan: make(chan string),
-		updateConfig: nil, // TODO:
+		infoCB:       nil,
+		answerChan:   make(chan string),
+		answers:      map[string]string{},
+		updateConfig: core.ConfigUpdater(id),
 	}
 }
 
@@ -0,0 +1,289 @@
+package telnet
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+const (
+	SE   = 240
+	NOP  = 241
+	GA   = 249
+	SB   = 250
+	WILL = 251
+	WONT = 252
+	DO   = 253
+	DONT = 254
+	IAC  = 255
+)
+
+const (
+	OPT_BINARY = 0
+	OPT_ECHO   = 1
+	OPT_SGA    = 3
+	OPT_TTYPE  = 24
+	OPT_NAWS   = 31
+)
+
+const (
+	TTYPE_IS   = 0
+	TTYPE_SEND = 1
+)
+
+// states of an option on one side
+const (
+	optionOff = iota
+	optionAsked
+	optionOn
+)
+
+const (
+	stateData = iota
+	stateIAC
+	stateCommand
+	stateSB
+	stateSBIAC
+	stateCR
+)
+
+// options this client performs and options it lets the server perform
+var localOptions = map[byte]bool{OPT_BINARY: true, OPT_SGA: true, OPT_TTYPE: true, OPT_NAWS: true}
+var remoteOptions = map[byte]bool{OPT_BINARY: true, OPT_ECHO: true, OPT_SGA: true}
+
+// Conn speaks the telnet protocol over conn, Read returns the data stream with commands removed.
+type Conn struct {
+	conn     net.Conn
+	termType string
+	wlock    sync.Mutex
+	lock     sync.Mutex
+	local    map[byte]int
+	remote   map[byte]int
+	rows     int
+	cols     int
+	state    int
+	command  byte
+	sub      []byte
+	buf      []byte
+}
+
+func NewConn(conn net.Conn, termType string) *Conn {
+	c := &Conn{
+		conn:     conn,
+		termType: termType,
+		local:    map[byte]int{},
+		remote:   map[byte]int{},
+		rows:     40,
+		cols:     80,
+		buf:      make([]byte, 1024),
+	}
+	c.ask(WILL, OPT_NAWS)
+	c.ask(WILL, OPT_TTYPE)
+	c.ask(DO, OPT_SGA)
+	c.ask(DO, OPT_ECHO)
+	return c
+}
+
+func (c *Conn) send(data ...byte) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	_, _ = c.conn.Write(data)
+}
+
+func (c *Conn) ask(verb byte, option byte) {
+	c.lock.Lock()
+	if verb == WILL {
+		c.local[option] = optionAsked
+	} else {
+		c.remote[option] = optionAsked
+	}
+	c.lock.Unlock()
+	c.send(IAC, verb, option)
+}
+
+// escape doubles IAC bytes of a subnegotiation payload.
+func escape(data []byte) []byte {
+	ret := make([]byte, 0, len(data))
+	for _, b := range data {
+		ret = append(ret, b)
+		if b == IAC {
+			ret = append(ret, IAC)
+		}
+	}
+	return ret
+}
+
+func (c *Conn) sendNAWS() {
+	c.lock.Lock()
+	if c.local[OPT_NAWS] != optionOn {
+		c.lock.Unlock()
+		return
+	}
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint16(size[0:], uint16(c.cols))
+	binary.BigEndian.PutUint16(size[2:], uint16(c.rows))
+	c.lock.Unlock()
+	data := append([]byte{IAC, SB, OPT_NAWS}, escape(size)...)
+	c.send(append(data, IAC, SE)...)
+}
+
+// negotiate answers a DO/DONT/WILL/WONT, requests we asked for are not answered again to avoid loops.
+func (c *Conn) negotiate(verb byte, option byte) {
+	c.lock.Lock()
+	var reply byte
+	enabled := false
+	switch verb {
+	case DO:
+		if !localOptions[option] {
+			reply = WONT
+		} else if c.local[option] != optionOn {
+			if c.local[option] == optionOff {
+				reply = WILL
+			}
+			c.local[option] = optionOn
+			enabled = true
+		}
+	case DONT:
+		if c.local[option] != optionOff {
+			if c.local[option] == optionOn {
+				reply = WONT
+			}
+			c.local[option] = optionOff
+		}
+	case WILL:
+		if !remoteOptions[option] {
+			reply = DONT
+		} else if c.remote[option] != optionOn {
+			if c.remote[option] == optionOff {
+				reply = DO
+			}
+			c.remote[option] = optionOn
+		}
+	case WONT:
+		if c.remote[option] != optionOff {
+			if c.remote[option] == optionOn {
+				reply = DONT
+			}
+			c.remote[option] = optionOff
+		}
+	}
+	c.lock.Unlock()
+	if reply != 0 {
+		c.send(IAC, reply, option)
+	}
+	if enabled && option == OPT_NAWS {
+		c.sendNAWS()
+	}
+}
+
+func (c *Conn) subnegotiate(data []byte) {
+	if len(data) == 2 && data[0] == OPT_TTYPE && data[1] == TTYPE_SEND {
+		reply := append([]byte{IAC, SB, OPT_TTYPE, TTYPE_IS}, escape([]byte(c.termType))...)
+		c.send(append(reply, IAC, SE)...)
+	}
+}
+
+func (c *Conn) Read(p []byte) (n int, err error) {
+	for n == 0 {
+		size := len(p)
+		if size > len(c.buf) {
+			size = len(c.buf)
+		}
+		count, err := c.conn.Read(c.buf[:size])
+		for _, b := range c.buf[:count] {
+			switch c.state {
+			case stateData:
+				if b == IAC {
+					c.state = stateIAC
+					continue
+				}
+				if b == '\r' {
+					c.state = stateCR
+				}
+				p[n] = b
+				n++
+			case stateCR:
+				// CR NUL is a bare CR
+				c.state = stateData
+				if b == IAC {
+					c.state = stateIAC
+				} else if b != 0 {
+					if b == '\r' {
+						c.state = stateCR
+					}
+					p[n] = b
+					n++
+				}
+			case stateIAC:
+				c.state = stateData
+				switch b {
+				case IAC:
+					p[n] = IAC
+					n++
+				case DO, DONT, WILL, WONT:
+					c.command = b
+					c.state = stateCommand
+				case SB:
+					c.sub = c.sub[:0]
+					c.state = stateSB
+				}
+			case stateCommand:
+				c.state = stateData
+				c.negotiate(c.command, b)
+			case stateSB:
+				if b == IAC {
+					c.state = stateSBIAC
+				} else {
+					c.sub = append(c.sub, b)
+				}
+			case stateSBIAC:
+				if b == SE {
+					c.state = stateData
+					c.subnegotiate(c.sub)
+				} else {
+					c.state = stateSB
+					c.sub = append(c.sub, b)
+				}
+			}
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Write escapes IAC and sends CR as CR NUL unless the binary option is on.
+func (c *Conn) Write(p []byte) (n int, err error) {
+	c.lock.Lock()
+	binaryMode := c.local[OPT_BINARY] == optionOn
+	c.lock.Unlock()
+	data := make([]byte, 0, len(p))
+	for _, b := range p {
+		data = append(data, b)
+		if b == IAC {
+			data = append(data, IAC)
+		} else if b == '\r' && !binaryMode {
+			data = append(data, 0)
+		}
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Conn) Resize(rows int, cols int) {
+	c.lock.Lock()
+	c.rows = rows
+	c.cols = cols
+	c.lock.Unlock()
+	c.sendNAWS()
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,141 @@
+package telnet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeConn replays input in reads of at most chunk bytes and records what is written.
+type fakeConn struct {
+	net.Conn
+	input   []byte
+	chunk   int
+	written bytes.Buffer
+}
+
+func (f *fakeConn) Read(p []byte) (int, error) {
+	if len(f.input) == 0 {
+		return 0, io.EOF
+	}
+	size := len(p)
+	if f.chunk > 0 && size > f.chunk {
+		size = f.chunk
+	}
+	n := copy(p[:size], f.input)
+	f.input = f.input[n:]
+	return n, nil
+}
+
+func (f *fakeConn) Write(p []byte) (int, error) {
+	return f.written.Write(p)
+}
+
+func (f *fakeConn) Close() error {
+	return nil
+}
+
+func readAll(c *Conn) ([]byte, error) {
+	ret := []byte{}
+	buf := make([]byte, 16)
+	for {
+		n, err := c.Read(buf)
+		ret = append(ret, buf[:n]...)
+		if errors.Is(err, io.EOF) {
+			return ret, nil
+		} else if err != nil {
+			return ret, err
+		}
+	}
+}
+
+func TestConnRead(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		data  []byte
+		reply []byte
+	}{
+		{"plain text", []byte("hello"), []byte("hello"), nil},
+		{"escaped IAC", []byte{'a', IAC, IAC, 'b'}, []byte{'a', IAC, 'b'}, nil},
+		{"CR NUL is a bare CR", []byte{'a', '\r', 0, 'b'}, []byte("a\rb"), nil},
+		{"CR LF", []byte("a\r\nb"), []byte("a\r\nb"), nil},
+		{"CR CR NUL", []byte{'\r', '\r', 0}, []byte("\r\r"), nil},
+		{"CR then command", []byte{'\r', IAC, NOP, 'x'}, []byte("\rx"), nil},
+		{"NOP and GA are dropped", []byte{'a', IAC, NOP, IAC, GA, 'b'}, []byte("ab"), nil},
+		{"WILL of an asked option", []byte{IAC, WILL, OPT_ECHO, 'x'}, []byte("x"), nil},
+		{"WILL of an unsupported option", []byte{IAC, WILL, 5}, []byte{}, []byte{IAC, DONT, 5}},
+		{"WILL of a supported option", []byte{IAC, WILL, OPT_BINARY}, []byte{}, []byte{IAC, DO, OPT_BINARY}},
+		{"WONT of an asked option", []byte{IAC, WONT, OPT_SGA}, []byte{}, nil},
+		{"DO of an asked option", []byte{IAC, DO, OPT_TTYPE}, []byte{}, nil},
+		{"DO of an unsupported option", []byte{IAC, DO, 99}, []byte{}, []byte{IAC, WONT, 99}},
+		{"DO of a supported option", []byte{IAC, DO, OPT_BINARY}, []byte{}, []byte{IAC, WILL, OPT_BINARY}},
+		{"DO NAWS sends the size", []byte{IAC, DO, OPT_NAWS}, []byte{}, []byte{IAC, SB, OPT_NAWS, 0, 80, 0, 40, IAC, SE}},
+		{"DONT of an asked option", []byte{IAC, DONT, OPT_NAWS}, []byte{}, nil},
+		{"terminal type request", []byte{IAC, SB, OPT_TTYPE, TTYPE_SEND, IAC, SE}, []byte{},
+			append(append([]byte{IAC, SB, OPT_TTYPE, TTYPE_IS}, "xterm"...), IAC, SE)},
+		{"unknown subnegotiation with escaped IAC", []byte{'a', IAC, SB, 42, IAC, IAC, 1, IAC, SE, 'b'}, []byte("ab"), nil},
+	}
+	for _, test := range tests {
+		for _, chunk := range []int{0, 1} {
+			fake := &fakeConn{chunk: chunk}
+			c := NewConn(fake, "xterm")
+			fake.written.Reset()
+			fake.input = test.input
+			data, err := readAll(c)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if !bytes.Equal(data, test.data) {
+				t.Errorf("%s (chunk %d): data %v, want %v", test.name, chunk, data, test.data)
+			}
+			if !bytes.Equal(fake.written.Bytes(), test.reply) {
+				t.Errorf("%s (chunk %d): reply %v, want %v", test.name, chunk, fake.written.Bytes(), test.reply)
+			}
+		}
+	}
+}
+
+func TestConnWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		binary bool
+		input  []byte
+		want   []byte
+	}{
+		{"plain text", false, []byte("ls"), []byte("ls")},
+		{"IAC is doubled", false, []byte{'a', IAC}, []byte{'a', IAC, IAC}},
+		{"CR is sent as CR NUL", false, []byte("ls\r"), []byte{'l', 's', '\r', 0}},
+		{"binary mode keeps CR", true, []byte("ls\r"), []byte("ls\r")},
+		{"binary mode still doubles IAC", true, []byte{IAC}, []byte{IAC, IAC}},
+	}
+	for _, test := range tests {
+		fake := &fakeConn{}
+		c := NewConn(fake, "xterm")
+		if test.binary {
+			fake.input = []byte{IAC, DO, OPT_BINARY}
+			if _, err := readAll(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fake.written.Reset()
+		n, err := c.Write(test.input)
+		if err != nil || n != len(test.input) {
+			t.Fatalf("%s: Write = %d, %v", test.name, n, err)
+		}
+		if !bytes.Equal(fake.written.Bytes(), test.want) {
+			t.Errorf("%s: sent %v, want %v", test.name, fake.written.Bytes(), test.want)
+		}
+	}
+}
+
+func TestNewConnAsks(t *testing.T) {
+	fake := &fakeConn{}
+	NewConn(fake, "xterm")
+	want := []byte{IAC, WILL, OPT_NAWS, IAC, WILL, OPT_TTYPE, IAC, DO, OPT_SGA, IAC, DO, OPT_ECHO}
+	if !bytes.Equal(fake.written.Bytes(), want) {
+		t.Errorf("sent %v, want %v", fake.written.Bytes(), want)
+	}
+}
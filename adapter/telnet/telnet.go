@@ -0,0 +1,309 @@
+package telnet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+	"wterm/core"
+)
+
+const dialTimeout = 10 * time.Second
+
+// login prompts are only looked for in the first output of a session
+const loginWindow = 4096
+
+// output after the password answer without a new prompt confirms the login
+const verifyWindow = 512
+
+var defaultLoginPrompts = []string{"login:", "username:"}
+var defaultPasswordPrompts = []string{"password:"}
+
+type Config struct {
+	core.ConfigBase
+	TermType string `json:"termType"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	// answer the login and password prompts, missing credentials are asked before connecting
+	Login    bool   `json:"login"`
+	Username string `json:"username"`
+	Password string `json:"password" secret:"true"`
+	// prompts to answer, matched case-insensitively, default is "login:"/"username:" and "password:"
+	LoginPrompts    []string `json:"loginPrompts,omitempty"`
+	PasswordPrompts []string `json:"passwordPrompts,omitempty"`
+}
+
+// SetCredentials keeps the non-empty credentials answered at an auth prompt.
+func (c *Config) SetCredentials(username string, password string) {
+	if username != "" {
+		c.Username = username
+	}
+	if password != "" {
+		c.Password = password
+	}
+}
+
+type Instance struct {
+	id           uint64
+	config       Config
+	authChan     chan bool
+	authCB       func(question string)
+	infoCB       func(info core.InfoDesc)
+	updateConfig func(username string, password string)
+	saveUsername bool
+	savePassword bool
+}
+
+func (instance *Instance) Connect(auth chan bool, callback func(question string), info func(info core.InfoDesc)) error {
+	instance.authChan = auth
+	instance.authCB = callback
+	instance.infoCB = info
+	instance.next()
+	return nil
+}
+
+// next asks the missing credentials one by one and then passes the auth.
+func (instance *Instance) next() {
+	if instance.config.Login && instance.config.Username == "" {
+		go instance.authCB("username")
+	} else if instance.config.Login && instance.config.Password == "" {
+		go instance.authCB("password")
+	} else {
+		go func() {
+			instance.authChan <- true
+		}()
+	}
+}
+
+func (instance *Instance) Auth(info core.AuthDesc) {
+	if info.Question == "username" {
+		instance.config.Username = info.Password
+		instance.saveUsername = info.Saved
+	} else if info.Question == "password" {
+		instance.config.Password = info.Password
+		instance.savePassword = info.Saved
+	}
+	instance.next()
+}
+
+func (instance *Instance) NewShell(id uint16) core.ShellSession {
+	address := net.JoinHostPort(instance.config.Host, strconv.Itoa(instance.config.Port))
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		instance.infoCB(core.InfoDesc{
+			Type: "ERROR",
+			Info: fmt.Sprintf("[TELNET] %s", err.Error()),
+		})
+		return nil
+	}
+	termType := instance.config.TermType
+	if termType == "" {
+		termType = "xterm-256color"
+	}
+	ss := &ShellSession{
+		Conn: NewConn(conn, termType),
+	}
+	if instance.config.Login {
+		ss.login = &loginWatcher{
+			instance:        instance,
+			username:        instance.config.Username,
+			password:        instance.config.Password,
+			loginPrompts:    lowerPrompts(instance.config.LoginPrompts, defaultLoginPrompts),
+			passwordPrompts: lowerPrompts(instance.config.PasswordPrompts, defaultPasswordPrompts),
+		}
+	}
+	return ss
+}
+
+func (instance *Instance) NewFS(id uint16) core.FilesystemSession {
+	return nil
+}
+
+func (*Instance) IsWindowsPath() bool {
+	return false
+}
+
+func lowerPrompts(prompts []string, defaults []string) [][]byte {
+	if len(prompts) == 0 {
+		prompts = defaults
+	}
+	ret := [][]byte{}
+	for _, prompt := range prompts {
+		ret = append(ret, bytes.ToLower([]byte(prompt)))
+	}
+	return ret
+}
+
+// loginWatcher answers the login prompts found in the output of a new session.
+type loginWatcher struct {
+	instance        *Instance
+	username        string
+	password        string
+	loginPrompts    [][]byte
+	passwordPrompts [][]byte
+	tail            []byte
+	seen            int
+	sentUsername    bool
+	sentPassword    bool
+	verified        int
+}
+
+func matchPrompt(tail []byte, prompts [][]byte) bool {
+	for _, prompt := range prompts {
+		if bytes.Contains(tail, prompt) {
+			return true
+		}
+	}
+	return false
+}
+
+// endsWithPrompt tells whether the last output waits on one of prompts,
+// unlike matchPrompt it skips prompts found inside text such as "Last login:".
+func endsWithPrompt(tail []byte, prompts [][]byte) bool {
+	tail = bytes.TrimRight(tail, " \t")
+	for _, prompt := range prompts {
+		if bytes.HasSuffix(tail, prompt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *loginWatcher) append(output []byte) {
+	w.tail = append(w.tail, bytes.ToLower(output)...)
+	if len(w.tail) > 256 {
+		w.tail = w.tail[len(w.tail)-256:]
+	}
+}
+
+// feed looks for prompts in output, it returns the answer to send and whether the login is over.
+func (w *loginWatcher) feed(output []byte) (string, bool) {
+	w.seen += len(output)
+	w.append(output)
+	if matchPrompt(w.tail, w.passwordPrompts) {
+		w.tail = w.tail[:0]
+		w.sentPassword = true
+		return w.password + "\r", true
+	}
+	if !w.sentUsername && matchPrompt(w.tail, w.loginPrompts) {
+		w.tail = w.tail[:0]
+		w.sentUsername = true
+		return w.username + "\r", false
+	}
+	return "", w.seen > loginWindow
+}
+
+// verify looks for a new prompt in the output following the password answer,
+// it returns whether the login outcome is known and whether the login succeeded.
+// A prompt asked again fails the login, so do a command asking a password early
+// and a read cut right after "Last login:", which only skip the save.
+func (w *loginWatcher) verify(output []byte) (bool, bool) {
+	w.verified += len(output)
+	w.append(output)
+	if endsWithPrompt(w.tail, w.loginPrompts) || endsWithPrompt(w.tail, w.passwordPrompts) {
+		return true, false
+	}
+	return w.verified > verifyWindow, true
+}
+
+// wantsSave tells whether credentials asked before connecting are waiting to be saved.
+func (w *loginWatcher) wantsSave() bool {
+	instance := w.instance
+	return instance.updateConfig != nil && (instance.saveUsername || instance.savePassword)
+}
+
+// saveCredentials saves the asked credentials once the login succeeded.
+func (w *loginWatcher) saveCredentials() {
+	instance := w.instance
+	if !w.wantsSave() {
+		return
+	}
+	username, password := "", ""
+	if instance.saveUsername {
+		username = instance.config.Username
+	}
+	if instance.savePassword {
+		password = instance.config.Password
+	}
+	instance.saveUsername = false
+	instance.savePassword = false
+	instance.updateConfig(username, password)
+}
+
+type ShellSession struct {
+	*Conn
+	login *loginWatcher
+}
+
+func (s *ShellSession) Read(p []byte) (n int, err error) {
+	n, err = s.Conn.Read(p)
+	login := s.login
+	if login == nil || n <= 0 {
+		return n, err
+	}
+	if login.sentPassword {
+		// credentials are only saved once the answered login got through
+		if done, ok := login.verify(p[:n]); done {
+			s.login = nil
+			if ok {
+				login.saveCredentials()
+			}
+		}
+		return n, err
+	}
+	answer, done := login.feed(p[:n])
+	if answer != "" {
+		_, _ = s.Conn.Write([]byte(answer))
+	}
+	if done && !(login.sentPassword && login.wantsSave()) {
+		s.login = nil
+	}
+	return n, err
+}
+
+type ConfigHelper struct {
+}
+
+func (helper *ConfigHelper) LoadConfig(data []byte) interface{} {
+	ret := Config{}
+	err := json.Unmarshal(data, &ret)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if ret.Port == 0 {
+		ret.Port = 23
+	}
+	return &ret
+}
+
+func (helper *ConfigHelper) StoreConfig(config interface{}) []byte {
+	ret, err := json.Marshal(config)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return ret
+}
+
+func (helper *ConfigHelper) New(id uint64, config interface{}) core.ServeInstance {
+	return &Instance{
+		id:           id,
+		config:       *config.(*Config),
+		updateConfig: core.ConfigUpdater(id),
+	}
+}
+
+func (helper *ConfigHelper) Info(host string, id uint64, config interface{}) core.ConnectionInfo {
+	cased := config.(*Config)
+	return core.ConnectionInfo{
+		Id:       int(id),
+		Name:     cased.Name,
+		URL:      fmt.Sprintf("%s/ws?id=%d", host, id),
+		Protocol: "standard",
+		FixSize:  false,
+	}
+}
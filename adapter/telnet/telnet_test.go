@@ -0,0 +1,59 @@
+package telnet
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLoginSave(t *testing.T) {
+	motd := strings.Repeat("motd\r\n", 100)
+	tests := []struct {
+		name   string
+		writes []string
+		saved  bool
+	}{
+		{"success", []string{"login: ", "Password: ", "\r\nLast login: Mon Oct 12 from 10.0.0.2\r\n", motd, "$ "}, true},
+		{"asked again", []string{"login: ", "Password: ", "\r\nLogin incorrect\r\n", "login: "}, false},
+		{"short output", []string{"login: ", "Password: ", "\r\nLast login: Mon Oct 12\r\n$ "}, false},
+		{"no prompt", []string{motd, motd, motd, motd, motd, motd, motd, motd}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			saved := false
+			instance := &Instance{
+				config:       Config{Login: true, Username: "root", Password: "secret"},
+				saveUsername: true,
+				savePassword: true,
+				updateConfig: func(username string, password string) {
+					saved = username == "root" && password == "secret"
+				},
+			}
+			fake := &fakeConn{}
+			ss := &ShellSession{
+				Conn: NewConn(fake, "xterm"),
+				login: &loginWatcher{
+					instance:        instance,
+					username:        "root",
+					password:        "secret",
+					loginPrompts:    lowerPrompts(nil, defaultLoginPrompts),
+					passwordPrompts: lowerPrompts(nil, defaultPasswordPrompts),
+				},
+			}
+			// each write of the server comes in its own read
+			buf := make([]byte, 1024)
+			for _, write := range test.writes {
+				fake.input = []byte(write)
+				if _, err := ss.Read(buf); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if saved != test.saved {
+				t.Errorf("saved %v, want %v", saved, test.saved)
+			}
+			if test.saved && !bytes.Contains(fake.written.Bytes(), []byte("secret\r\x00")) {
+				t.Errorf("password not answered, sent %q", fake.written.Bytes())
+			}
+		})
+	}
+}
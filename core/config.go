@@ -2,16 +2,33 @@ package core
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 )
 
 type ConfigBase struct {
-	Type string `json:"type"`
-	Name string `json:"name"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Record bool   `json:"record,omitempty"` // always record shell sessions
+}
+
+func (c *ConfigBase) Base() *ConfigBase {
+	return c
+}
+
+// BaseOf returns the ConfigBase embedded in a full config.
+func BaseOf(config interface{}) ConfigBase {
+	if cased, ok := config.(interface{ Base() *ConfigBase }); ok {
+		return *cased.Base()
+	}
+	return ConfigBase{}
 }
 
 type ConnectionInfo struct {
@@ -25,7 +42,7 @@ type ConnectionInfo struct {
 type ConfigHelper interface {
 	LoadConfig(data []byte) interface{}
 	StoreConfig(config interface{}) []byte
-	New(config interface{}) ServeInstance
+	New(id uint64, config interface{}) ServeInstance
 	Info(host string, id uint64, config interface{}) ConnectionInfo
 }
 
@@ -42,6 +59,62 @@ var ConfigLock = sync.RWMutex{}
 
 var Id = new(uint64)
 
+var ErrConfigNotFound = errors.New("config not found")
+
+func parseConfig(data []byte) (string, interface{}, error) {
+	base := ConfigBase{}
+	err := json.Unmarshal(data, &base)
+	if err != nil {
+		return "", nil, err
+	}
+	helper, ok := Helpers[base.Type]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown type: %s", base.Type)
+	}
+	full := helper.LoadConfig(data)
+	if full == nil {
+		return "", nil, errors.New("invalid config")
+	}
+	return base.Type, full, nil
+}
+
+// AddConfig appends a new record from its json form and returns the record id.
+func AddConfig(data []byte) (uint64, error) {
+	typ, full, err := parseConfig(data)
+	if err != nil {
+		return 0, err
+	}
+	id := atomic.AddUint64(Id, 1)
+	ConfigLock.Lock()
+	Configs = append(Configs, Record{
+		Id:   id,
+		Type: typ,
+		Full: full,
+	})
+	ConfigLock.Unlock()
+	return id, nil
+}
+
+// UpdateConfig replaces the record id from its json form, the type cannot change.
+func UpdateConfig(id uint64, data []byte) error {
+	typ, full, err := parseConfig(data)
+	if err != nil {
+		return err
+	}
+	ConfigLock.Lock()
+	defer ConfigLock.Unlock()
+	for index, item := range Configs {
+		if item.Id == id {
+			if item.Type != typ {
+				return errors.New("config type mismatch")
+			}
+			Configs[index].Full = full
+			return nil
+		}
+	}
+	return ErrConfigNotFound
+}
+
 func LoadConfig(filename string) {
 	rd, err := os.Open(filename)
 	defer rd.Close()
@@ -53,6 +126,7 @@ func LoadConfig(filename string) {
 	scanner.Scan()
 	ConfigLock.Lock()
 	err = json.Unmarshal([]byte(scanner.Text()), &MainConfig)
+	vaultKey = nil
 	ConfigLock.Unlock()
 	if err != nil {
 		log.Println(err)
@@ -85,40 +159,126 @@ func LoadConfig(filename string) {
 	ConfigLock.Unlock()
 }
 
-func SaveConfig(filename string) {
-	file, err := os.Create(filename)
-	if err != nil {
-		return
+// ConfigFilename is where Persist saves the configs, empty disables saving.
+var ConfigFilename string
+
+// UpdateRecord calls update with the full config of record id under the config lock and saves the configs.
+func UpdateRecord(id uint64, update func(full interface{}) interface{}) error {
+	ConfigLock.Lock()
+	found := false
+	for index, item := range Configs {
+		if item.Id == id {
+			Configs[index].Full = update(item.Full)
+			found = true
+			break
+		}
 	}
+	ConfigLock.Unlock()
+	if !found {
+		return ErrConfigNotFound
+	}
+	return Persist()
+}
+
+func Persist() error {
+	if ConfigFilename != "" {
+		return SaveConfig(ConfigFilename)
+	}
+	return nil
+}
+
+// SaveConfig writes the main config and every record to filename, nothing is written if a record fails to store.
+func SaveConfig(filename string) error {
+	buf := bytes.Buffer{}
 	ConfigLock.RLock()
 	data, err := json.Marshal(MainConfig)
 	if err != nil {
-		log.Println(err)
-		return
+		ConfigLock.RUnlock()
+		return err
 	}
-	file.Write(data)
-	file.WriteString("\n")
+	buf.Write(data)
+	buf.WriteString("\n")
 	for _, item := range Configs {
-		data := Helpers[item.Type].StoreConfig(item.Full)
-		if data == nil {
-			continue
+		data, err := sealConfig(Helpers[item.Type], item.Full)
+		if err != nil {
+			ConfigLock.RUnlock()
+			return fmt.Errorf("config %d: %w", item.Id, err)
 		}
-		file.Write(data)
-		file.WriteString("\n")
+		buf.Write(data)
+		buf.WriteString("\n")
 	}
 	ConfigLock.RUnlock()
-	file.Close()
+	return writeFileAtomic(filename, buf.Bytes())
+}
+
+// writeFileAtomic replaces filename with data through a synced temporary file,
+// a crash or a full disk leaves the old file in place.
+func writeFileAtomic(filename string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+	return err
+}
+
+// CredentialConfig is implemented by full configs that can keep the credentials answered at an auth prompt.
+type CredentialConfig interface {
+	// SetCredentials sets the non-empty ones of username and password.
+	SetCredentials(username string, password string)
+}
+
+// ConfigUpdater returns a callback writing credentials back into the saved config id,
+// its full config must implement CredentialConfig.
+func ConfigUpdater(id uint64) func(username string, password string) {
+	return func(username string, password string) {
+		err := UpdateRecord(id, func(full interface{}) interface{} {
+			// running instances share the old config, so the change goes to a copy
+			ret, err := copyConfig(Helpers[BaseOf(full).Type], full)
+			if err != nil {
+				log.Println(err)
+				return full
+			}
+			cased, ok := ret.(CredentialConfig)
+			if !ok {
+				log.Printf("config %d cannot keep credentials", id)
+				return full
+			}
+			cased.SetCredentials(username, password)
+			return ret
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}
 }
 
 type Settings struct {
-	Launch     string `json:"launch"`
-	FontFamily string `json:"fontFamily"`
-	FontSize   int    `json:"fontSize"`
+	Launch        string `json:"launch"`
+	FontFamily    string `json:"fontFamily"`
+	FontSize      int    `json:"fontSize"`
+	DetachTimeout int    `json:"detachTimeout"` // seconds, <= 0 closes sessions on detach
+	Scrollback    int    `json:"scrollback"`    // bytes of output replayed on attach
+	RecordDir     string `json:"recordDir"`
+	LogDir        string `json:"logDir"` // serial logs, kept apart from the recordings
 }
 
 type MainConfigType struct {
-	Layout   string   `json:"layout"`
-	Settings Settings `json:"settings"`
+	Layout   string     `json:"layout"`
+	Settings Settings   `json:"settings"`
+	Vault    *VaultInfo `json:"vault,omitempty"`
 }
 
 var MainConfig MainConfigType
@@ -0,0 +1,1049 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/azurity/xmodem-go"
+	"github.com/ncruces/zenity"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MODEM_DIALOG = "dialog"
+	MODEM_PATH   = "path"
+	MODEM_STREAM = "stream"
+	MODEM_FS     = "fs"
+)
+
+const modemStreamChunk = 32 << 10
+
+// a text send is canceled between chunks
+const modemTextChunk = 256
+const modemStreamTimeout = 30 * time.Second
+
+// a zmodem transfer started by sz or rz without an armed request waits this long for one
+const modemArmTimeout = 60 * time.Second
+
+// progress of a transfer is sent at most this often
+const modemProgressInterval = 200 * time.Millisecond
+
+var ErrModemCanceled = errors.New("modem transfer canceled")
+
+// modemRequest is a transfer asked by a client, a zmodem request waits until sz or rz starts.
+type modemRequest struct {
+	conn        *WsProtocol
+	ssid        uint16
+	desc        *ModemDesc
+	fs          FilesystemSession // for the "fs" source
+	windowsPath bool
+}
+
+// fsPath finds the volume of a path in the filesystem session.
+func (req *modemRequest) fsPath(p string) (FSBase, string, error) {
+	if req.fs == nil {
+		return nil, "", errors.New("no filesystem session")
+	}
+	vol, name := formatVolume(p, req.windowsPath)
+	if vol == "" {
+		return req.fs, name, nil
+	}
+	sub, err := req.fs.SubVolume(vol)
+	return sub, name, err
+}
+
+func (req *modemRequest) openFS(p string) (xmodem.File, error) {
+	fsys, name, err := req.fsPath(p)
+	if err != nil {
+		return xmodem.File{}, err
+	}
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return xmodem.File{}, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return xmodem.File{}, err
+	}
+	return xmodem.File{
+		Path:    path.Base(name),
+		Length:  stat.Size(),
+		ModTime: stat.ModTime(),
+		Mode:    stat.Mode(),
+		Body:    f,
+	}, nil
+}
+
+func (req *modemRequest) createFS(p string) (io.WriteCloser, error) {
+	fsys, name, err := req.fsPath(p)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	writer, ok := f.(io.WriteCloser)
+	if !ok {
+		f.Close()
+		return nil, errors.New("file is not writable")
+	}
+	return writer, nil
+}
+
+// modemStream moves the file bytes of a transfer over the websocket of the client,
+// the transfer is canceled once that websocket is released.
+type modemStream struct {
+	conn  *WsProtocol
+	ssid  uint16
+	reply chan *ModemDesc
+	ended chan struct{}
+}
+
+func (s *modemStream) deliver(desc *ModemDesc) {
+	select {
+	case s.reply <- desc:
+	default:
+	}
+}
+
+// streamBody reads a file streamed by the client, it asks for every chunk so it can also seek.
+type streamBody struct {
+	stream *modemStream
+	file   int
+	offset int64
+	size   int64
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	size := int64(len(p))
+	if size > modemStreamChunk {
+		size = modemStreamChunk
+	}
+	if size > b.size-b.offset {
+		size = b.size - b.offset
+	}
+	err := b.stream.conn.Modem(b.stream.ssid, ModemEventDesc{
+		Op:     "read",
+		File:   b.file,
+		Offset: b.offset,
+		Size:   size,
+	})
+	if err != nil {
+		return 0, err
+	}
+	timer := time.NewTimer(modemStreamTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case desc := <-b.stream.reply:
+			// answers of an earlier read are dropped
+			if desc.File != b.file || desc.Offset != b.offset {
+				continue
+			}
+			if len(desc.Data) == 0 {
+				return 0, errors.New("modem stream ended early")
+			}
+			n := copy(p, desc.Data)
+			b.offset += int64(n)
+			return n, nil
+		case <-timer.C:
+			return 0, errors.New("modem stream timeout")
+		case <-b.stream.conn.done:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+func (b *streamBody) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return 0, errors.New("modem stream seek before start")
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+// streamWriter hands a received file to the client.
+type streamWriter struct {
+	stream *modemStream
+	file   int
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += modemStreamChunk {
+		end := i + modemStreamChunk
+		if end > len(p) {
+			end = len(p)
+		}
+		err := w.stream.conn.Modem(w.stream.ssid, ModemEventDesc{
+			Op:   "data",
+			File: w.file,
+			Data: p[i:end],
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *streamWriter) Close() error {
+	return w.stream.conn.Modem(w.stream.ssid, ModemEventDesc{
+		Op:   "close",
+		File: w.file,
+	})
+}
+
+func (m *ModemShellSession) openStream(req *modemRequest, progress *modemProgress) *modemStream {
+	if req.desc.Source != MODEM_STREAM || req.conn == nil {
+		return nil
+	}
+	stream := &modemStream{
+		conn:  req.conn,
+		ssid:  req.ssid,
+		reply: make(chan *ModemDesc, 1),
+		ended: make(chan struct{}),
+	}
+	m.lock.Lock()
+	m.stream = stream
+	m.lock.Unlock()
+	go func() {
+		// nobody feeds or takes the files once the client is gone
+		select {
+		case <-stream.conn.done:
+			progress.cancel()
+		case <-stream.ended:
+		}
+	}()
+	return stream
+}
+
+func (m *ModemShellSession) closeStream(stream *modemStream) {
+	if stream == nil {
+		return
+	}
+	close(stream.ended)
+	m.lock.Lock()
+	if m.stream == stream {
+		m.stream = nil
+	}
+	m.lock.Unlock()
+}
+
+func closeFiles(files []xmodem.File) {
+	for _, file := range files {
+		if closer, ok := file.Body.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// sendFiles opens the files to send from the paths, the stream or a dialog.
+func sendFiles(req *modemRequest, stream *modemStream, multiple bool) ([]xmodem.File, error) {
+	desc := req.desc
+	paths := []string{}
+	switch desc.Source {
+	case MODEM_STREAM:
+		if stream == nil || len(desc.Files) == 0 {
+			return nil, errors.New("no file to send")
+		}
+		files := []xmodem.File{}
+		for i, file := range desc.Files {
+			files = append(files, xmodem.File{
+				Path:    file.Name,
+				Length:  file.Size,
+				ModTime: time.UnixMilli(file.ModTime),
+				Mode:    0644,
+				Body:    &streamBody{stream: stream, file: i, size: file.Size},
+			})
+		}
+		if !multiple {
+			files = files[:1]
+		}
+		return files, nil
+	case MODEM_PATH, MODEM_FS:
+		paths = desc.Paths
+	default:
+		if multiple {
+			selected, err := zenity.SelectFileMultiple(zenity.Title("upload files"))
+			if err != nil {
+				return nil, err
+			}
+			paths = selected
+		} else {
+			selected, err := zenity.SelectFile(zenity.Title("upload files"))
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, selected)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("no file to send")
+	}
+	if !multiple {
+		paths = paths[:1]
+	}
+	files := []xmodem.File{}
+	for _, path := range paths {
+		if desc.Source == MODEM_FS {
+			file, err := req.openFS(path)
+			if err != nil {
+				closeFiles(files)
+				return nil, err
+			}
+			files = append(files, file)
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, xmodem.File{
+			Path:    filepath.Base(path),
+			Length:  stat.Size(),
+			ModTime: stat.ModTime(),
+			Mode:    stat.Mode(),
+			Body:    f,
+		})
+	}
+	return files, nil
+}
+
+// receiveTarget returns where received files are written, from the paths, the stream or a dialog.
+func receiveTarget(req *modemRequest, stream *modemStream, multiple bool) (func(file xmodem.File) (io.WriteCloser, error), error) {
+	desc := req.desc
+	target := ""
+	switch desc.Source {
+	case MODEM_STREAM:
+		if stream == nil {
+			return nil, errors.New("no stream to receive into")
+		}
+		index := 0
+		return func(file xmodem.File) (io.WriteCloser, error) {
+			name, err := receivedName(file.Path)
+			if err != nil {
+				return nil, err
+			}
+			writer := &streamWriter{stream: stream, file: index}
+			index++
+			return writer, stream.conn.Modem(stream.ssid, ModemEventDesc{
+				Op:   "file",
+				File: writer.file,
+				Name: name,
+				Size: file.Length,
+			})
+		}, nil
+	case MODEM_PATH, MODEM_FS:
+		if len(desc.Paths) == 0 {
+			return nil, errors.New("no path to receive into")
+		}
+		target = desc.Paths[0]
+	default:
+		var err error
+		if multiple {
+			target, err = zenity.SelectFile(zenity.Title("download files to..."), zenity.Directory())
+		} else {
+			target, err = zenity.SelectFileSave(zenity.Title("download file"))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if desc.Source == MODEM_FS {
+		if !multiple {
+			return func(file xmodem.File) (io.WriteCloser, error) {
+				return req.createFS(target)
+			}, nil
+		}
+		if fsys, name, err := req.fsPath(target); err != nil {
+			return nil, err
+		} else if err = fsys.Mkdir(name, fs.ModePerm); err != nil && !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		return func(file xmodem.File) (io.WriteCloser, error) {
+			name, err := receivedName(file.Path)
+			if err != nil {
+				return nil, err
+			}
+			return req.createFS(path.Join(target, name))
+		}, nil
+	}
+	if !multiple {
+		return func(file xmodem.File) (io.WriteCloser, error) {
+			return os.Create(target)
+		}, nil
+	}
+	if err := os.MkdirAll(target, fs.ModePerm); err != nil {
+		return nil, err
+	}
+	return func(file xmodem.File) (io.WriteCloser, error) {
+		name, err := receivedName(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		p := filepath.Join(target, name)
+		if rel, err := filepath.Rel(target, p); err != nil || rel != name {
+			return nil, fmt.Errorf("received file name %q leaves the target directory", file.Path)
+		}
+		return os.Create(p)
+	}, nil
+}
+
+// receivedName returns the base name of a file name sent by the remote side, both / and \ are
+// separators and a name that cannot be a file in the target directory is refused.
+func receivedName(name string) (string, error) {
+	base := path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if base == "" || base == "." || base == ".." || base == "/" || filepath.VolumeName(base) != "" {
+		return "", fmt.Errorf("invalid received file name %q", name)
+	}
+	return base, nil
+}
+
+// modemProgress reports a running transfer to the viewers of the session, it also cancels the transfer.
+type modemProgress struct {
+	m        *ModemShellSession
+	lock     sync.Mutex
+	event    ModemEventDesc
+	last     time.Time
+	canceled bool
+	onCancel func()
+}
+
+func (m *ModemShellSession) setNotify(notify func(event ModemEventDesc)) {
+	m.lock.Lock()
+	m.notify = notify
+	m.lock.Unlock()
+}
+
+func (m *ModemShellSession) notifyEvent(event ModemEventDesc) {
+	m.lock.Lock()
+	notify := m.notify
+	m.lock.Unlock()
+	if notify != nil {
+		notify(event)
+	}
+}
+
+// beginTransfer starts tracking a transfer, only one transfer runs in a session at a time.
+func (m *ModemShellSession) beginTransfer(direct string, kind string) (*modemProgress, error) {
+	m.lock.Lock()
+	if m.transfer != nil {
+		m.lock.Unlock()
+		return nil, errors.New("another modem transfer is running")
+	}
+	progress := &modemProgress{
+		m: m,
+		event: ModemEventDesc{
+			Op:     "progress",
+			File:   -1,
+			Direct: direct,
+			Type:   kind,
+		},
+	}
+	m.transfer = progress
+	m.lock.Unlock()
+	if kind != "text" {
+		// a text send is input like typing, the session translates and paces it
+		m.setTransfer(true)
+	}
+	return progress, nil
+}
+
+func (m *ModemShellSession) endTransfer(p *modemProgress, err error) {
+	m.lock.Lock()
+	current := m.transfer == p
+	if current {
+		m.transfer = nil
+	}
+	m.lock.Unlock()
+	if current && p.event.Type != "text" {
+		m.setTransfer(false)
+	}
+	event := ModemEventDesc{
+		Op:     "result",
+		Direct: p.event.Direct,
+		Type:   p.event.Type,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	m.notifyEvent(event)
+}
+
+func (p *modemProgress) send(force bool) {
+	p.lock.Lock()
+	if !force && time.Since(p.last) < modemProgressInterval {
+		p.lock.Unlock()
+		return
+	}
+	p.last = time.Now()
+	event := p.event
+	p.lock.Unlock()
+	p.m.notifyEvent(event)
+}
+
+func (p *modemProgress) start(index int, name string, size int64) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	p.event.File = index
+	p.event.Name = name
+	p.event.Size = size
+	p.event.Done = 0
+	p.lock.Unlock()
+	p.send(true)
+}
+
+func (p *modemProgress) update(done int64) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	p.event.Done = done
+	finished := done >= p.event.Size
+	p.lock.Unlock()
+	p.send(finished)
+}
+
+func (p *modemProgress) retry() {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	p.event.Retries++
+	p.lock.Unlock()
+	p.send(true)
+}
+
+func (p *modemProgress) cancel() {
+	p.lock.Lock()
+	p.canceled = true
+	onCancel := p.onCancel
+	p.lock.Unlock()
+	if onCancel != nil {
+		onCancel()
+	}
+}
+
+func (p *modemProgress) isCanceled() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.canceled
+}
+
+// progressReader counts a file sent by xmodem or ymodem, it fails once the transfer is canceled
+// so the modem ends it with a break.
+type progressReader struct {
+	io.Reader
+	progress *modemProgress
+	index    int
+	file     xmodem.File
+	done     int64
+	started  bool
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	if r.progress.isCanceled() {
+		return 0, ErrModemCanceled
+	}
+	if !r.started {
+		r.started = true
+		r.progress.start(r.index, r.file.Path, r.file.Length)
+	}
+	n, err := r.Reader.Read(p)
+	r.done += int64(n)
+	r.progress.update(r.done)
+	return n, err
+}
+
+// progressWriter counts a file received by xmodem or ymodem, the rest is dropped once the
+// transfer is canceled.
+type progressWriter struct {
+	io.WriteCloser
+	progress *modemProgress
+	done     int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	if w.progress.isCanceled() {
+		return len(p), nil
+	}
+	n, err := w.WriteCloser.Write(p)
+	w.done += int64(n)
+	w.progress.update(w.done)
+	return n, err
+}
+
+// bytes of the xmodem and ymodem framing
+const (
+	xmodemSOH = 0x01
+	xmodemSTX = 0x02
+	xmodemEOT = 0x04
+	xmodemNAK = 0x15
+)
+
+// modemRetries counts the retries of a xmodem or ymodem transfer in the stream between the adapter
+// and the remote side, the adapter does not report them. A NAK answering a block is a retry in either
+// direction, so is a received block repeating the number of the previous one without being asked.
+type modemRetries struct {
+	lock      sync.Mutex
+	progress  *modemProgress
+	sent      byte // first byte written since the last read, the frame waiting for an answer
+	received  byte // first byte read since the last write
+	readSince bool
+	wroteLast bool
+	block     int // number of the last received block, -1 for none
+	asked     bool
+}
+
+func isModemBlock(b byte) bool {
+	return b == xmodemSOH || b == xmodemSTX
+}
+
+// reset starts counting for progress, nil stops counting.
+func (r *modemRetries) reset(progress *modemProgress) {
+	r.lock.Lock()
+	r.progress = progress
+	r.sent, r.received = 0, 0
+	r.readSince, r.wroteLast = true, true
+	r.block = -1
+	r.asked = false
+	r.lock.Unlock()
+}
+
+// written notes data sent to the remote side.
+func (r *modemRetries) written(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	r.lock.Lock()
+	if r.readSince {
+		r.sent = p[0]
+		r.readSince = false
+	}
+	retry := p[0] == xmodemNAK && isModemBlock(r.received)
+	if retry {
+		// the block sent again is not counted twice
+		r.received = 0
+		r.asked = true
+	}
+	r.wroteLast = true
+	progress := r.progress
+	r.lock.Unlock()
+	if retry {
+		progress.retry()
+	}
+}
+
+// read notes data received from the remote side.
+func (r *modemRetries) read(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	r.lock.Lock()
+	retry := false
+	if r.wroteLast {
+		r.received = p[0]
+		r.wroteLast = false
+		if p[0] == xmodemEOT {
+			r.block = -1
+		} else if isModemBlock(p[0]) && len(p) > 1 {
+			retry = int(p[1]) == r.block && !r.asked
+			r.block = int(p[1])
+			r.asked = false
+		}
+	}
+	if isModemBlock(r.sent) && bytes.IndexByte(p, xmodemNAK) >= 0 {
+		r.sent = 0
+		retry = true
+	}
+	r.readSince = true
+	progress := r.progress
+	r.lock.Unlock()
+	if retry {
+		progress.retry()
+	}
+}
+
+// modemCancel makes the remote side give up a xmodem, ymodem or zmodem transfer, the
+// backspaces erase the CANs if it is already back at its shell.
+var modemCancel = append(bytes.Repeat([]byte{0x18}, 10), bytes.Repeat([]byte{'\b'}, 10)...)
+
+// modemFeed connects one xmodem adapter to the session, the adapter fails once its feed is
+// closed, which is the only way to end a transfer waiting for the remote side.
+type modemFeed struct {
+	m      *ModemShellSession
+	closed chan struct{}
+	rest   []byte
+}
+
+func (f *modemFeed) Read(p []byte) (int, error) {
+	if len(f.rest) == 0 {
+		select {
+		case <-f.closed:
+			return 0, ErrModemCanceled
+		default:
+		}
+		select {
+		case chunk, ok := <-f.m.output:
+			if !ok {
+				return 0, f.m.outErr
+			}
+			f.rest = chunk
+		case <-f.closed:
+			return 0, ErrModemCanceled
+		}
+	}
+	n := copy(p, f.rest)
+	f.rest = f.rest[n:]
+	f.m.retries.read(p[:n])
+	return n, nil
+}
+
+// Write drops what the adapter sends after the feed is closed, it may still be retrying.
+func (f *modemFeed) Write(p []byte) (int, error) {
+	select {
+	case <-f.closed:
+		return len(p), nil
+	default:
+	}
+	f.m.retries.written(p)
+	return f.m.zmodem.Write(p)
+}
+
+// pumpOutput hands the output of the zmodem tap to whichever modem is current.
+func (m *ModemShellSession) pumpOutput() {
+	for {
+		buf := make([]byte, 1024)
+		n, err := m.zmodem.Read(buf)
+		if n > 0 {
+			m.output <- buf[:n]
+		}
+		if err != nil {
+			m.outErr = err
+			close(m.output)
+			return
+		}
+	}
+}
+
+// resetModem puts a new xmodem adapter over the session, the transfer of the old one fails at once.
+func (m *ModemShellSession) resetModem() {
+	feed := &modemFeed{m: m, closed: make(chan struct{})}
+	// the config is set for every transfer
+	modem, reader, writer := xmodem.NewModem(xmodem.XModemConfig(0), feed, feed)
+	m.lock.Lock()
+	oldFeed, oldWriter := m.feed, m.writer
+	m.feed, m.modem, m.reader, m.writer = feed, modem, reader, writer
+	m.lock.Unlock()
+	if oldFeed != nil {
+		close(oldFeed.closed)
+	}
+	if closer, ok := oldWriter.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// cancelModem ends a xmodem or ymodem transfer on both sides.
+func (m *ModemShellSession) cancelModem() {
+	_, _ = m.zmodem.Write(modemCancel)
+	m.resetModem()
+}
+
+// modemTransfer runs a xmodem or ymodem transfer.
+func (m *ModemShellSession) modemTransfer(modem *xmodem.Modem, req *modemRequest, progress *modemProgress) error {
+	multiple := req.desc.Type == "y"
+	stream := m.openStream(req, progress)
+	defer m.closeStream(stream)
+	// the data of the transfer must not start a zmodem transfer
+	m.zmodem.pause(true)
+	defer m.zmodem.pause(false)
+	progress.lock.Lock()
+	progress.onCancel = m.cancelModem
+	progress.lock.Unlock()
+	m.retries.reset(progress)
+	defer m.retries.reset(nil)
+	if req.desc.Direct == "send" {
+		files, err := sendFiles(req, stream, multiple)
+		if err != nil {
+			m.cancelModem()
+			return err
+		}
+		defer closeFiles(files)
+		for i := range files {
+			files[i].Body = &progressReader{Reader: files[i].Body, progress: progress, index: i, file: files[i]}
+		}
+		if multiple {
+			err = modem.SendList(files)
+		} else {
+			err = modem.SendBytes(files[0].Body)
+		}
+		if progress.isCanceled() {
+			err = ErrModemCanceled
+		}
+		return err
+	}
+	open, err := receiveTarget(req, stream, multiple)
+	if err != nil {
+		m.cancelModem()
+		return err
+	}
+	var openErr error
+	index := 0
+	err = modem.Receive(func(file xmodem.File) {
+		progress.start(index, file.Path, file.Length)
+		index++
+		writer, err := open(file)
+		if err != nil {
+			openErr = err
+			m.cancelModem()
+			io.ReadAll(file.Body)
+			return
+		}
+		defer writer.Close()
+		io.Copy(&progressWriter{WriteCloser: writer, progress: progress}, file.Body)
+		// the rest of a file the writer failed on is dropped so the modem keeps going
+		io.Copy(io.Discard, file.Body)
+	})
+	if openErr != nil {
+		err = openErr
+	} else if progress.isCanceled() {
+		err = ErrModemCanceled
+	}
+	return err
+}
+
+// textTransfer sends a file as typed input, a paced session sends it at its pace.
+func (m *ModemShellSession) textTransfer(req *modemRequest, progress *modemProgress) error {
+	stream := m.openStream(req, progress)
+	defer m.closeStream(stream)
+	files, err := sendFiles(req, stream, false)
+	if err != nil {
+		return err
+	}
+	defer closeFiles(files)
+	write := func(p []byte) error {
+		_, err := m.Write(p)
+		return err
+	}
+	if paced, ok := m.ss.(PacedSession); ok {
+		write = paced.SendPaced
+	}
+	reader := &progressReader{Reader: files[0].Body, progress: progress, file: files[0]}
+	buf := make([]byte, modemTextChunk)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if err := write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// takeRequest returns the zmodem request armed by a client for direct, without one it tells the
+// clients that sz or rz started and waits until one is armed, the transfer is canceled or it times out.
+func (m *ModemShellSession) takeRequest(z *zmodem, direct string) (*modemRequest, error) {
+	timer := time.NewTimer(modemArmTimeout)
+	defer timer.Stop()
+	detected := false
+	for {
+		m.lock.Lock()
+		req := m.armed
+		if req != nil && req.desc.Direct == direct {
+			m.armed = nil
+			m.lock.Unlock()
+			return req, nil
+		}
+		if m.arming == nil {
+			m.arming = make(chan struct{})
+		}
+		arming := m.arming
+		m.lock.Unlock()
+		if !detected {
+			detected = true
+			m.notifyEvent(ModemEventDesc{
+				Op:     "detected",
+				Direct: direct,
+				Type:   "z",
+			})
+		}
+		z.lock.Lock()
+		changed, canceled, err := z.changed, z.canceled, z.err
+		z.lock.Unlock()
+		if canceled {
+			return nil, ErrModemCanceled
+		} else if err != nil {
+			return nil, err
+		}
+		select {
+		case <-arming:
+		case <-changed:
+		case <-timer.C:
+			return nil, errors.New("no zmodem transfer was armed in time")
+		}
+	}
+}
+
+// arm keeps the zmodem request until sz or rz starts, a detected transfer waiting for it goes on.
+func (m *ModemShellSession) arm(req *modemRequest) {
+	m.lock.Lock()
+	m.armed = req
+	if m.arming != nil {
+		close(m.arming)
+		m.arming = nil
+	}
+	m.lock.Unlock()
+}
+
+// zmodemTransfer runs a transfer started by sz or rz on the remote side.
+func (m *ModemShellSession) zmodemTransfer(z *zmodem, direct string) (err error) {
+	progress, err := m.beginTransfer(direct, "z")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		m.endTransfer(progress, err)
+	}()
+	z.progress = progress
+	progress.lock.Lock()
+	progress.onCancel = z.cancel
+	progress.lock.Unlock()
+	req, err := m.takeRequest(z, direct)
+	if err != nil {
+		return err
+	}
+	stream := m.openStream(req, progress)
+	defer m.closeStream(stream)
+	if direct == "send" {
+		files, err := sendFiles(req, stream, true)
+		if err != nil {
+			return err
+		}
+		defer closeFiles(files)
+		return z.send(files)
+	}
+	open, err := receiveTarget(req, stream, true)
+	if err != nil {
+		return err
+	}
+	return z.receive(open)
+}
+
+func serveModem(conn *WsProtocol, ssid uint16, m *ModemShellSession, desc *ModemDesc, fsys FilesystemSession, windowsPath bool) error {
+	switch desc.Op {
+	case "data":
+		m.lock.Lock()
+		stream := m.stream
+		m.lock.Unlock()
+		if stream != nil {
+			stream.deliver(desc)
+		}
+		return nil
+	case "cancel":
+		m.lock.Lock()
+		m.armed = nil
+		progress := m.transfer
+		m.lock.Unlock()
+		if progress != nil {
+			progress.cancel()
+		}
+		return nil
+	}
+	req := &modemRequest{
+		conn:        conn,
+		ssid:        ssid,
+		desc:        desc,
+		fs:          fsys,
+		windowsPath: windowsPath,
+	}
+	if desc.Type == "z" {
+		m.arm(req)
+		return nil
+	}
+	if desc.Type == "text" {
+		if desc.Direct != "send" {
+			return conn.Info(InfoDesc{
+				Type: "ERROR",
+				Info: "[MODEM] text can only be sent",
+			})
+		}
+		progress, err := m.beginTransfer(desc.Direct, desc.Type)
+		if err != nil {
+			return conn.Info(InfoDesc{
+				Type: "ERROR",
+				Info: fmt.Sprintf("[MODEM] %s", err.Error()),
+			})
+		}
+		go func() {
+			err := m.textTransfer(req, progress)
+			m.endTransfer(progress, err)
+		}()
+		return nil
+	}
+	if desc.Type != "x" && desc.Type != "y" {
+		return conn.Info(InfoDesc{
+			Type: "ERROR",
+			Info: fmt.Sprintf("[MODEM] unknown type: %s", desc.Type),
+		})
+	}
+	progress, err := m.beginTransfer(desc.Direct, desc.Type)
+	if err != nil {
+		return conn.Info(InfoDesc{
+			Type: "ERROR",
+			Info: fmt.Sprintf("[MODEM] %s", err.Error()),
+		})
+	}
+	fn := desc.Fn
+	if desc.Direct == "send" {
+		// a failed send ends with CAN CAN, the modem would send EOT otherwise and the
+		// receiver would keep a truncated file as complete
+		fn |= xmodem.ModemFnCANCAN
+	}
+	m.lock.Lock()
+	modem := m.modem
+	if desc.Type == "x" {
+		modem.Config = xmodem.XModemConfig(fn)
+	} else {
+		modem.Config = xmodem.YModemConfig(fn)
+	}
+	m.lock.Unlock()
+	go func() {
+		err := m.modemTransfer(modem, req, progress)
+		m.endTransfer(progress, err)
+	}()
+	return nil
+}
@@ -0,0 +1,248 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type playbackEvent struct {
+	Time float64
+	Data []byte
+}
+
+// loadPlayback reads an asciicast v2 file, any other file is played as a raw log at once.
+func loadPlayback(name string) ([]playbackEvent, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	if scanner.Scan() {
+		header := castHeader{}
+		if json.Unmarshal(scanner.Bytes(), &header) == nil && header.Version == 2 {
+			events := []playbackEvent{}
+			for scanner.Scan() {
+				event := []interface{}{}
+				if json.Unmarshal(scanner.Bytes(), &event) != nil || len(event) != 3 {
+					continue
+				}
+				t, ok0 := event[0].(float64)
+				code, ok1 := event[1].(string)
+				text, ok2 := event[2].(string)
+				if !ok0 || !ok1 || !ok2 || code != "o" {
+					continue
+				}
+				events = append(events, playbackEvent{t, []byte(text)})
+			}
+			return events, nil
+		}
+	}
+	return []playbackEvent{{0, data}}, nil
+}
+
+// playbackInstance backs a host that only replays recordings, there is no adapter behind it.
+type playbackInstance struct{}
+
+func (playbackInstance) Connect(auth chan bool, callback func(question string), info func(info InfoDesc)) error {
+	return nil
+}
+
+func (playbackInstance) Auth(info AuthDesc) {}
+
+func (playbackInstance) NewShell(id uint16) ShellSession {
+	return nil
+}
+
+func (playbackInstance) NewFS(id uint16) FilesystemSession {
+	return nil
+}
+
+func (playbackInstance) IsWindowsPath() bool {
+	return false
+}
+
+// NewPlaybackHost returns an authorized host to replay recordings in without connecting a config,
+// its config id is 0.
+func NewPlaybackHost() *Host {
+	host := NewHost(0, ConfigBase{Name: "playback"}, playbackInstance{})
+	host.setAuthorized()
+	return host
+}
+
+// Player is a ShellSession that replays a recording with its original timing.
+type Player struct {
+	lock     sync.Mutex
+	changed  chan struct{}
+	events   []playbackEvent
+	index    int
+	pending  []byte
+	position float64 // recording time at base
+	base     time.Time
+	speed    float64
+	paused   bool
+	closed   bool
+}
+
+func NewPlayer() *Player {
+	return &Player{
+		changed: make(chan struct{}),
+		speed:   1,
+		paused:  true,
+	}
+}
+
+func (p *Player) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *Player) clock() float64 {
+	if p.paused {
+		return p.position
+	}
+	return p.position + time.Since(p.base).Seconds()*p.speed
+}
+
+func (p *Player) Open(name string) error {
+	name, err := RecordPath(name)
+	if err != nil {
+		return err
+	}
+	events, err := loadPlayback(name)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.events = events
+	p.index = 0
+	p.pending = []byte("\x1bc")
+	p.position = 0
+	p.base = time.Now()
+	p.paused = false
+	p.notify()
+	return nil
+}
+
+func (p *Player) Pause(paused bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.paused == paused {
+		return
+	}
+	p.position = p.clock()
+	p.base = time.Now()
+	p.paused = paused
+	p.notify()
+}
+
+func (p *Player) SetSpeed(speed float64) {
+	if speed <= 0 {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.position = p.clock()
+	p.base = time.Now()
+	p.speed = speed
+	p.notify()
+}
+
+// Seek resets the terminal and redraws every output up to t at once.
+func (p *Player) Seek(t float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if t < 0 {
+		t = 0
+	}
+	pending := []byte("\x1bc")
+	index := 0
+	for index < len(p.events) && p.events[index].Time <= t {
+		pending = append(pending, p.events[index].Data...)
+		index++
+	}
+	p.pending = pending
+	p.index = index
+	p.position = t
+	p.base = time.Now()
+	p.notify()
+}
+
+func (p *Player) State() PlaybackStateDesc {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	duration := 0.0
+	if len(p.events) > 0 {
+		duration = p.events[len(p.events)-1].Time
+	}
+	position := p.clock()
+	if position > duration {
+		position = duration
+	}
+	return PlaybackStateDesc{
+		Duration: duration,
+		Time:     position,
+		Speed:    p.speed,
+		Paused:   p.paused,
+	}
+}
+
+func (p *Player) Read(b []byte) (n int, err error) {
+	p.lock.Lock()
+	for {
+		if p.closed {
+			p.lock.Unlock()
+			return 0, io.EOF
+		}
+		if len(p.pending) > 0 {
+			n = copy(b, p.pending)
+			p.pending = p.pending[n:]
+			p.lock.Unlock()
+			return n, nil
+		}
+		changed := p.changed
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !p.paused && p.index < len(p.events) {
+			wait := (p.events[p.index].Time - p.clock()) / p.speed
+			if wait <= 0 {
+				p.pending = p.events[p.index].Data
+				p.index++
+				continue
+			}
+			timer = time.NewTimer(time.Duration(wait * float64(time.Second)))
+			timeout = timer.C
+		}
+		p.lock.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		p.lock.Lock()
+	}
+}
+
+func (p *Player) Write(b []byte) (n int, err error) {
+	return len(b), nil
+}
+
+func (p *Player) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.closed {
+		p.closed = true
+		p.notify()
+	}
+	return nil
+}
+
+func (p *Player) Resize(rows int, cols int) {}
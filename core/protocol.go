@@ -7,6 +7,8 @@ import (
 	"github.com/azurity/xmodem-go"
 	"github.com/gorilla/websocket"
 	"net"
+	"sync"
+	"time"
 )
 
 const (
@@ -17,14 +19,28 @@ const (
 	PROTOCOL_FS_OPERATION
 	PROTOCOL_INFO
 	PROTOCOL_MODEM
+	PROTOCOL_HOST
+	PROTOCOL_PLAYBACK
+	PROTOCOL_SERIAL
+	PROTOCOL_ROLE
 	PROTOCOL_RESIZE uint16 = 0x0100
 )
 
 const (
-	SESSION_SHELL uint16 = 0
-	SESSION_SFTP  uint16 = 1
+	SESSION_SHELL    uint16 = 0
+	SESSION_SFTP     uint16 = 1
+	SESSION_PLAYBACK uint16 = 2
 )
 
+// attachment role
+const (
+	ROLE_READ_WRITE uint8 = 0
+	ROLE_READ_ONLY  uint8 = 1
+)
+
+// a viewer that stops reading for longer is dropped, so it can't stall the others
+const wsWriteTimeout = 10 * time.Second
+
 // FS op code
 const (
 	FSOP_GETWD uint8 = iota
@@ -44,6 +60,7 @@ type AuthDesc struct {
 
 type NewSessionDesc struct {
 	Type uint16
+	Role uint8
 }
 
 type CloseSessionDesc struct {
@@ -60,9 +77,86 @@ type InfoDesc struct {
 }
 
 type ModemDesc struct {
+	Op     string         `json:"op"`     // "start"(default)/"data"/"cancel"
 	Direct string         `json:"direct"` // "send"/"recv"
-	Type   string         `json:"type"`   // "x"/"y"
+	Type   string         `json:"type"`   // "x"/"y"/"z"/"text", "z" waits for sz or rz to start, "text" sends a file as input
 	Fn     xmodem.ModemFn `json:"fn"`
+	Source string         `json:"source"` // "dialog"(default)/"path"/"stream"/"fs"
+	// files to send, or the file(x) or directory(y/z) to receive into, on the machine running wterm
+	// or in the filesystem session FS
+	Paths []string `json:"paths,omitempty"`
+	FS    uint16   `json:"fs"`
+	// files streamed by the client for a send
+	Files []ModemFileDesc `json:"files,omitempty"`
+	// answer of a "read" event
+	File   int    `json:"file"`
+	Offset int64  `json:"offset"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+type ModemFileDesc struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"` // unix milliseconds
+}
+
+// ModemEventDesc asks the client for bytes of a streamed file, hands it the received files,
+// or reports the progress and result of a transfer to every viewer.
+type ModemEventDesc struct {
+	Op     string `json:"op"` // "read"/"file"/"data"/"close"/"progress"/"result"/"detected"
+	File   int    `json:"file"`
+	Name   string `json:"name,omitempty"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Data   []byte `json:"data,omitempty"`
+	Direct string `json:"direct,omitempty"`
+	Type   string `json:"type,omitempty"`
+	// bytes done of the file and retries of the transfer, for "progress"
+	Done    int64 `json:"done"`
+	Retries int   `json:"retries"`
+	// empty when a transfer succeeded, for "result"
+	Error string `json:"error,omitempty"`
+}
+
+type HostDesc struct {
+	Id uint64 `json:"id"`
+}
+
+type PlaybackDesc struct {
+	Op    string  `json:"op"` // "open"/"pause"/"resume"/"seek"/"speed"/"state"
+	Path  string  `json:"path"`
+	Time  float64 `json:"time"`
+	Speed float64 `json:"speed"`
+}
+
+type PlaybackStateDesc struct {
+	Duration float64 `json:"duration"`
+	Time     float64 `json:"time"`
+	Speed    float64 `json:"speed"`
+	Paused   bool    `json:"paused"`
+}
+
+type SerialDesc struct {
+	Op       string `json:"op"`       // "break"/"dtr"/"rts"/"log"/"status"
+	Duration int    `json:"duration"` // milliseconds of a break, default is 250
+	Value    bool   `json:"value"`    // level of dtr/rts, start or stop of log
+}
+
+type SerialStatusDesc struct {
+	DTR bool   `json:"dtr"`
+	RTS bool   `json:"rts"`
+	CTS bool   `json:"cts"`
+	DSR bool   `json:"dsr"`
+	RI  bool   `json:"ri"`
+	DCD bool   `json:"dcd"`
+	Log string `json:"log"` // file being logged to, empty when not logging
+}
+
+// RoleDesc shares or unshares input of a session to every viewer when sent by a writer,
+// and tells a viewer its role when sent by the server.
+type RoleDesc struct {
+	Role   uint8 `json:"role"`
+	Shared bool  `json:"shared"`
 }
 
 type SizeDesc struct {
@@ -77,20 +171,37 @@ type WsProtocol struct {
 	sendChan   chan []byte
 	sendCbChan chan error
 	release    chan bool
+	done       chan bool
+	closeOnce  sync.Once
 }
 
-func (c *WsProtocol) Release() {
-	if c.release != nil {
-		c.release <- true
+func newWsProtocol(c *websocket.Conn) *WsProtocol {
+	return &WsProtocol{
+		Conn:       c,
+		Closed:     false,
+		CloseChan:  make(chan bool, 1),
+		sendChan:   make(chan []byte),
+		sendCbChan: make(chan error),
+		release:    make(chan bool),
+		done:       make(chan bool),
 	}
 }
 
+// Release stops the sender, later sends fail at once.
+func (c *WsProtocol) Release() {
+	c.release <- true
+}
+
+func (c *WsProtocol) markClosed() {
+	c.closeOnce.Do(func() {
+		c.Closed = true
+		c.CloseChan <- true
+	})
+}
+
 func (c *WsProtocol) testClose(err error) {
 	if _, ok := err.(*websocket.CloseError); ok || errors.Is(err, net.ErrClosed) {
-		if !c.Closed {
-			c.CloseChan <- true
-		}
-		c.Closed = true
+		c.markClosed()
 	}
 }
 
@@ -108,9 +219,14 @@ func (c *WsProtocol) Recv() (uint16, interface{}, error) {
 		_ = json.Unmarshal(msg[4:], out)
 		return ssid, out, nil
 	case PROTOCOL_NEW_SESSION:
-		return ssid, &NewSessionDesc{
+		out := &NewSessionDesc{
 			Type: binary.LittleEndian.Uint16(msg[4:]),
-		}, nil
+			Role: ROLE_READ_WRITE,
+		}
+		if len(msg) > 6 {
+			out.Role = msg[6]
+		}
+		return ssid, out, nil
 	case PROTOCOL_CLOSE_SESSION:
 		return ssid, &CloseSessionDesc{}, nil
 	case PROTOCOL_TERM_DATA:
@@ -123,6 +239,18 @@ func (c *WsProtocol) Recv() (uint16, interface{}, error) {
 		out := &ModemDesc{}
 		_ = json.Unmarshal(msg[4:], out)
 		return ssid, out, nil
+	case PROTOCOL_PLAYBACK:
+		out := &PlaybackDesc{}
+		_ = json.Unmarshal(msg[4:], out)
+		return ssid, out, nil
+	case PROTOCOL_SERIAL:
+		out := &SerialDesc{}
+		_ = json.Unmarshal(msg[4:], out)
+		return ssid, out, nil
+	case PROTOCOL_ROLE:
+		out := &RoleDesc{}
+		_ = json.Unmarshal(msg[4:], out)
+		return ssid, out, nil
 	case PROTOCOL_RESIZE:
 		out := &SizeDesc{}
 		_ = json.Unmarshal(msg[4:], out)
@@ -133,21 +261,23 @@ func (c *WsProtocol) Recv() (uint16, interface{}, error) {
 }
 
 func (c *WsProtocol) Start() {
-	c.release = make(chan bool)
+	var err error
 	for {
-		buffer := <-c.sendChan
-		err := c.WriteMessage(websocket.BinaryMessage, buffer)
-		c.testClose(err)
-		c.sendCbChan <- err
-		if c.Closed {
-			for {
-				select {
-				case <-c.sendChan:
-					c.sendCbChan <- err
-				case <-c.release:
-					return
+		select {
+		case buffer := <-c.sendChan:
+			if err == nil {
+				_ = c.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+				err = c.WriteMessage(websocket.BinaryMessage, buffer)
+				if err != nil {
+					// a timed out or broken websocket can't be written again, closing it ends the reader too
+					_ = c.Conn.Close()
+					c.markClosed()
 				}
 			}
+			c.sendCbChan <- err
+		case <-c.release:
+			close(c.done)
+			return
 		}
 	}
 }
@@ -158,10 +288,12 @@ func (c *WsProtocol) send(op uint16, ssid uint16, data []byte) error {
 	binary.LittleEndian.PutUint16(buffer[2:], ssid)
 	buffer = append(buffer, data...)
 	//err := c.WriteMessage(websocket.BinaryMessage, buffer)
-	c.sendChan <- buffer
-	err := <-c.sendCbChan
-	c.testClose(err)
-	return err
+	select {
+	case c.sendChan <- buffer:
+	case <-c.done:
+		return net.ErrClosed
+	}
+	return <-c.sendCbChan
 }
 
 func (c *WsProtocol) Auth(question string) error {
@@ -198,3 +330,43 @@ func (c *WsProtocol) Info(data InfoDesc) error {
 	}
 	return c.send(PROTOCOL_INFO, 0, buffer)
 }
+
+func (c *WsProtocol) Host(data HostDesc) error {
+	buffer, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	return c.send(PROTOCOL_HOST, 0, buffer)
+}
+
+func (c *WsProtocol) Playback(ssid uint16, data PlaybackStateDesc) error {
+	buffer, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	return c.send(PROTOCOL_PLAYBACK, ssid, buffer)
+}
+
+func (c *WsProtocol) Modem(ssid uint16, data ModemEventDesc) error {
+	buffer, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	return c.send(PROTOCOL_MODEM, ssid, buffer)
+}
+
+func (c *WsProtocol) Role(ssid uint16, data RoleDesc) error {
+	buffer, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	return c.send(PROTOCOL_ROLE, ssid, buffer)
+}
+
+func (c *WsProtocol) Serial(ssid uint16, data SerialStatusDesc) error {
+	buffer, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	return c.send(PROTOCOL_SERIAL, ssid, buffer)
+}
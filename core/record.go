@@ -0,0 +1,199 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder writes the output, input and resize events of a session as an asciicast v2 file.
+// It is fed at the terminal data layer, so bytes of a modem transfer never reach it.
+type Recorder struct {
+	file    io.WriteCloser
+	title   string
+	start   time.Time
+	lock    sync.Mutex
+	started bool     // header written, it waits for the first resize to know the size
+	pending [][]byte // events before the header
+	closed  bool
+	output  []byte // incomplete utf-8 tail of the last output
+	input   []byte // incomplete utf-8 tail of the last input
+}
+
+// size of the header when the session is never resized
+const (
+	recordDefaultCols = 80
+	recordDefaultRows = 24
+)
+
+func recordName(title string, ssid uint16, now time.Time, ext string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, title)
+	return fmt.Sprintf("%s-%d-%s%s", name, ssid, now.Format("20060102-150405"), ext)
+}
+
+// CreateSessionFile creates a new file named after the session in dir.
+func CreateSessionFile(dir string, title string, ssid uint16, now time.Time, ext string) (*os.File, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	name := recordName(title, ssid, now, ext)
+	for i := 2; ; i++ {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if !errors.Is(err, fs.ErrExist) || i > 100 {
+			return file, err
+		}
+		// another record of the same session started in the same second
+		name = strings.TrimSuffix(recordName(title, ssid, now, ext), ext) + fmt.Sprintf("-%d%s", i, ext)
+	}
+}
+
+var ErrRecordPath = errors.New("not a file in the record directory")
+
+// RecordPath resolves name, relative or absolute, to a file inside the record dir.
+func RecordPath(name string) (string, error) {
+	dir, err := filepath.Abs(MainConfig.Settings.RecordDir)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(dir, name)
+	}
+	rel, err := filepath.Rel(dir, filepath.Clean(name))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrRecordPath
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+// NewRecorder starts a recording of the session in a new file of the record dir.
+func NewRecorder(title string, ssid uint16) (*Recorder, error) {
+	now := time.Now()
+	file, err := CreateSessionFile(MainConfig.Settings.RecordDir, title, ssid, now, ".cast")
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		file:  file,
+		title: title,
+		start: now,
+	}, nil
+}
+
+// splitUTF8 returns the longest prefix of p that does not end inside a multi-byte character.
+func splitUTF8(p []byte) ([]byte, []byte) {
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		c := p[len(p)-i]
+		if c < utf8.RuneSelf {
+			break
+		}
+		if utf8.RuneStart(c) {
+			if !utf8.FullRune(p[len(p)-i:]) {
+				return p[:len(p)-i], p[len(p)-i:]
+			}
+			break
+		}
+	}
+	return p, nil
+}
+
+func (r *Recorder) writeHeader(cols int, rows int) {
+	r.started = true
+	header, err := json.Marshal(castHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: r.start.Unix(),
+		Title:     r.title,
+	})
+	if err != nil {
+		return
+	}
+	_, _ = r.file.Write(append(header, '\n'))
+	for _, line := range r.pending {
+		_, _ = r.file.Write(line)
+	}
+	r.pending = nil
+}
+
+func (r *Recorder) event(code string, data string) {
+	line, err := json.Marshal([]interface{}{time.Since(r.start).Seconds(), code, data})
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if !r.started {
+		r.pending = append(r.pending, line)
+		return
+	}
+	_, _ = r.file.Write(line)
+}
+
+func (r *Recorder) text(code string, tail *[]byte, p []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	data, rest := splitUTF8(append(*tail, p...))
+	*tail = append([]byte{}, rest...)
+	if len(data) > 0 {
+		r.event(code, string(data))
+	}
+}
+
+func (r *Recorder) Output(p []byte) {
+	r.text("o", &r.output, p)
+}
+
+func (r *Recorder) Input(p []byte) {
+	r.text("i", &r.input, p)
+}
+
+func (r *Recorder) Resize(rows int, cols int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	if !r.started {
+		r.writeHeader(cols, rows)
+		return
+	}
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if !r.started {
+		r.writeHeader(recordDefaultCols, recordDefaultRows)
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,53 @@
+package core
+
+// RingBuffer keeps the most recent bytes written into it, up to a fixed limit.
+type RingBuffer struct {
+	buf   []byte
+	start int
+	size  int
+}
+
+func NewRingBuffer(limit int) *RingBuffer {
+	return &RingBuffer{
+		buf: make([]byte, limit),
+	}
+}
+
+func (r *RingBuffer) Write(p []byte) (n int, err error) {
+	n = len(p)
+	limit := len(r.buf)
+	if limit == 0 {
+		return n, nil
+	}
+	if len(p) >= limit {
+		copy(r.buf, p[len(p)-limit:])
+		r.start = 0
+		r.size = limit
+		return n, nil
+	}
+	end := (r.start + r.size) % limit
+	copied := copy(r.buf[end:], p)
+	copy(r.buf, p[copied:])
+	r.size += len(p)
+	if r.size > limit {
+		r.start = (r.start + r.size - limit) % limit
+		r.size = limit
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the buffered data in write order.
+func (r *RingBuffer) Bytes() []byte {
+	ret := make([]byte, r.size)
+	end := r.start + r.size
+	if end > len(r.buf) {
+		end = len(r.buf)
+	}
+	copied := copy(ret, r.buf[r.start:end])
+	copy(ret[copied:], r.buf[:r.size-copied])
+	return ret
+}
+
+func (r *RingBuffer) Len() int {
+	return r.size
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRingBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		writes []string
+		want   string
+	}{
+		{"empty", 8, nil, ""},
+		{"under limit", 8, []string{"abc", "de"}, "abcde"},
+		{"exactly full", 4, []string{"ab", "cd"}, "abcd"},
+		{"overflow keeps the tail", 4, []string{"abc", "def"}, "cdef"},
+		{"wraps several times", 5, []string{"abc", "def", "ghi", "jk"}, "ghijk"},
+		{"single write over limit", 3, []string{"abcdefg"}, "efg"},
+		{"big write after wrap", 4, []string{"ab", "cde", "vwxyz"}, "wxyz"},
+		{"small writes", 3, []string{"a", "b", "c", "d", "e"}, "cde"},
+		{"empty write", 3, []string{"ab", "", "c"}, "abc"},
+		{"zero limit", 0, []string{"abc"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewRingBuffer(test.limit)
+			for _, w := range test.writes {
+				n, err := r.Write([]byte(w))
+				if err != nil || n != len(w) {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if got := r.Bytes(); !bytes.Equal(got, []byte(test.want)) {
+				t.Errorf("Bytes() = %q, want %q", got, test.want)
+			}
+			if r.Len() != len(test.want) {
+				t.Errorf("Len() = %d, want %d", r.Len(), len(test.want))
+			}
+		})
+	}
+}
+
+func TestRingBufferBytesIsACopy(t *testing.T) {
+	r := NewRingBuffer(4)
+	r.Write([]byte("abcd"))
+	got := r.Bytes()
+	got[0] = 'x'
+	if string(r.Bytes()) != "abcd" {
+		t.Errorf("Bytes() shares the buffer")
+	}
+}
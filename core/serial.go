@@ -0,0 +1,101 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+const defaultBreak = 250 * time.Millisecond
+const serialPollInterval = 100 * time.Millisecond
+
+// SerialControl is implemented by shell sessions over a serial line.
+type SerialControl interface {
+	Break(duration time.Duration) error
+	SetDTR(dtr bool) error
+	SetRTS(rts bool) error
+	StartLog() error
+	StopLog() error
+	SerialStatus() (SerialStatusDesc, error)
+}
+
+// serialControl looks for a SerialControl through the wrappers of a shell session.
+func serialControl(value io.Closer) (SerialControl, bool) {
+	for {
+		if control, ok := value.(SerialControl); ok {
+			return control, true
+		}
+		wrapper, ok := value.(interface{ Unwrap() ShellSession })
+		if !ok {
+			return nil, false
+		}
+		value = wrapper.Unwrap()
+	}
+}
+
+// watchSerial polls the modem status of a serial session and sends every change to its viewers.
+func watchSerial(session *Session, control SerialControl) {
+	last, err := control.SerialStatus()
+	if err != nil {
+		return
+	}
+	for {
+		time.Sleep(serialPollInterval)
+		if current, ok := session.host.Load(session.Id); !ok || current != session {
+			return
+		}
+		status, err := control.SerialStatus()
+		if err != nil {
+			return
+		}
+		if status != last {
+			last = status
+			session.serialStatus(status)
+		}
+	}
+}
+
+func serveSerial(conn *WsProtocol, host *Host, ssid uint16, control SerialControl, desc *SerialDesc) error {
+	var err error
+	switch desc.Op {
+	case "break":
+		duration := time.Duration(desc.Duration) * time.Millisecond
+		if duration <= 0 {
+			duration = defaultBreak
+		}
+		// a long break must not hold up the websocket, the result goes to whoever is attached when it ends
+		go func() {
+			if err := control.Break(duration); err != nil {
+				host.Info(InfoDesc{
+					Type: "ERROR",
+					Info: fmt.Sprintf("[SERIAL BREAK] %s", err.Error()),
+				})
+			}
+		}()
+		return nil
+	case "dtr":
+		err = control.SetDTR(desc.Value)
+	case "rts":
+		err = control.SetRTS(desc.Value)
+	case "log":
+		if desc.Value {
+			err = control.StartLog()
+		} else {
+			err = control.StopLog()
+		}
+	}
+	if err != nil {
+		return conn.Info(InfoDesc{
+			Type: "ERROR",
+			Info: fmt.Sprintf("[SERIAL %s] %s", desc.Op, err.Error()),
+		})
+	}
+	status, err := control.SerialStatus()
+	if err != nil {
+		return conn.Info(InfoDesc{
+			Type: "ERROR",
+			Info: fmt.Sprintf("[SERIAL STATUS] %s", err.Error()),
+		})
+	}
+	return conn.Serial(ssid, status)
+}
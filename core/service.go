@@ -11,7 +11,6 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
 	"sync"
 	"sync/atomic"
 )
@@ -22,18 +21,58 @@ type ShellSession interface {
 }
 
 type ModemShellSession struct {
-	ss     ShellSession
-	reader io.Reader
-	writer io.Writer
-	modem  *xmodem.Modem
+	ss       ShellSession
+	reader   io.Reader
+	writer   io.Writer
+	modem    *xmodem.Modem
+	feed     *modemFeed
+	output   chan []byte // the output of the zmodem tap, read by the feed of the current modem
+	outErr   error       // why output was closed
+	zmodem   *zmodemTap
+	lock     sync.Mutex
+	armed    *modemRequest
+	arming   chan struct{} // closed once a zmodem request is armed
+	stream   *modemStream
+	transfer *modemProgress
+	retries  modemRetries // of the running xmodem or ymodem transfer
+	notify   func(event ModemEventDesc)
 }
 
+// Read reads the terminal output, it moves on to the new modem when the old one was reset.
 func (m *ModemShellSession) Read(p []byte) (n int, err error) {
-	return m.reader.Read(p)
+	for {
+		m.lock.Lock()
+		reader := m.reader
+		m.lock.Unlock()
+		n, err = reader.Read(p)
+		if err == nil || n > 0 {
+			return n, err
+		}
+		m.lock.Lock()
+		reset := m.reader != reader
+		m.lock.Unlock()
+		if !reset {
+			return n, err
+		}
+	}
 }
 
 func (m *ModemShellSession) Write(p []byte) (n int, err error) {
-	return m.writer.Write(p)
+	for {
+		m.lock.Lock()
+		writer := m.writer
+		m.lock.Unlock()
+		n, err = writer.Write(p)
+		if err == nil || n > 0 {
+			return n, err
+		}
+		m.lock.Lock()
+		reset := m.writer != writer
+		m.lock.Unlock()
+		if !reset {
+			return n, err
+		}
+	}
 }
 
 func (m *ModemShellSession) Close() error {
@@ -44,17 +83,36 @@ func (m *ModemShellSession) Resize(rows int, cols int) {
 	m.ss.Resize(rows, cols)
 }
 
-func wrapModem(session ShellSession) *ModemShellSession {
-	// reset config when use
-	m, r, w := xmodem.NewModem(xmodem.XModemConfig(0), session, session)
-	return &ModemShellSession{
-		ss:     session,
-		reader: r,
-		writer: w,
-		modem:  m,
+func (m *ModemShellSession) Unwrap() ShellSession {
+	return m.ss
+}
+
+// TransferSession is implemented by shell sessions that translate the terminal data,
+// the data of a modem transfer must pass through them unchanged.
+type TransferSession interface {
+	SetTransfer(active bool)
+}
+
+// PacedSession is implemented by shell sessions that pace their input, SendPaced returns
+// once data was sent so a text file send can report its progress and be canceled.
+type PacedSession interface {
+	SendPaced(data []byte) error
+}
+
+func (m *ModemShellSession) setTransfer(active bool) {
+	if cased, ok := m.ss.(TransferSession); ok {
+		cased.SetTransfer(active)
 	}
 }
 
+func wrapModem(session ShellSession) *ModemShellSession {
+	ret := &ModemShellSession{ss: session, output: make(chan []byte)}
+	ret.zmodem = newZModemTap(session, ret.zmodemTransfer)
+	go ret.pumpOutput()
+	ret.resetModem()
+	return ret
+}
+
 type FSBase interface {
 	hackpadfs.FS
 	hackpadfs.OpenFileFS
@@ -73,30 +131,25 @@ type FilesystemSession interface {
 }
 
 type ServeInstance interface {
-	Connect(auth chan bool, callback func(question string)) error
+	Connect(auth chan bool, callback func(question string), info func(info InfoDesc)) error
 	Auth(info AuthDesc)
 	NewShell(id uint16) ShellSession
 	NewFS(id uint16) FilesystemSession
 	IsWindowsPath() bool
 }
 
-func shellSessionReader(id uint16, ss ShellSession, conn *WsProtocol) {
+func shellSessionReader(session *Session) {
 	buf := make([]byte, 1024)
 	for {
-		n, err := ss.Read(buf)
+		n, err := session.Value.(ShellSession).Read(buf)
 		if n > 0 {
-			err = conn.TermData(id, buf[:n])
-			if conn.Closed {
-				return
-			} else if err != nil {
-				//logError(err)
-				break
-			}
+			session.termData(buf[:n])
 		}
 		if err != nil {
 			break
 		}
 	}
+	_ = session.host.Remove(session.Id)
 }
 
 var DownloadUrlSet = sync.Map{}
@@ -104,44 +157,65 @@ var downloadUrlName = new(uint64)
 var UploadUrlSet = sync.Map{}
 var uploadUrlName = new(uint64)
 
-func ServeWS(c *websocket.Conn, instance ServeInstance) error {
-	conn := &WsProtocol{
-		Conn:       c,
-		Closed:     false,
-		CloseChan:  make(chan bool),
-		sendChan:   make(chan []byte),
-		sendCbChan: make(chan error),
-	}
+// ServeWS serves a websocket for the host, the host's sessions stay alive after the websocket closes.
+func ServeWS(c *websocket.Conn, host *Host) error {
+	conn := newWsProtocol(c)
 	go conn.Start()
-	var err error
-	authChan := make(chan bool)
-	authorized := false
+	instance := host.Instance
+	host.attach(conn)
+	authorized := host.Authorized()
 	updateAuth := make(chan bool)
-	go func() {
-		result := <-authChan
-		if !result {
-			c.Close()
-			conn.Closed = true
-			conn.CloseChan <- true
-			return
+	if authorized {
+		err := conn.Host(HostDesc{Id: host.Id})
+		if err != nil {
+			host.detach(conn)
+			conn.Release()
+			return err
+		}
+	} else {
+		authChan := make(chan bool)
+		go func() {
+			result := <-authChan
+			if !result {
+				c.Close()
+				conn.markClosed()
+				return
+			}
+			host.setAuthorized()
+			authorized = true
+			updateAuth <- true
+			_ = conn.Host(HostDesc{Id: host.Id})
+		}()
+		// start connect
+		err := instance.Connect(authChan, func(question string) {
+			conn.Auth(question)
+		}, host.Info)
+		if err != nil {
+			host.detach(conn)
+			conn.Release()
+			return err
 		}
-		authorized = true
-		updateAuth <- true
-	}()
-	// start connect
-	err = instance.Connect(authChan, func(question string) {
-		conn.Auth(question)
-	})
-	if err != nil {
-		return err
 	}
-	sessionSet := sync.Map{}
+	lookup := func(ssid uint16) (io.Closer, bool) {
+		if session, ok := host.Load(ssid); ok && session.attached(conn) {
+			return session.Value, true
+		}
+		return nil, false
+	}
+	writable := func(ssid uint16) (io.Closer, bool) {
+		if session, ok := host.Load(ssid); ok && session.writable(conn) {
+			return session.Value, true
+		}
+		return nil, false
+	}
 	go func() {
 		type packType struct {
 			ssid uint16
 			msg  interface{}
 		}
 		caches := []packType{}
+		// sessions this websocket was told its input is ignored in
+		ignored := map[uint16]bool{}
 		recvChan := make(chan packType)
 		go func() {
 			for {
@@ -188,20 +262,57 @@ func ServeWS(c *websocket.Conn, instance ServeInstance) error {
 			} else {
 				var err error
 				if cased, ok := msg.(*NewSessionDesc); ok {
-					if _, ok := sessionSet.Load(ssid); ok {
+					if session, ok := host.Load(ssid); ok {
+						// join a session opened by another websocket, or left by a previous one
+						success := session.Type == cased.Type && !session.attached(conn)
+						err = conn.NewSession(ssid, success, instance.IsWindowsPath())
+						if success && err == nil {
+							role := session.attach(conn, cased.Role)
+							err = conn.Role(ssid, RoleDesc{Role: role, Shared: session.isShared()})
+						}
+					} else if cased.Role != ROLE_READ_WRITE {
+						// read-only viewers can only join existing sessions
 						err = conn.NewSession(ssid, false, false)
 					} else if cased.Type == SESSION_SHELL {
 						ret := instance.NewShell(ssid)
+						var session *Session
 						if ret != nil {
-							ret = wrapModem(ret)
-							sessionSet.Store(ssid, ret)
-							go shellSessionReader(ssid, ret, conn)
+							modem := wrapModem(ret)
+							session = host.store(ssid, SESSION_SHELL, modem)
+							if host.Config.Record {
+								recorder, err := NewRecorder(host.Config.Name, ssid)
+								if err != nil {
+									_ = conn.Info(InfoDesc{
+										Type: "ERROR",
+										Info: fmt.Sprintf("[RECORD] %s", err.Error()),
+									})
+								} else {
+									session.recorder = recorder
+								}
+							}
+							modem.setNotify(session.modemEvent)
+							go shellSessionReader(session)
+							if control, ok := serialControl(ret); ok {
+								go watchSerial(session, control)
+							}
 						}
 						err = conn.NewSession(ssid, ret != nil, instance.IsWindowsPath())
+						if session != nil && err == nil {
+							// output produced before the reply is replayed from scrollback
+							session.attach(conn, ROLE_READ_WRITE)
+						}
+					} else if cased.Type == SESSION_PLAYBACK {
+						session := host.store(ssid, SESSION_PLAYBACK, NewPlayer())
+						go shellSessionReader(session)
+						err = conn.NewSession(ssid, true, false)
+						if err == nil {
+							session.attach(conn, ROLE_READ_WRITE)
+						}
 					} else if cased.Type == SESSION_SFTP {
 						ret := instance.NewFS(ssid)
 						if ret != nil {
-							sessionSet.Store(ssid, ret)
+							session := host.store(ssid, SESSION_SFTP, ret)
+							session.attach(conn, ROLE_READ_WRITE)
 						}
 						err = conn.NewSession(ssid, ret != nil, instance.IsWindowsPath())
 					} else {
@@ -209,16 +320,38 @@ func ServeWS(c *websocket.Conn, instance ServeInstance) error {
 						err = conn.NewSession(ssid, false, false)
 					}
 				} else if _, ok := msg.(*CloseSessionDesc); ok {
-					if session, ok := sessionSet.Load(ssid); ok {
-						err = session.(io.Closer).Close()
-						sessionSet.Delete(ssid)
+					if session, ok := host.Load(ssid); ok {
+						if session.writable(conn) {
+							err = host.Remove(ssid)
+						} else {
+							// read-only viewers only leave the session
+							session.detach(conn)
+						}
 					}
 				} else if cased, ok := msg.([]byte); ok {
-					if session, ok := sessionSet.Load(ssid); ok {
-						_, err = session.(ShellSession).Write(cased)
+					if session, ok := host.Load(ssid); ok && session.writable(conn) {
+						delete(ignored, ssid)
+						_, err = session.Value.(ShellSession).Write(cased)
+						session.recordInput(cased)
+					} else if ok && session.attached(conn) && !ignored[ssid] {
+						ignored[ssid] = true
+						err = conn.Info(InfoDesc{
+							Type: "ERROR",
+							Info: "[SESSION] read-only viewer, input is ignored",
+						})
 					}
 				} else if cased, ok := msg.(*FsOperationDesc); ok {
-					if session, ok := sessionSet.Load(ssid); ok {
+					session, ok := lookup(ssid)
+					if op := uint8(cased.Op); ok && op != FSOP_GETWD && op != FSOP_READDIR {
+						// read-only viewers can only browse
+						if session, ok = writable(ssid); !ok {
+							err = conn.Info(InfoDesc{
+								Type: "ERROR",
+								Info: "[FS] read-only viewers cannot change or transfer files",
+							})
+						}
+					}
+					if ok {
 						switch uint8(cased.Op) {
 						case FSOP_GETWD:
 							var path string
@@ -418,131 +551,53 @@ func ServeWS(c *websocket.Conn, instance ServeInstance) error {
 						}
 					}
 				} else if cased, ok := msg.(*ModemDesc); ok {
-					if session, ok := sessionSet.Load(ssid); ok {
-						var conf xmodem.ModemConfig
-						if cased.Type == "x" {
-							conf = xmodem.XModemConfig(cased.Fn)
-						} else if cased.Type == "y" {
-							conf = xmodem.YModemConfig(cased.Fn)
+					if session, ok := writable(ssid); ok && isModem(session) {
+						var fsys FilesystemSession
+						if cased.Source == MODEM_FS {
+							var value io.Closer
+							if cased.Direct == "send" {
+								value, _ = lookup(cased.FS)
+							} else {
+								value, _ = writable(cased.FS)
+							}
+							fsys, _ = value.(FilesystemSession)
 						}
-						session.(*ModemShellSession).modem.Config = conf
-						if cased.Direct == "send" {
-							go func() {
-								if cased.Type == "y" {
-									paths, err := zenity.SelectFileMultiple(zenity.Title("upload files"))
-									if err != nil {
-										session.(*ModemShellSession).modem.SendBreak()
-										// TODO:
-										return
-									}
-									sFiles := []xmodem.File{}
-									for _, file := range paths {
-										f, err := os.Open(file)
-										if err != nil {
-											session.(*ModemShellSession).modem.SendBreak()
-											// TODO:
-											return
-										}
-										stat, err := f.Stat()
-										if err != nil {
-											session.(*ModemShellSession).modem.SendBreak()
-											f.Close()
-											// TODO:
-											return
-										}
-										sFiles = append(sFiles, xmodem.File{
-											Path:    filepath.Base(file),
-											Length:  stat.Size(),
-											ModTime: stat.ModTime(),
-											Mode:    stat.Mode(),
-											Body:    f,
-										})
-									}
-									err = session.(*ModemShellSession).modem.SendList(sFiles)
-									for _, f := range sFiles {
-										f.Body.(*os.File).Close()
-									}
-									if err != nil {
-										// TODO:
-										return
-									}
-								} else {
-									path, err := zenity.SelectFile(zenity.Title("upload files"))
-									f, err := os.Open(path)
-									if err != nil {
-										session.(*ModemShellSession).modem.SendBreak()
-										// TODO:
-										return
-									}
-									defer f.Close()
-									err = session.(*ModemShellSession).modem.SendBytes(f)
-									if err != nil {
-										// TODO:
-										return
-									}
+						err = serveModem(conn, ssid, session.(*ModemShellSession), cased, fsys, instance.IsWindowsPath())
+					}
+				} else if cased, ok := msg.(*PlaybackDesc); ok {
+					if session, ok := lookup(ssid); ok {
+						if player, ok := session.(*Player); ok {
+							if cased.Op != "state" {
+								if _, ok := writable(ssid); !ok {
+									player = nil
 								}
-							}()
-						} else {
-							go func() {
-								if cased.Type == "x" {
-									path, err := zenity.SelectFileSave(zenity.Title("download file"))
-									if err != nil {
-										session.(*ModemShellSession).modem.SendBreak()
-										// TODO:
-										return
-									}
-									err = session.(*ModemShellSession).modem.Receive(func(file xmodem.File) {
-										f, err := os.Create(path)
-										if err != nil {
-											session.(*ModemShellSession).modem.SendBreak()
-											io.ReadAll(file.Body)
-											// TODO:
-											return
-										}
-										defer f.Close()
-										io.Copy(f, file.Body)
-									})
-									if err != nil {
-										// TODO:
-										return
-									}
-								} else {
-									path, err := zenity.SelectFile(zenity.Title("download files to..."), zenity.Directory())
-									if err != nil {
-										session.(*ModemShellSession).modem.SendBreak()
-										// TODO:
-										return
-									}
-									err = os.MkdirAll(path, fs.ModePerm)
-									if err != nil {
-										session.(*ModemShellSession).modem.SendBreak()
-										// TODO:
-										return
-									}
-									err = session.(*ModemShellSession).modem.Receive(func(file xmodem.File) {
-										// TODO: better safety filter
-										p := strings.Replace(file.Path, "/", "_", -1)
-										f, err := os.Create(filepath.Join(path, p))
-										if err != nil {
-											session.(*ModemShellSession).modem.SendBreak()
-											io.ReadAll(file.Body)
-											// TODO:
-											return
-										}
-										defer f.Close()
-										io.Copy(f, file.Body)
-									})
-									if err != nil {
-										// TODO:
-										return
-									}
+							}
+							if player != nil {
+								err = servePlayback(conn, ssid, player, cased)
+							}
+						}
+					}
+				} else if cased, ok := msg.(*SerialDesc); ok {
+					if session, ok := lookup(ssid); ok {
+						if control, ok := serialControl(session); ok {
+							if cased.Op != "status" {
+								if _, ok := writable(ssid); !ok {
+									control = nil
 								}
-							}()
+							}
+							if control != nil {
+								err = serveSerial(conn, host, ssid, control, cased)
+							}
 						}
 					}
+				} else if cased, ok := msg.(*RoleDesc); ok {
+					if session, ok := host.Load(ssid); ok && session.writable(conn) {
+						session.share(conn, cased.Shared)
+					}
 				} else if cased, ok := msg.(*SizeDesc); ok {
-					if session, ok := sessionSet.Load(ssid); ok {
-						session.(ShellSession).Resize(cased.Rows, cased.Cols)
+					if session, ok := host.Load(ssid); ok && session.writable(conn) {
+						session.Value.(ShellSession).Resize(cased.Rows, cased.Cols)
+						session.recordResize(cased.Rows, cased.Cols)
 					}
 				}
 				if err != nil {
@@ -556,14 +611,38 @@ func ServeWS(c *websocket.Conn, instance ServeInstance) error {
 		}
 	}()
 	<-conn.CloseChan
-	sessionSet.Range(func(key, value any) bool {
-		value.(io.Closer).Close()
-		return true
-	})
+	host.detach(conn)
 	conn.Release()
 	return nil
 }
 
+func isModem(session io.Closer) bool {
+	_, ok := session.(*ModemShellSession)
+	return ok
+}
+
+func servePlayback(conn *WsProtocol, ssid uint16, player *Player, desc *PlaybackDesc) error {
+	switch desc.Op {
+	case "open":
+		err := player.Open(desc.Path)
+		if err != nil {
+			return conn.Info(InfoDesc{
+				Type: "ERROR",
+				Info: fmt.Sprintf("[PLAYBACK] %s", err.Error()),
+			})
+		}
+	case "pause":
+		player.Pause(true)
+	case "resume":
+		player.Pause(false)
+	case "seek":
+		player.Seek(desc.Time)
+	case "speed":
+		player.SetSpeed(desc.Speed)
+	}
+	return conn.Playback(ssid, player.State())
+}
+
 type WebDirEntry struct {
 	Name    string `json:"name"`
 	Dir     bool   `json:"dir"`
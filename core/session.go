@@ -0,0 +1,416 @@
+package core
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session is a shell or filesystem session owned by a Host.
+// It outlives the websocket that created it, so a client can attach to it again later.
+type Session struct {
+	Id     uint16
+	Type   uint16
+	Value  io.Closer
+	host   *Host
+	lock   sync.Mutex
+	conns  map[*WsProtocol]uint8 // attached viewers and their roles
+	asked  []*WsProtocol         // viewers that asked for write access, oldest first
+	shared bool                  // every viewer may write, granted by a writer
+	ring   *RingBuffer
+	// records what the viewers see and type, nil when the config does not record
+	recorder *Recorder
+	// keeps output in order while it is sent outside lock
+	sendLock sync.Mutex
+}
+
+// attach binds conn to the session and replays the scrollback to it.
+// The server picks the role: a viewer only gets write access when it asks for it and
+// either no writer is attached, e.g. the owner coming back after a reload, or input is shared.
+// A viewer that asked for it gets write access later, once the last writer detaches.
+func (s *Session) attach(conn *WsProtocol, requested uint8) uint8 {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	s.lock.Lock()
+	role := ROLE_READ_ONLY
+	if requested == ROLE_READ_WRITE {
+		if s.shared || !s.hasWriter() {
+			role = ROLE_READ_WRITE
+		}
+		s.asked = append(s.asked, conn)
+	}
+	s.conns[conn] = role
+	var replay []byte
+	if s.ring != nil && s.ring.Len() > 0 && !conn.Closed {
+		replay = s.ring.Bytes()
+	}
+	s.lock.Unlock()
+	if replay != nil {
+		_ = conn.TermData(s.Id, replay)
+	}
+	return role
+}
+
+func (s *Session) hasWriter() bool {
+	for _, role := range s.conns {
+		if role == ROLE_READ_WRITE {
+			return true
+		}
+	}
+	return false
+}
+
+// share grants write access to every viewer or takes it back from all but by.
+func (s *Session) share(by *WsProtocol, shared bool) {
+	s.lock.Lock()
+	s.shared = shared
+	roles := map[*WsProtocol]uint8{}
+	for conn := range s.conns {
+		if shared || conn == by {
+			s.conns[conn] = ROLE_READ_WRITE
+		} else {
+			s.conns[conn] = ROLE_READ_ONLY
+		}
+		roles[conn] = s.conns[conn]
+	}
+	s.lock.Unlock()
+	for conn, role := range roles {
+		_ = conn.Role(s.Id, RoleDesc{Role: role, Shared: shared})
+	}
+}
+
+// detach unbinds conn, when it was the last writer the oldest viewer that asked for write access
+// takes over, e.g. the owner reattached before its dropped websocket was noticed.
+func (s *Session) detach(conn *WsProtocol) {
+	s.lock.Lock()
+	role, ok := s.conns[conn]
+	delete(s.conns, conn)
+	for i, it := range s.asked {
+		if it == conn {
+			s.asked = append(s.asked[:i], s.asked[i+1:]...)
+			break
+		}
+	}
+	var promoted *WsProtocol
+	if ok && role == ROLE_READ_WRITE && !s.hasWriter() {
+		for _, it := range s.asked {
+			if s.conns[it] == ROLE_READ_ONLY {
+				promoted = it
+				s.conns[it] = ROLE_READ_WRITE
+				break
+			}
+		}
+	}
+	shared := s.shared
+	s.lock.Unlock()
+	if promoted != nil {
+		_ = promoted.Role(s.Id, RoleDesc{Role: ROLE_READ_WRITE, Shared: shared})
+	}
+}
+
+func (s *Session) attached(conn *WsProtocol) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.conns[conn]
+	return ok
+}
+
+func (s *Session) writable(conn *WsProtocol) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	role, ok := s.conns[conn]
+	return ok && role == ROLE_READ_WRITE
+}
+
+func (s *Session) isShared() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.shared
+}
+
+// viewers returns the attached websockets, so they can be written without holding lock.
+func (s *Session) viewers() []*WsProtocol {
+	ret := make([]*WsProtocol, 0, len(s.conns))
+	for conn := range s.conns {
+		ret = append(ret, conn)
+	}
+	return ret
+}
+
+func (s *Session) termData(data []byte) {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	s.lock.Lock()
+	if s.ring != nil {
+		_, _ = s.ring.Write(data)
+	}
+	if s.recorder != nil {
+		s.recorder.Output(data)
+	}
+	conns := s.viewers()
+	s.lock.Unlock()
+	for _, conn := range conns {
+		_ = conn.TermData(s.Id, data)
+	}
+}
+
+func (s *Session) recordInput(data []byte) {
+	if s.recorder != nil {
+		s.recorder.Input(data)
+	}
+}
+
+func (s *Session) recordResize(rows int, cols int) {
+	if s.recorder != nil {
+		s.recorder.Resize(rows, cols)
+	}
+}
+
+func (s *Session) close() error {
+	err := s.Value.Close()
+	if s.recorder != nil {
+		_ = s.recorder.Close()
+	}
+	return err
+}
+
+func (s *Session) serialStatus(status SerialStatusDesc) {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	s.lock.Lock()
+	conns := s.viewers()
+	s.lock.Unlock()
+	for _, conn := range conns {
+		_ = conn.Serial(s.Id, status)
+	}
+}
+
+func (s *Session) modemEvent(event ModemEventDesc) {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	s.lock.Lock()
+	conns := s.viewers()
+	s.lock.Unlock()
+	for _, conn := range conns {
+		_ = conn.Modem(s.Id, event)
+	}
+}
+
+// Host holds a connected ServeInstance together with every session opened on it.
+type Host struct {
+	Id         uint64
+	ConfigId   uint64
+	Config     ConfigBase
+	Instance   ServeInstance
+	authorized bool
+	lock       sync.Mutex
+	sessions   map[uint16]*Session
+	conns      map[*WsProtocol]bool
+	timer      *time.Timer
+	closed     bool
+}
+
+type HostInfo struct {
+	Id       uint64            `json:"id"`
+	ConfigId uint64            `json:"configId"`
+	Sessions []HostSessionInfo `json:"sessions"`
+	Attached bool              `json:"attached"`
+}
+
+type HostSessionInfo struct {
+	Id   uint16 `json:"id"`
+	Type uint16 `json:"type"`
+}
+
+var hostSet = sync.Map{}
+var hostName = new(uint64)
+
+func NewHost(configId uint64, config ConfigBase, instance ServeInstance) *Host {
+	host := &Host{
+		Id:       atomic.AddUint64(hostName, 1),
+		ConfigId: configId,
+		Config:   config,
+		Instance: instance,
+		sessions: map[uint16]*Session{},
+		conns:    map[*WsProtocol]bool{},
+	}
+	hostSet.Store(host.Id, host)
+	return host
+}
+
+// LoadHost returns an authorized host that a new websocket can attach to.
+func LoadHost(id uint64) *Host {
+	if value, ok := hostSet.Load(id); ok {
+		host := value.(*Host)
+		host.lock.Lock()
+		defer host.lock.Unlock()
+		if host.authorized && !host.closed {
+			return host
+		}
+	}
+	return nil
+}
+
+func ListHosts() []HostInfo {
+	ret := []HostInfo{}
+	hostSet.Range(func(key, value any) bool {
+		host := value.(*Host)
+		host.lock.Lock()
+		info := HostInfo{
+			Id:       host.Id,
+			ConfigId: host.ConfigId,
+			Sessions: []HostSessionInfo{},
+			Attached: len(host.conns) > 0,
+		}
+		for id, session := range host.sessions {
+			info.Sessions = append(info.Sessions, HostSessionInfo{Id: id, Type: session.Type})
+		}
+		host.lock.Unlock()
+		sort.Slice(info.Sessions, func(i, j int) bool { return info.Sessions[i].Id < info.Sessions[j].Id })
+		ret = append(ret, info)
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Id < ret[j].Id })
+	return ret
+}
+
+func (h *Host) Authorized() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.authorized
+}
+
+func (h *Host) setAuthorized() {
+	h.lock.Lock()
+	h.authorized = true
+	h.lock.Unlock()
+}
+
+func (h *Host) attach(conn *WsProtocol) {
+	h.lock.Lock()
+	h.conns[conn] = true
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+	h.lock.Unlock()
+}
+
+// detach drops every session binding of conn and starts the idle timer once the host has no client left.
+func (h *Host) detach(conn *WsProtocol) {
+	h.lock.Lock()
+	sessions := make([]*Session, 0, len(h.sessions))
+	for _, session := range h.sessions {
+		sessions = append(sessions, session)
+	}
+	h.lock.Unlock()
+	// a viewer taking over write access is told without holding lock
+	for _, session := range sessions {
+		session.detach(conn)
+	}
+	h.lock.Lock()
+	delete(h.conns, conn)
+	if len(h.conns) > 0 {
+		h.lock.Unlock()
+		return
+	}
+	timeout := time.Duration(MainConfig.Settings.DetachTimeout) * time.Second
+	if !h.authorized || timeout <= 0 {
+		h.lock.Unlock()
+		h.Close()
+		return
+	}
+	h.timer = time.AfterFunc(timeout, func() {
+		h.lock.Lock()
+		idle := len(h.conns) == 0
+		h.lock.Unlock()
+		if idle {
+			h.Close()
+		}
+	})
+	h.lock.Unlock()
+}
+
+// Info sends info to every websocket attached to the host.
+func (h *Host) Info(info InfoDesc) {
+	h.lock.Lock()
+	conns := make([]*WsProtocol, 0, len(h.conns))
+	for conn := range h.conns {
+		conns = append(conns, conn)
+	}
+	h.lock.Unlock()
+	for _, conn := range conns {
+		_ = conn.Info(info)
+	}
+}
+
+func (h *Host) Load(ssid uint16) (*Session, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	session, ok := h.sessions[ssid]
+	return session, ok
+}
+
+func (h *Host) store(ssid uint16, sessionType uint16, value io.Closer) *Session {
+	session := &Session{
+		Id:    ssid,
+		Type:  sessionType,
+		Value: value,
+		host:  h,
+		conns: map[*WsProtocol]uint8{},
+	}
+	if sessionType != SESSION_SFTP && MainConfig.Settings.Scrollback > 0 {
+		session.ring = NewRingBuffer(MainConfig.Settings.Scrollback)
+	}
+	h.lock.Lock()
+	h.sessions[ssid] = session
+	h.lock.Unlock()
+	return session
+}
+
+// Remove closes the session and forgets it, it is safe to call more than once.
+func (h *Host) Remove(ssid uint16) error {
+	h.lock.Lock()
+	session, ok := h.sessions[ssid]
+	if ok {
+		delete(h.sessions, ssid)
+	}
+	h.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return session.close()
+}
+
+func (h *Host) Close() {
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		return
+	}
+	h.closed = true
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+	sessions := h.sessions
+	h.sessions = map[uint16]*Session{}
+	h.lock.Unlock()
+	hostSet.Delete(h.Id)
+	for _, session := range sessions {
+		session.close()
+	}
+	if closer, ok := h.Instance.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// CloseHosts closes every host, used on shutdown.
+func CloseHosts() {
+	hostSet.Range(func(key, value any) bool {
+		value.(*Host).Close()
+		return true
+	})
+}
@@ -0,0 +1,61 @@
+package core
+
+import "testing"
+
+// testViewer returns a websocket whose sends fail at once.
+func testViewer() *WsProtocol {
+	conn := newWsProtocol(nil)
+	close(conn.done)
+	return conn
+}
+
+func TestSessionRoles(t *testing.T) {
+	type step struct {
+		attach    int   // viewer to attach, -1 for none
+		requested uint8 // role asked by the attached viewer
+		detach    int   // viewer to detach, -1 for none
+	}
+	tests := []struct {
+		name    string
+		viewers int
+		steps   []step
+		want    []int8 // role of each viewer afterwards, -1 when detached
+	}{
+		{"first writer", 1, []step{{0, ROLE_READ_WRITE, -1}}, []int8{0}},
+		{"second writer is read-only", 2, []step{{0, ROLE_READ_WRITE, -1}, {1, ROLE_READ_WRITE, -1}}, []int8{0, 1}},
+		{"read-only stays read-only", 1, []step{{0, ROLE_READ_ONLY, -1}}, []int8{1}},
+		{"stale owner leaves, reattached owner writes", 2, []step{
+			{0, ROLE_READ_WRITE, -1}, {1, ROLE_READ_WRITE, -1}, {-1, 0, 0},
+		}, []int8{-1, 0}},
+		{"oldest asking viewer is promoted", 4, []step{
+			{0, ROLE_READ_WRITE, -1}, {1, ROLE_READ_ONLY, -1}, {2, ROLE_READ_WRITE, -1}, {3, ROLE_READ_WRITE, -1}, {-1, 0, 0},
+		}, []int8{-1, 1, 0, 1}},
+		{"a left viewer is not promoted", 3, []step{
+			{0, ROLE_READ_WRITE, -1}, {1, ROLE_READ_WRITE, -1}, {2, ROLE_READ_WRITE, -1}, {-1, 0, 1}, {-1, 0, 0},
+		}, []int8{-1, -1, 0}},
+		{"read-only leaving promotes nobody", 3, []step{
+			{0, ROLE_READ_WRITE, -1}, {1, ROLE_READ_ONLY, -1}, {2, ROLE_READ_WRITE, -1}, {-1, 0, 1},
+		}, []int8{0, -1, 1}},
+	}
+	for _, test := range tests {
+		session := &Session{conns: map[*WsProtocol]uint8{}}
+		viewers := []*WsProtocol{}
+		for i := 0; i < test.viewers; i++ {
+			viewers = append(viewers, testViewer())
+		}
+		for _, step := range test.steps {
+			if step.attach >= 0 {
+				session.attach(viewers[step.attach], step.requested)
+			}
+			if step.detach >= 0 {
+				session.detach(viewers[step.detach])
+			}
+		}
+		for i, want := range test.want {
+			role, ok := session.conns[viewers[i]]
+			if got := int8(role); !ok && want != -1 || ok && got != want {
+				t.Errorf("%s: viewer %d has role %d (attached %v), want %d", test.name, i, role, ok, want)
+			}
+		}
+	}
+}
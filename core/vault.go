@@ -0,0 +1,272 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"reflect"
+	"strings"
+)
+
+// secret fields of adapter configs are marked with the tag `secret:"true"`,
+// they are written to the config file encrypted once the vault is enabled.
+
+const vaultPrefix = "vault:"
+const vaultCheck = "wterm"
+
+var ErrVaultLocked = errors.New("vault is locked")
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+type VaultInfo struct {
+	Salt  string `json:"salt"`
+	Check string `json:"check"` // vaultCheck sealed with the key, to verify the passphrase
+}
+
+type VaultState struct {
+	Enabled bool `json:"enabled"`
+	Locked  bool `json:"locked"`
+}
+
+// vaultKey is the key of the unlocked vault, guarded by ConfigLock.
+var vaultKey []byte
+
+func deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+// sealSecret encrypts text, every non-empty text is sealed even if it looks sealed already.
+func sealSecret(key []byte, text string) (string, error) {
+	if text == "" {
+		return text, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(text), nil)
+	return vaultPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openSecret decrypts a sealed text, plain text is returned as it is.
+func openSecret(key []byte, text string) (string, error) {
+	if !strings.HasPrefix(text, vaultPrefix) {
+		return text, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(text[len(vaultPrefix):])
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("invalid sealed secret")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", ErrWrongPassphrase
+	}
+	return string(plain), nil
+}
+
+// walkSecrets replaces every secret string field reachable from value with the result of fn.
+func walkSecrets(value reflect.Value, fn func(text string) (string, error)) error {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		return walkSecrets(value.Elem(), fn)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err := walkSecrets(value.Index(i), fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		typ := value.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if field.Type.Kind() == reflect.String && field.Tag.Get("secret") == "true" {
+				text, err := fn(value.Field(i).String())
+				if err != nil {
+					return err
+				}
+				value.Field(i).SetString(text)
+			} else if err := walkSecrets(value.Field(i), fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyConfig returns a deep copy of a full config through its stored form.
+func copyConfig(helper ConfigHelper, full interface{}) (interface{}, error) {
+	data := helper.StoreConfig(full)
+	if data == nil {
+		return nil, errors.New("cannot store config")
+	}
+	ret := helper.LoadConfig(data)
+	if ret == nil {
+		return nil, errors.New("cannot load config")
+	}
+	return ret, nil
+}
+
+// sealConfig returns the stored form of a full config with its secrets encrypted.
+func sealConfig(helper ConfigHelper, full interface{}) ([]byte, error) {
+	if vaultKey == nil {
+		data := helper.StoreConfig(full)
+		if data == nil {
+			return nil, errors.New("cannot store config")
+		}
+		return data, nil
+	}
+	sealed, err := copyConfig(helper, full)
+	if err != nil {
+		return nil, err
+	}
+	err = walkSecrets(reflect.ValueOf(sealed), func(text string) (string, error) {
+		return sealSecret(vaultKey, text)
+	})
+	if err != nil {
+		return nil, err
+	}
+	data := helper.StoreConfig(sealed)
+	if data == nil {
+		return nil, errors.New("cannot store config")
+	}
+	return data, nil
+}
+
+// VaultLocked reports whether secrets are still encrypted in memory, configs cannot be used until unlocked.
+func VaultLocked() bool {
+	ConfigLock.RLock()
+	defer ConfigLock.RUnlock()
+	return MainConfig.Vault != nil && vaultKey == nil
+}
+
+func VaultStatus() VaultState {
+	ConfigLock.RLock()
+	defer ConfigLock.RUnlock()
+	return VaultState{
+		Enabled: MainConfig.Vault != nil,
+		Locked:  MainConfig.Vault != nil && vaultKey == nil,
+	}
+}
+
+func vaultVerify(passphrase string) ([]byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(MainConfig.Vault.Salt)
+	if err != nil {
+		return nil, err
+	}
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	check, err := openSecret(key, MainConfig.Vault.Check)
+	if err != nil {
+		return nil, err
+	}
+	if check != vaultCheck {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// UnlockVault verifies passphrase and decrypts the secrets of every config in memory,
+// the configs are left sealed unless all of them decrypt.
+func UnlockVault(passphrase string) error {
+	ConfigLock.Lock()
+	defer ConfigLock.Unlock()
+	if MainConfig.Vault == nil || vaultKey != nil {
+		return nil
+	}
+	key, err := vaultVerify(passphrase)
+	if err != nil {
+		return err
+	}
+	opened := make([]interface{}, len(Configs))
+	for index, item := range Configs {
+		full, err := copyConfig(Helpers[item.Type], item.Full)
+		if err != nil {
+			return err
+		}
+		err = walkSecrets(reflect.ValueOf(full), func(text string) (string, error) {
+			return openSecret(key, text)
+		})
+		if err != nil {
+			return fmt.Errorf("config %d: %w", item.Id, err)
+		}
+		opened[index] = full
+	}
+	for index := range Configs {
+		Configs[index].Full = opened[index]
+	}
+	vaultKey = key
+	return nil
+}
+
+// SetVault changes the master passphrase, an empty newPassphrase disables the vault.
+// passphrase is the current one and is ignored when the vault is not enabled yet.
+func SetVault(passphrase string, newPassphrase string) error {
+	ConfigLock.Lock()
+	if MainConfig.Vault != nil {
+		if vaultKey == nil {
+			ConfigLock.Unlock()
+			return ErrVaultLocked
+		}
+		if _, err := vaultVerify(passphrase); err != nil {
+			ConfigLock.Unlock()
+			return err
+		}
+	}
+	if newPassphrase == "" {
+		MainConfig.Vault = nil
+		vaultKey = nil
+	} else {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			ConfigLock.Unlock()
+			return err
+		}
+		key, err := deriveKey(newPassphrase, salt)
+		if err != nil {
+			ConfigLock.Unlock()
+			return err
+		}
+		check, err := sealSecret(key, vaultCheck)
+		if err != nil {
+			ConfigLock.Unlock()
+			return err
+		}
+		MainConfig.Vault = &VaultInfo{
+			Salt:  base64.StdEncoding.EncodeToString(salt),
+			Check: check,
+		}
+		vaultKey = key
+	}
+	ConfigLock.Unlock()
+	return Persist()
+}
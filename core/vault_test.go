@@ -0,0 +1,268 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type vaultTestJump struct {
+	Host     string `json:"host"`
+	Password string `json:"password" secret:"true"`
+}
+
+type vaultTestConfig struct {
+	ConfigBase
+	Username string          `json:"username"`
+	Password string          `json:"password" secret:"true"`
+	Jumps    []vaultTestJump `json:"jumps"`
+}
+
+type vaultTestHelper struct{}
+
+func (vaultTestHelper) LoadConfig(data []byte) interface{} {
+	ret := vaultTestConfig{}
+	if json.Unmarshal(data, &ret) != nil {
+		return nil
+	}
+	return &ret
+}
+
+func (vaultTestHelper) StoreConfig(config interface{}) []byte {
+	ret, err := json.Marshal(config)
+	if err != nil {
+		return nil
+	}
+	return ret
+}
+
+func (vaultTestHelper) New(id uint64, config interface{}) ServeInstance { return nil }
+
+func (vaultTestHelper) Info(host string, id uint64, config interface{}) ConnectionInfo {
+	return ConnectionInfo{}
+}
+
+func testKey(fill byte) []byte {
+	return bytes.Repeat([]byte{fill}, 32)
+}
+
+func TestSealOpenSecret(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"empty stays empty", ""},
+		{"plain", "hunter2"},
+		{"unicode", "pässwörd ✓"},
+		{"looks sealed", vaultPrefix + "not really"},
+		{"long", strings.Repeat("x", 4096)},
+	}
+	for _, test := range tests {
+		sealed, err := sealSecret(testKey(1), test.text)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if test.text == "" {
+			if sealed != "" {
+				t.Errorf("%s: sealed to %q", test.name, sealed)
+			}
+			continue
+		}
+		if !strings.HasPrefix(sealed, vaultPrefix) || strings.Contains(sealed, test.text) {
+			t.Errorf("%s: not sealed: %q", test.name, sealed)
+		}
+		opened, err := openSecret(testKey(1), sealed)
+		if err != nil || opened != test.text {
+			t.Errorf("%s: opened %q, %v", test.name, opened, err)
+		}
+		if _, err := openSecret(testKey(2), sealed); !errors.Is(err, ErrWrongPassphrase) {
+			t.Errorf("%s: opened with the wrong key: %v", test.name, err)
+		}
+	}
+}
+
+func TestOpenSecretInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+		err  bool
+	}{
+		{"plain text is kept", "plain", "plain", false},
+		{"bad base64", vaultPrefix + "%%%", "", true},
+		{"too short", vaultPrefix + "AAAA", "", true},
+	}
+	for _, test := range tests {
+		got, err := openSecret(testKey(1), test.text)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("%s: got %q, %v", test.name, got, err)
+		}
+	}
+}
+
+func TestSealTwiceDiffers(t *testing.T) {
+	a, _ := sealSecret(testKey(1), "same")
+	b, _ := sealSecret(testKey(1), "same")
+	if a == b {
+		t.Error("sealing reuses the nonce")
+	}
+}
+
+// useVaultState swaps the global config state for a test.
+func useVaultState(t *testing.T, configs []Record, key []byte, vault *VaultInfo) {
+	oldConfigs, oldKey, oldVault, oldFilename := Configs, vaultKey, MainConfig.Vault, ConfigFilename
+	oldHelper, hadHelper := Helpers["vaulttest"]
+	Helpers["vaulttest"] = vaultTestHelper{}
+	Configs, vaultKey, MainConfig.Vault, ConfigFilename = configs, key, vault, ""
+	t.Cleanup(func() {
+		Configs, vaultKey, MainConfig.Vault, ConfigFilename = oldConfigs, oldKey, oldVault, oldFilename
+		if hadHelper {
+			Helpers["vaulttest"] = oldHelper
+		} else {
+			delete(Helpers, "vaulttest")
+		}
+	})
+}
+
+func TestSealConfig(t *testing.T) {
+	full := &vaultTestConfig{
+		ConfigBase: ConfigBase{Type: "vaulttest", Name: "a"},
+		Username:   "root",
+		Password:   "secret",
+		Jumps:      []vaultTestJump{{Host: "jump", Password: "hop"}},
+	}
+	useVaultState(t, nil, testKey(1), nil)
+	data, err := sealConfig(vaultTestHelper{}, full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Password != "secret" || full.Jumps[0].Password != "hop" {
+		t.Error("sealing changed the config in memory")
+	}
+	stored := vaultTestHelper{}.LoadConfig(data).(*vaultTestConfig)
+	if stored.Username != "root" || stored.Jumps[0].Host != "jump" {
+		t.Errorf("plain fields changed: %+v", stored)
+	}
+	for _, field := range []string{stored.Password, stored.Jumps[0].Password} {
+		if !strings.HasPrefix(field, vaultPrefix) {
+			t.Errorf("secret not sealed: %q", field)
+		}
+	}
+	err = walkSecrets(reflect.ValueOf(stored), func(text string) (string, error) {
+		return openSecret(testKey(1), text)
+	})
+	if err != nil || !reflect.DeepEqual(stored, full) {
+		t.Errorf("round trip: %+v, %v", stored, err)
+	}
+}
+
+func TestUnlockVault(t *testing.T) {
+	salt := bytes.Repeat([]byte{7}, 16)
+	key, err := deriveKey("right", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check, _ := sealSecret(key, vaultCheck)
+	vault := &VaultInfo{Salt: base64.StdEncoding.EncodeToString(salt), Check: check}
+	sealed := func(text string) string {
+		ret, _ := sealSecret(key, text)
+		return ret
+	}
+	otherSealed, _ := sealSecret(testKey(9), "other")
+	tests := []struct {
+		name       string
+		passphrase string
+		passwords  []string
+		err        bool
+		want       []string // passwords after the unlock
+	}{
+		{"all open", "right", []string{sealed("a"), sealed("b")}, false, []string{"a", "b"}},
+		{"plain is kept", "right", []string{"plain", sealed("b")}, false, []string{"plain", "b"}},
+		{"wrong passphrase", "wrong", []string{sealed("a")}, true, []string{sealed("a")}},
+		{"one fails, none change", "right", []string{sealed("a"), otherSealed}, true, []string{sealed("a"), otherSealed}},
+	}
+	for _, test := range tests {
+		configs := []Record{}
+		for i, password := range test.passwords {
+			configs = append(configs, Record{Id: uint64(i + 1), Type: "vaulttest", Full: &vaultTestConfig{
+				ConfigBase: ConfigBase{Type: "vaulttest"},
+				Password:   password,
+			}})
+		}
+		before := []interface{}{}
+		for _, item := range configs {
+			before = append(before, item.Full)
+		}
+		useVaultState(t, configs, nil, vault)
+		err := UnlockVault(test.passphrase)
+		if (err != nil) != test.err {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		for i, item := range Configs {
+			got := item.Full.(*vaultTestConfig).Password
+			if test.err {
+				// sealed texts differ each time, the records must be the untouched originals
+				if item.Full != before[i] || got != test.passwords[i] {
+					t.Errorf("%s: config %d changed to %q", test.name, i, got)
+				}
+			} else if got != test.want[i] {
+				t.Errorf("%s: config %d is %q, want %q", test.name, i, got, test.want[i])
+			}
+		}
+		if locked := vaultKey == nil; locked != test.err {
+			t.Errorf("%s: locked %v", test.name, locked)
+		}
+	}
+}
+
+func TestSaveConfigSeals(t *testing.T) {
+	useVaultState(t, []Record{{Id: 1, Type: "vaulttest", Full: &vaultTestConfig{
+		ConfigBase: ConfigBase{Type: "vaulttest"},
+		Password:   "vault:typed by the user",
+	}}}, testKey(1), nil)
+	filename := filepath.Join(t.TempDir(), "sessions")
+	if err := SaveConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("saved %d lines", len(lines))
+	}
+	stored := vaultTestHelper{}.LoadConfig([]byte(lines[1])).(*vaultTestConfig)
+	opened, err := openSecret(testKey(1), stored.Password)
+	if err != nil || opened != "vault:typed by the user" {
+		t.Errorf("stored %q, opened %q, %v", stored.Password, opened, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(filename)); len(entries) != 1 {
+		t.Errorf("temporary files left: %v", entries)
+	}
+	if info, err := os.Stat(filename); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("saved with mode %v", info.Mode())
+	}
+}
+
+func TestSaveConfigFailure(t *testing.T) {
+	useVaultState(t, []Record{{Id: 1, Type: "vaulttest", Full: make(chan int)}}, nil, nil)
+	filename := filepath.Join(t.TempDir(), "sessions")
+	if err := os.WriteFile(filename, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveConfig(filename); err == nil {
+		t.Fatal("a config that cannot be stored was dropped silently")
+	}
+	if data, _ := os.ReadFile(filename); string(data) != "old\n" {
+		t.Errorf("file overwritten with %q", data)
+	}
+}
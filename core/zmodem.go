@@ -0,0 +1,1051 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/azurity/xmodem-go"
+	"github.com/ncruces/zenity"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ZPAD   = '*'
+	ZDLE   = 0x18
+	ZDLEE  = ZDLE ^ 0x40
+	ZBIN   = 'A'
+	ZHEX   = 'B'
+	ZBIN32 = 'C'
+)
+
+// frame types
+const (
+	ZRQINIT = iota
+	ZRINIT
+	ZSINIT
+	ZACK
+	ZFILE
+	ZSKIP
+	ZNAK
+	ZABORT
+	ZFIN
+	ZRPOS
+	ZDATA
+	ZEOF
+	ZFERR
+	ZCRC
+	ZCHALLENGE
+	ZCOMPL
+	ZCAN
+	ZFREECNT
+	ZCOMMAND
+)
+
+// ends of a data subpacket
+const (
+	ZCRCE = 'h'
+	ZCRCG = 'i'
+	ZCRCQ = 'j'
+	ZCRCW = 'k'
+	ZRUB0 = 'l'
+	ZRUB1 = 'm'
+)
+
+// ZRINIT capabilities
+const (
+	CANFDX  = 0x01
+	CANOVIO = 0x02
+	CANBRK  = 0x04
+	CANFC32 = 0x20
+	ESCCTL  = 0x40
+	ESC8    = 0x80
+)
+
+const ZCBIN = 1
+
+const zmodemTimeout = 10 * time.Second
+const zmodemRetries = 10
+const zmodemBlock = 1024
+const zmodemMaxData = 8192
+const zmodemMaxGarbage = 1 << 20
+const zmodemTrailer = 100 * time.Millisecond
+
+// remote output after a failed transfer is dropped until it is quiet for this long
+const zmodemQuiet = 500 * time.Millisecond
+
+var ErrZModemAborted = errors.New("zmodem aborted by remote")
+var errZModemTimeout = errors.New("zmodem timeout")
+var errZModemCRC = errors.New("zmodem bad crc")
+
+// frameEnd marks the return value of readZDLE as the end of a subpacket
+const frameEnd = 0x100
+
+// headers printed by sz and rz when they start
+var zrqinitMagic = []byte("**\x18B00")
+var zrinitMagic = []byte("**\x18B01")
+
+type zheader struct {
+	kind byte
+	data [4]byte // ZP0..ZP3, ZF0 is data[3]
+}
+
+func posHeader(kind byte, pos int64) zheader {
+	h := zheader{kind: kind}
+	binary.LittleEndian.PutUint32(h.data[:], uint32(pos))
+	return h
+}
+
+func (h zheader) pos() int64 {
+	return int64(binary.LittleEndian.Uint32(h.data[:]))
+}
+
+func crc16(crc uint16, data []byte) uint16 {
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func appendCRC16(b []byte, crc uint16) []byte {
+	return append(b, byte(crc>>8), byte(crc))
+}
+
+func appendCRC32(b []byte, crc uint32) []byte {
+	return append(b, byte(crc), byte(crc>>8), byte(crc>>16), byte(crc>>24))
+}
+
+// zmodem runs one transfer over a shell session, the output of the session is fed into it.
+type zmodem struct {
+	writer   io.Writer
+	lock     sync.Mutex
+	input    []byte
+	changed  chan struct{}
+	err      error
+	canceled bool
+	cans     int
+	rxCRC32  bool
+	txCRC32  bool
+	escctl   bool
+	progress *modemProgress
+}
+
+func newZModem(writer io.Writer, input []byte) *zmodem {
+	return &zmodem{
+		writer:  writer,
+		input:   append([]byte{}, input...),
+		changed: make(chan struct{}),
+	}
+}
+
+func (z *zmodem) signal() {
+	close(z.changed)
+	z.changed = make(chan struct{})
+}
+
+func (z *zmodem) feed(data []byte) {
+	z.lock.Lock()
+	z.input = append(z.input, data...)
+	z.signal()
+	z.lock.Unlock()
+}
+
+// stop ends the input with err, the session is gone.
+func (z *zmodem) stop(err error) {
+	z.lock.Lock()
+	z.err = err
+	z.signal()
+	z.lock.Unlock()
+}
+
+func (z *zmodem) cancel() {
+	z.lock.Lock()
+	if !z.canceled {
+		z.canceled = true
+		z.signal()
+	}
+	z.lock.Unlock()
+}
+
+func (z *zmodem) isCanceled() bool {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	return z.canceled
+}
+
+// abort tells the remote side to give up the transfer.
+func (z *zmodem) abort() {
+	_, _ = z.writer.Write(modemCancel)
+}
+
+// drain drops the protocol data in the input until the remote side is quiet,
+// the text after the last ZDLE is kept for the terminal.
+func (z *zmodem) drain() {
+	deadline := time.After(5 * time.Second)
+	for {
+		z.lock.Lock()
+		if i := bytes.LastIndexByte(z.input, ZDLE); i >= 0 {
+			z.input = z.input[i+1:]
+		}
+		changed := z.changed
+		failed := z.err != nil
+		z.lock.Unlock()
+		if failed {
+			return
+		}
+		select {
+		case <-changed:
+		case <-time.After(zmodemQuiet):
+			return
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// leftover returns the input which was not used by the transfer.
+func (z *zmodem) leftover() []byte {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	return append([]byte{}, z.input...)
+}
+
+func (z *zmodem) pending() bool {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	return len(z.input) > 0
+}
+
+func (z *zmodem) next(timeout time.Duration, consume bool) (byte, error) {
+	var timer *time.Timer
+	for {
+		z.lock.Lock()
+		if z.canceled {
+			z.lock.Unlock()
+			return 0, ErrModemCanceled
+		}
+		if len(z.input) > 0 {
+			b := z.input[0]
+			if consume {
+				z.input = z.input[1:]
+			}
+			z.lock.Unlock()
+			if consume {
+				// five CANs in a row are only sent to abort
+				if b == ZDLE {
+					z.cans++
+					if z.cans >= 5 {
+						return 0, ErrZModemAborted
+					}
+				} else {
+					z.cans = 0
+				}
+			}
+			return b, nil
+		}
+		if z.err != nil {
+			z.lock.Unlock()
+			return 0, z.err
+		}
+		changed := z.changed
+		z.lock.Unlock()
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return 0, errZModemTimeout
+		}
+	}
+}
+
+func (z *zmodem) readByte(timeout time.Duration) (byte, error) {
+	return z.next(timeout, true)
+}
+
+// readZDLE reads one unescaped byte, flow control characters are skipped.
+func (z *zmodem) readZDLE() (int, error) {
+	for {
+		c, err := z.readByte(zmodemTimeout)
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case 0x11, 0x13, 0x91, 0x93:
+			continue
+		case ZDLE:
+		default:
+			return int(c), nil
+		}
+		for {
+			c, err = z.readByte(zmodemTimeout)
+			if err != nil {
+				return 0, err
+			}
+			if c != 0x11 && c != 0x13 && c != 0x91 && c != 0x93 {
+				break
+			}
+		}
+		switch c {
+		case ZCRCE, ZCRCG, ZCRCQ, ZCRCW:
+			return frameEnd | int(c), nil
+		case ZRUB0:
+			return 0x7f, nil
+		case ZRUB1:
+			return 0xff, nil
+		}
+		if c&0x60 == 0x40 {
+			return int(c ^ 0x40), nil
+		}
+		return 0, fmt.Errorf("zmodem bad escape: %#x", c)
+	}
+}
+
+func (z *zmodem) readHeader(timeout time.Duration) (zheader, error) {
+	garbage := 0
+	for {
+		c, err := z.readByte(timeout)
+		if err != nil {
+			return zheader{}, err
+		}
+		if c != ZPAD {
+			garbage++
+			if garbage > zmodemMaxGarbage {
+				return zheader{}, errors.New("zmodem header not found")
+			}
+			continue
+		}
+		for c == ZPAD {
+			if c, err = z.readByte(timeout); err != nil {
+				return zheader{}, err
+			}
+		}
+		if c != ZDLE {
+			continue
+		}
+		if c, err = z.readByte(timeout); err != nil {
+			return zheader{}, err
+		}
+		switch c {
+		case ZHEX:
+			return z.readHexHeader(timeout)
+		case ZBIN, ZBIN32:
+			return z.readBinHeader(c == ZBIN32)
+		}
+	}
+}
+
+func (z *zmodem) readHexHeader(timeout time.Duration) (zheader, error) {
+	digits := make([]byte, 14)
+	for i := range digits {
+		c, err := z.readByte(timeout)
+		if err != nil {
+			return zheader{}, err
+		}
+		digits[i] = c
+	}
+	raw, err := hex.DecodeString(string(digits))
+	if err != nil {
+		return zheader{}, errZModemCRC
+	}
+	if crc16(0, raw[:5]) != binary.BigEndian.Uint16(raw[5:]) {
+		return zheader{}, errZModemCRC
+	}
+	h := zheader{kind: raw[0]}
+	copy(h.data[:], raw[1:5])
+	z.rxCRC32 = false
+	// a hex header ends with CR LF, then XON unless it is ZACK or ZFIN
+	ends := []byte{'\r', 0x8a, 0x11}
+	if h.kind == ZACK || h.kind == ZFIN {
+		ends = ends[:2]
+	}
+	for _, end := range ends {
+		if c, err := z.next(zmodemTrailer, false); err == nil && c|0x80 == end|0x80 {
+			_, _ = z.readByte(0)
+		}
+	}
+	return h, nil
+}
+
+func (z *zmodem) readBinHeader(use32 bool) (zheader, error) {
+	size := 7
+	if use32 {
+		size = 9
+	}
+	raw := make([]byte, size)
+	for i := range raw {
+		c, err := z.readZDLE()
+		if err != nil {
+			return zheader{}, err
+		}
+		if c&frameEnd != 0 {
+			return zheader{}, errZModemCRC
+		}
+		raw[i] = byte(c)
+	}
+	if use32 {
+		if crc32.ChecksumIEEE(raw[:5]) != binary.LittleEndian.Uint32(raw[5:]) {
+			return zheader{}, errZModemCRC
+		}
+	} else if crc16(0, raw[:5]) != binary.BigEndian.Uint16(raw[5:]) {
+		return zheader{}, errZModemCRC
+	}
+	h := zheader{kind: raw[0]}
+	copy(h.data[:], raw[1:5])
+	z.rxCRC32 = use32
+	return h, nil
+}
+
+// readData reads a data subpacket, it returns the data and how the subpacket ended.
+func (z *zmodem) readData() ([]byte, byte, error) {
+	data := []byte{}
+	for {
+		c, err := z.readZDLE()
+		if err != nil {
+			return nil, 0, err
+		}
+		if c&frameEnd == 0 {
+			if len(data) >= zmodemMaxData {
+				return nil, 0, errors.New("zmodem subpacket too long")
+			}
+			data = append(data, byte(c))
+			continue
+		}
+		end := byte(c)
+		size := 2
+		if z.rxCRC32 {
+			size = 4
+		}
+		sum := make([]byte, size)
+		for i := range sum {
+			c, err := z.readZDLE()
+			if err != nil {
+				return nil, 0, err
+			}
+			if c&frameEnd != 0 {
+				return nil, 0, errZModemCRC
+			}
+			sum[i] = byte(c)
+		}
+		if z.rxCRC32 {
+			crc := crc32.Update(crc32.ChecksumIEEE(data), crc32.IEEETable, []byte{end})
+			if crc != binary.LittleEndian.Uint32(sum) {
+				return nil, 0, errZModemCRC
+			}
+		} else if crc16(crc16(0, data), []byte{end}) != binary.BigEndian.Uint16(sum) {
+			return nil, 0, errZModemCRC
+		}
+		return data, end, nil
+	}
+}
+
+func (z *zmodem) escape(dst []byte, data []byte) []byte {
+	for _, b := range data {
+		switch {
+		case b == ZDLE, b == 0x10, b == 0x90, b == 0x11, b == 0x91, b == 0x13, b == 0x93, b == '\r', b == 0x8d:
+		case z.escctl && b&0x60 == 0:
+		default:
+			dst = append(dst, b)
+			continue
+		}
+		dst = append(dst, ZDLE, b^0x40)
+	}
+	return dst
+}
+
+func (z *zmodem) write(data []byte) error {
+	_, err := z.writer.Write(data)
+	return err
+}
+
+func (z *zmodem) sendHexHeader(h zheader) error {
+	raw := append([]byte{h.kind}, h.data[:]...)
+	raw = appendCRC16(raw, crc16(0, raw))
+	buf := append([]byte{ZPAD, ZPAD, ZDLE, ZHEX}, hex.EncodeToString(raw)...)
+	buf = append(buf, '\r', 0x8a)
+	if h.kind != ZFIN && h.kind != ZACK {
+		buf = append(buf, 0x11)
+	}
+	return z.write(buf)
+}
+
+func (z *zmodem) sendBinHeader(h zheader) error {
+	raw := append([]byte{h.kind}, h.data[:]...)
+	buf := []byte{ZPAD, ZDLE, ZBIN}
+	if z.txCRC32 {
+		buf[2] = ZBIN32
+		raw = appendCRC32(raw, crc32.ChecksumIEEE(raw))
+	} else {
+		raw = appendCRC16(raw, crc16(0, raw))
+	}
+	return z.write(z.escape(buf, raw))
+}
+
+func (z *zmodem) sendData(data []byte, end byte) error {
+	buf := z.escape(make([]byte, 0, len(data)+len(data)/8+16), data)
+	buf = append(buf, ZDLE, end)
+	var sum []byte
+	if z.txCRC32 {
+		crc := crc32.Update(crc32.ChecksumIEEE(data), crc32.IEEETable, []byte{end})
+		sum = appendCRC32(nil, crc)
+	} else {
+		sum = appendCRC16(nil, crc16(crc16(0, data), []byte{end}))
+	}
+	return z.write(z.escape(buf, sum))
+}
+
+// parseFileInfo reads the "name\0size mtime mode ..." payload of ZFILE.
+func parseFileInfo(data []byte) xmodem.File {
+	parts := bytes.SplitN(data, []byte{0}, 2)
+	file := xmodem.File{Path: string(parts[0]), Mode: 0644}
+	if len(parts) < 2 {
+		return file
+	}
+	fields := strings.Fields(string(bytes.TrimRight(parts[1], "\x00")))
+	if len(fields) > 0 {
+		file.Length, _ = strconv.ParseInt(fields[0], 10, 64)
+	}
+	if len(fields) > 1 {
+		if mtime, err := strconv.ParseInt(fields[1], 8, 64); err == nil && mtime > 0 {
+			file.ModTime = time.Unix(mtime, 0)
+		}
+	}
+	if len(fields) > 2 {
+		if mode, err := strconv.ParseUint(fields[2], 8, 32); err == nil && mode&0777 != 0 {
+			file.Mode = fs.FileMode(mode & 0777)
+		}
+	}
+	return file
+}
+
+func fileInfo(file xmodem.File) []byte {
+	mode := uint32(file.Mode.Perm())
+	if mode == 0 {
+		mode = 0644
+	}
+	mtime := int64(0)
+	if !file.ModTime.IsZero() {
+		mtime = file.ModTime.Unix()
+	}
+	return []byte(fmt.Sprintf("%s\x00%d %o %o\x00", file.Path, file.Length, mtime, 0100000|mode))
+}
+
+// receive answers a sz on the remote side, open returns where to write a file, or nil to skip it.
+func (z *zmodem) receive(open func(file xmodem.File) (io.WriteCloser, error)) error {
+	sendInit := func() error {
+		return z.sendHexHeader(zheader{kind: ZRINIT, data: [4]byte{0, 0, 0, CANFDX | CANOVIO | CANFC32}})
+	}
+	if err := sendInit(); err != nil {
+		return err
+	}
+	retries := 0
+	index := 0
+	for {
+		h, err := z.readHeader(zmodemTimeout)
+		if err == errZModemTimeout || err == errZModemCRC {
+			retries++
+			if retries > zmodemRetries {
+				return err
+			}
+			if err = sendInit(); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		retries = 0
+		switch h.kind {
+		case ZRQINIT:
+			err = sendInit()
+		case ZSINIT:
+			if _, _, err = z.readData(); err != nil {
+				err = z.sendHexHeader(zheader{kind: ZNAK})
+			} else {
+				err = z.sendHexHeader(posHeader(ZACK, 1))
+			}
+		case ZFILE:
+			var data []byte
+			if data, _, err = z.readData(); err == errZModemCRC {
+				err = z.sendHexHeader(zheader{kind: ZNAK})
+				break
+			} else if err != nil {
+				return err
+			}
+			file := parseFileInfo(data)
+			z.progress.start(index, file.Path, file.Length)
+			index++
+			writer, openErr := open(file)
+			if openErr != nil || writer == nil {
+				err = z.sendHexHeader(zheader{kind: ZSKIP})
+				break
+			}
+			err = z.receiveFile(writer)
+			writer.Close()
+			if err == nil {
+				err = sendInit()
+			}
+		case ZFIN:
+			if err = z.sendHexHeader(zheader{kind: ZFIN}); err != nil {
+				return err
+			}
+			// the sender ends with "OO"
+			for i := 0; i < 2; i++ {
+				if c, err := z.next(time.Second, false); err != nil || c != 'O' {
+					break
+				}
+				_, _ = z.readByte(0)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (z *zmodem) receiveFile(writer io.Writer) error {
+	offset := int64(0)
+	retries := 0
+	retry := func(err error) error {
+		retries++
+		if retries > zmodemRetries {
+			return err
+		}
+		z.progress.retry()
+		return z.sendHexHeader(posHeader(ZRPOS, offset))
+	}
+	if err := z.sendHexHeader(posHeader(ZRPOS, offset)); err != nil {
+		return err
+	}
+	for {
+		h, err := z.readHeader(zmodemTimeout)
+		if err == errZModemTimeout || err == errZModemCRC {
+			if err = retry(err); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		switch h.kind {
+		case ZDATA:
+			if h.pos() != offset {
+				err = retry(errors.New("zmodem bad position"))
+				break
+			}
+			err = z.receiveData(writer, &offset)
+			if err == errZModemTimeout || err == errZModemCRC {
+				err = retry(err)
+			} else if err == nil {
+				retries = 0
+			}
+		case ZEOF:
+			if h.pos() == offset {
+				return nil
+			}
+		case ZFILE:
+			// the ZRPOS was lost
+			if _, _, err = z.readData(); err == nil {
+				err = z.sendHexHeader(posHeader(ZRPOS, offset))
+			}
+		case ZFIN, ZABORT, ZCAN:
+			return ErrZModemAborted
+		}
+		if err != nil {
+			if err != errZModemTimeout && err != errZModemCRC {
+				z.abort()
+			}
+			return err
+		}
+	}
+}
+
+// receiveData writes the subpackets of a ZDATA frame.
+func (z *zmodem) receiveData(writer io.Writer, offset *int64) error {
+	for {
+		data, end, err := z.readData()
+		if err != nil {
+			return err
+		}
+		if _, err = writer.Write(data); err != nil {
+			return err
+		}
+		*offset += int64(len(data))
+		z.progress.update(*offset)
+		switch end {
+		case ZCRCW:
+			return z.sendHexHeader(posHeader(ZACK, *offset))
+		case ZCRCQ:
+			if err = z.sendHexHeader(posHeader(ZACK, *offset)); err != nil {
+				return err
+			}
+		case ZCRCE:
+			return nil
+		}
+	}
+}
+
+// send answers a rz on the remote side.
+func (z *zmodem) send(files []xmodem.File) error {
+	streaming, err := z.waitInit()
+	if err != nil {
+		return err
+	}
+	for i, file := range files {
+		z.progress.start(i, file.Path, file.Length)
+		if err = z.sendFile(file, streaming); err != nil {
+			return err
+		}
+	}
+	for retries := 0; ; retries++ {
+		if err = z.sendHexHeader(zheader{kind: ZFIN}); err != nil {
+			return err
+		}
+		h, err := z.readHeader(zmodemTimeout)
+		if err == errZModemTimeout || err == errZModemCRC {
+			if retries < zmodemRetries {
+				continue
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+		if h.kind == ZFIN {
+			return z.write([]byte("OO"))
+		}
+	}
+}
+
+// waitInit reads the ZRINIT of the receiver, it returns whether data can be streamed.
+func (z *zmodem) waitInit() (bool, error) {
+	for retries := 0; ; {
+		h, err := z.readHeader(zmodemTimeout)
+		if err == errZModemTimeout || err == errZModemCRC {
+			retries++
+			if retries > zmodemRetries {
+				return false, err
+			}
+			if err = z.sendHexHeader(zheader{kind: ZRQINIT}); err != nil {
+				return false, err
+			}
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		switch h.kind {
+		case ZRINIT:
+			flags := h.data[3]
+			z.txCRC32 = flags&CANFC32 != 0
+			z.escctl = flags&ESCCTL != 0
+			return flags&CANOVIO != 0 && binary.LittleEndian.Uint16(h.data[:2]) == 0, nil
+		case ZCHALLENGE:
+			err = z.sendHexHeader(zheader{kind: ZACK, data: h.data})
+		case ZFIN, ZABORT, ZCAN:
+			return false, ErrZModemAborted
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+func (z *zmodem) sendFile(file xmodem.File, streaming bool) error {
+	for retries := 0; ; {
+		if err := z.sendBinHeader(zheader{kind: ZFILE, data: [4]byte{0, 0, 0, ZCBIN}}); err != nil {
+			return err
+		}
+		if err := z.sendData(fileInfo(file), ZCRCW); err != nil {
+			return err
+		}
+		h, err := z.readHeader(zmodemTimeout)
+		if err == errZModemTimeout || err == errZModemCRC {
+			retries++
+			if retries > zmodemRetries {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		switch h.kind {
+		case ZRPOS:
+			return z.sendBody(file.Body, h.pos(), streaming)
+		case ZSKIP:
+			return nil
+		case ZFIN, ZABORT, ZCAN:
+			return ErrZModemAborted
+		}
+	}
+}
+
+// seekBody moves a file body from offset to pos, bodies which can not seek are only read forward.
+func seekBody(body io.Reader, offset int64, pos int64) error {
+	if seeker, ok := body.(io.Seeker); ok {
+		_, err := seeker.Seek(pos, io.SeekStart)
+		return err
+	}
+	if pos < offset {
+		return errors.New("zmodem can not rewind the file")
+	}
+	_, err := io.CopyN(io.Discard, body, pos-offset)
+	return err
+}
+
+func (z *zmodem) sendBody(body io.Reader, pos int64, streaming bool) error {
+	offset := int64(0)
+	buf := make([]byte, zmodemBlock)
+	retries := 0
+	for {
+		if err := seekBody(body, offset, pos); err != nil {
+			z.abort()
+			return err
+		}
+		offset = pos
+		if err := z.sendBinHeader(posHeader(ZDATA, offset)); err != nil {
+			return err
+		}
+		var reply *zheader
+		for reply == nil {
+			if z.isCanceled() {
+				return ErrModemCanceled
+			}
+			n, err := io.ReadFull(body, buf)
+			eof := err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !eof {
+				z.abort()
+				return err
+			}
+			end := byte(ZCRCG)
+			if eof {
+				end = ZCRCE
+			} else if !streaming {
+				end = ZCRCW
+			}
+			if err = z.sendData(buf[:n], end); err != nil {
+				return err
+			}
+			offset += int64(n)
+			z.progress.update(offset)
+			if end == ZCRCW || z.pending() {
+				timeout := zmodemTimeout
+				if end != ZCRCW {
+					timeout = time.Second
+				}
+				h, err := z.readHeader(timeout)
+				if err != nil && err != errZModemTimeout && err != errZModemCRC {
+					return err
+				}
+				if err == nil && (h.kind != ZACK || end == ZCRCW) {
+					// ZCRCW ends the frame, the next data needs a new header
+					reply = &h
+				} else if err != nil && end == ZCRCW {
+					// the ack is lost, send again from the acked position
+					h = posHeader(ZRPOS, offset-int64(n))
+					reply = &h
+				}
+			}
+			if eof && reply == nil {
+				if err = z.sendBinHeader(posHeader(ZEOF, offset)); err != nil {
+					return err
+				}
+				h, err := z.readHeader(zmodemTimeout)
+				for err == nil && h.kind == ZACK {
+					h, err = z.readHeader(zmodemTimeout)
+				}
+				if err == errZModemTimeout || err == errZModemCRC {
+					h = posHeader(ZRPOS, offset)
+				} else if err != nil {
+					return err
+				}
+				reply = &h
+			}
+		}
+		switch reply.kind {
+		case ZRINIT, ZSKIP:
+			return nil
+		case ZRPOS:
+			retries++
+			if retries > zmodemRetries {
+				z.abort()
+				return errors.New("zmodem too many retries")
+			}
+			z.progress.retry()
+			pos = reply.pos()
+		case ZFIN, ZABORT, ZCAN:
+			return ErrZModemAborted
+		default:
+			retries = 0
+			pos = offset
+		}
+	}
+}
+
+// zmodemTap sits between a shell session and its modem, the session is handed over to a
+// zmodem transfer once the output shows that sz or rz was started.
+type zmodemTap struct {
+	ss      ShellSession
+	start   func(z *zmodem, direct string) error
+	lock    sync.Mutex
+	running *zmodem
+	paused  bool // while another modem transfer runs
+	tail    []byte
+	reader  *io.PipeReader
+	writer  *io.PipeWriter
+
+	// held over route and its write to writer, so the output stays in order
+	// while a blocked write does not hold lock
+	routeLock sync.Mutex
+}
+
+func newZModemTap(ss ShellSession, start func(z *zmodem, direct string) error) *zmodemTap {
+	t := &zmodemTap{
+		ss:    ss,
+		start: start,
+	}
+	t.reader, t.writer = io.Pipe()
+	go t.pump()
+	return t
+}
+
+func detectZModem(data []byte) (int, string) {
+	if idx := bytes.Index(data, zrqinitMagic); idx >= 0 {
+		return idx, "recv"
+	}
+	if idx := bytes.Index(data, zrinitMagic); idx >= 0 {
+		return idx, "send"
+	}
+	return -1, ""
+}
+
+// route passes the output to the running transfer and returns what goes to the terminal,
+// the lock must be held.
+func (t *zmodemTap) route(data []byte) []byte {
+	if t.running != nil {
+		t.running.feed(data)
+		return nil
+	}
+	if t.paused {
+		return data
+	}
+	scan := append(t.tail, data...)
+	idx, direct := detectZModem(scan)
+	if idx < 0 {
+		keep := len(zrqinitMagic) - 1
+		if len(scan) < keep {
+			keep = len(scan)
+		}
+		t.tail = append([]byte{}, scan[len(scan)-keep:]...)
+		return data
+	}
+	var out []byte
+	if skip := idx - len(t.tail); skip > 0 {
+		out = data[:skip]
+	}
+	t.tail = nil
+	z := newZModem(t.ss, scan[idx:])
+	t.running = z
+	go t.run(z, direct)
+	return out
+}
+
+// routeOutput routes data and writes the terminal part of it outside the lock.
+func (t *zmodemTap) routeOutput(data []byte) {
+	t.routeLock.Lock()
+	defer t.routeLock.Unlock()
+	t.lock.Lock()
+	out := t.route(data)
+	t.lock.Unlock()
+	if len(out) > 0 {
+		_, _ = t.writer.Write(out)
+	}
+}
+
+func (t *zmodemTap) pump() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := t.ss.Read(buf)
+		if n > 0 {
+			t.routeOutput(buf[:n])
+		}
+		if err != nil {
+			t.routeLock.Lock()
+			t.lock.Lock()
+			if t.running != nil {
+				t.running.stop(err)
+			}
+			t.lock.Unlock()
+			if err == io.EOF {
+				t.writer.Close()
+			} else {
+				t.writer.CloseWithError(err)
+			}
+			t.routeLock.Unlock()
+			return
+		}
+	}
+}
+
+func (t *zmodemTap) run(z *zmodem, direct string) {
+	err := t.start(z, direct)
+	if err != nil {
+		if err != ErrModemCanceled && err != ErrZModemAborted && err != zenity.ErrCanceled {
+			log.Println(err)
+		}
+		if err != ErrZModemAborted {
+			z.abort()
+		}
+		z.drain()
+	}
+	t.routeLock.Lock()
+	defer t.routeLock.Unlock()
+	t.lock.Lock()
+	t.running = nil
+	out := t.route(z.leftover())
+	t.lock.Unlock()
+	if len(out) > 0 {
+		_, _ = t.writer.Write(out)
+	}
+}
+
+func (t *zmodemTap) pause(paused bool) {
+	t.lock.Lock()
+	t.paused = paused
+	t.tail = nil
+	t.lock.Unlock()
+}
+
+func (t *zmodemTap) Read(p []byte) (int, error) {
+	return t.reader.Read(p)
+}
+
+// Write drops the input during a transfer, Ctrl-C cancels it.
+func (t *zmodemTap) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	z := t.running
+	t.lock.Unlock()
+	if z == nil {
+		return t.ss.Write(p)
+	}
+	if bytes.IndexByte(p, 0x03) >= 0 {
+		z.cancel()
+	}
+	return len(p), nil
+}
@@ -0,0 +1,383 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"github.com/azurity/xmodem-go"
+	"io"
+	"testing"
+	"time"
+)
+
+// testZModem returns a zmodem reading input, the input ends after it.
+func testZModem(input []byte) (*zmodem, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	z := newZModem(out, input)
+	z.stop(io.EOF)
+	return z, out
+}
+
+func TestCRC16(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint16
+	}{
+		{"", 0},
+		{"123456789", 0x31c3}, // CRC-16/XMODEM check value
+		{"\x00\x00\x00\x00\x00", 0},
+		{"A", 0x58e5},
+	}
+	for _, test := range tests {
+		if got := crc16(0, []byte(test.data)); got != test.want {
+			t.Errorf("crc16(%q) = %#04x, want %#04x", test.data, got, test.want)
+		}
+	}
+	// the crc of a subpacket covers the data and then the end byte
+	if crc16(crc16(0, []byte("1234")), []byte("56789")) != 0x31c3 {
+		t.Error("crc16 does not continue")
+	}
+}
+
+func TestSendHexHeader(t *testing.T) {
+	tests := []struct {
+		header zheader
+		want   string
+	}{
+		{zheader{kind: ZRQINIT}, "**\x18B00000000000000\r\x8a\x11"},
+		{zheader{kind: ZRINIT, data: [4]byte{0, 0, 0, CANFDX | CANOVIO}}, "**\x18B01000000039a32\r\x8a\x11"},
+		// ZFIN and ZACK end without XON
+		{zheader{kind: ZFIN}, "**\x18B0800000000022d\r\x8a"},
+	}
+	for _, test := range tests {
+		z, out := testZModem(nil)
+		if err := z.sendHexHeader(test.header); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.want {
+			t.Errorf("header %d: sent %q, want %q", test.header.kind, out.String(), test.want)
+		}
+	}
+}
+
+func TestDetectZModem(t *testing.T) {
+	tests := []struct {
+		data   string
+		index  int
+		direct string
+	}{
+		{"plain output", -1, ""},
+		{"rz\r**\x18B00000000000000\r\x8a\x11", 3, "recv"},
+		{"**\x18B0100000023be50\r\x8a\x11", 0, "send"},
+		{"**\x18B09", -1, ""},
+	}
+	for _, test := range tests {
+		index, direct := detectZModem([]byte(test.data))
+		if index != test.index || direct != test.direct {
+			t.Errorf("%q: got %d %q, want %d %q", test.data, index, direct, test.index, test.direct)
+		}
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		header zheader
+		send   func(z *zmodem, h zheader) error
+		crc32  bool
+	}{
+		{"hex", posHeader(ZRPOS, 0x12345678), (*zmodem).sendHexHeader, false},
+		{"binary crc16", posHeader(ZDATA, 1024), (*zmodem).sendBinHeader, false},
+		{"binary crc32", posHeader(ZEOF, 0x7fffffff), (*zmodem).sendBinHeader, true},
+		// every byte of the position needs escaping
+		{"binary escaped", zheader{kind: ZDATA, data: [4]byte{ZDLE, 0x11, 0x93, '\r'}}, (*zmodem).sendBinHeader, true},
+	}
+	for _, test := range tests {
+		sender, out := testZModem(nil)
+		sender.txCRC32 = test.crc32
+		if err := test.send(sender, test.header); err != nil {
+			t.Fatal(err)
+		}
+		// garbage before the header is skipped
+		input := append([]byte("noise"), out.Bytes()...)
+		receiver, _ := testZModem(input)
+		got, err := receiver.readHeader(time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got != test.header {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.header)
+		}
+		if receiver.rxCRC32 != test.crc32 {
+			t.Errorf("%s: crc32 %v", test.name, receiver.rxCRC32)
+		}
+		if receiver.pending() {
+			t.Errorf("%s: trailer left %q", test.name, receiver.leftover())
+		}
+	}
+}
+
+func TestHeaderBadCRC(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"hex crc", "**\x18B01000000039a33\r\x8a"},
+		{"hex digits", "**\x18B01000000zz9a32\r\x8a"},
+		{"binary crc", "*\x18A\x0a\x00\x00\x00\x00\x00\x00"},
+	}
+	for _, test := range tests {
+		z, _ := testZModem([]byte(test.input))
+		if _, err := z.readHeader(time.Second); !errors.Is(err, errZModemCRC) {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
+
+func TestDataRoundTrip(t *testing.T) {
+	special := []byte{ZDLE, 0x10, 0x90, 0x11, 0x91, 0x13, 0x93, '\r', 0x8d, 0x7f, 0xff, 0x00, 0x01}
+	tests := []struct {
+		name   string
+		data   []byte
+		end    byte
+		crc32  bool
+		escctl bool
+	}{
+		{"empty", nil, ZCRCW, false, false},
+		{"text crc16", []byte("hello"), ZCRCG, false, false},
+		{"text crc32", []byte("hello"), ZCRCE, true, false},
+		{"special bytes", special, ZCRCQ, true, false},
+		{"escape controls", special, ZCRCW, false, true},
+		{"full block", bytes.Repeat([]byte{ZDLE, 'a'}, zmodemBlock/2), ZCRCG, true, false},
+	}
+	for _, test := range tests {
+		sender, out := testZModem(nil)
+		sender.txCRC32 = test.crc32
+		sender.escctl = test.escctl
+		if err := sender.sendData(test.data, test.end); err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range out.Bytes()[:out.Len()-1] {
+			// only the escaped form of these may be on the wire
+			if b == 0x11 || b == 0x13 || b == '\r' || test.escctl && b < 0x20 && b != ZDLE {
+				t.Errorf("%s: %#x sent unescaped", test.name, b)
+			}
+		}
+		receiver, _ := testZModem(out.Bytes())
+		receiver.rxCRC32 = test.crc32
+		data, end, err := receiver.readData()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !bytes.Equal(data, test.data) && len(data)+len(test.data) > 0 || end != test.end {
+			t.Errorf("%s: got %q end %c", test.name, data, end)
+		}
+		// a flipped bit is caught by the crc
+		corrupt := append([]byte{}, out.Bytes()...)
+		corrupt[0] ^= 0x01
+		receiver, _ = testZModem(corrupt)
+		receiver.rxCRC32 = test.crc32
+		if _, _, err := receiver.readData(); err == nil {
+			t.Errorf("%s: corruption not detected", test.name)
+		}
+	}
+}
+
+func TestReadZDLE(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  []int
+	}{
+		{"plain", []byte("ab"), []int{'a', 'b'}},
+		{"flow control is skipped", []byte{0x11, 'a', 0x93, 'b'}, []int{'a', 'b'}},
+		{"escaped ZDLE", []byte{ZDLE, ZDLEE}, []int{ZDLE}},
+		{"rubout", []byte{ZDLE, ZRUB0, ZDLE, ZRUB1}, []int{0x7f, 0xff}},
+		{"frame end", []byte{ZDLE, ZCRCW}, []int{frameEnd | ZCRCW}},
+		{"flow control after ZDLE", []byte{ZDLE, 0x11, 'M'}, []int{'\r'}},
+	}
+	for _, test := range tests {
+		z, _ := testZModem(test.input)
+		for _, want := range test.want {
+			got, err := z.readZDLE()
+			if err != nil || got != want {
+				t.Errorf("%s: got %#x %v, want %#x", test.name, got, err, want)
+			}
+		}
+	}
+	z, _ := testZModem([]byte{ZDLE, '!'})
+	if _, err := z.readZDLE(); err == nil {
+		t.Error("bad escape accepted")
+	}
+}
+
+func TestAbortByCANs(t *testing.T) {
+	z, _ := testZModem(bytes.Repeat([]byte{ZDLE}, 5))
+	if _, err := z.readHeader(time.Second); !errors.Is(err, ErrZModemAborted) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestFileInfo(t *testing.T) {
+	modTime := time.Unix(1700000000, 0)
+	tests := []struct {
+		name string
+		file xmodem.File
+	}{
+		{"plain", xmodem.File{Path: "a.txt", Length: 1234, ModTime: modTime, Mode: 0600}},
+		{"no mode or time", xmodem.File{Path: "b.bin", Length: 0, Mode: 0644}},
+		{"spaces in name", xmodem.File{Path: "my file", Length: 1, ModTime: modTime, Mode: 0755}},
+	}
+	for _, test := range tests {
+		got := parseFileInfo(fileInfo(test.file))
+		if got.Path != test.file.Path || got.Length != test.file.Length || got.Mode != test.file.Mode || !got.ModTime.Equal(test.file.ModTime) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.file)
+		}
+	}
+	got := parseFileInfo([]byte("only-name\x00"))
+	if got.Path != "only-name" || got.Length != 0 || got.Mode != 0644 {
+		t.Errorf("name only: %+v", got)
+	}
+}
+
+// pipeShell is a shell session whose output is written to out and whose input is read from in.
+type pipeShell struct {
+	io.Reader
+	io.Writer
+}
+
+func (pipeShell) Close() error          { return nil }
+func (pipeShell) Resize(rows, cols int) {}
+
+func TestTapInputWhileOutputBlocked(t *testing.T) {
+	outReader, outWriter := io.Pipe()
+	input := &bytes.Buffer{}
+	tap := newZModemTap(pipeShell{Reader: outReader, Writer: input}, nil)
+	// nobody reads the terminal, so the tap blocks writing this output
+	go outWriter.Write([]byte("output"))
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		tap.Write([]byte("ls\r"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("input blocked by the unread output")
+	}
+	if input.String() != "ls\r" {
+		t.Errorf("input %q, want %q", input.String(), "ls\r")
+	}
+	outWriter.Close()
+	buf := make([]byte, 16)
+	n, _ := tap.Read(buf)
+	if string(buf[:n]) != "output" {
+		t.Errorf("output %q, want %q", buf[:n], "output")
+	}
+}
+
+func TestTakeRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		armed  string // direct of a request armed before the transfer started
+		action string // what happens once the transfer was detected
+		err    bool
+	}{
+		{"armed before", "recv", "", false},
+		{"armed after", "", "arm", false},
+		{"other direct armed", "send", "arm", false},
+		{"canceled", "", "cancel", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &ModemShellSession{}
+			events := make(chan ModemEventDesc, 1)
+			m.setNotify(func(event ModemEventDesc) {
+				events <- event
+			})
+			if test.armed != "" {
+				m.arm(&modemRequest{desc: &ModemDesc{Direct: test.armed, Type: "z"}})
+			}
+			z := newZModem(&bytes.Buffer{}, nil)
+			type result struct {
+				req *modemRequest
+				err error
+			}
+			done := make(chan result, 1)
+			go func() {
+				req, err := m.takeRequest(z, "recv")
+				done <- result{req, err}
+			}()
+			if test.action != "" {
+				select {
+				case event := <-events:
+					if event.Op != "detected" || event.Direct != "recv" {
+						t.Fatalf("event %+v, want a detected recv", event)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("the transfer was not reported")
+				}
+			}
+			switch test.action {
+			case "arm":
+				m.arm(&modemRequest{desc: &ModemDesc{Direct: "recv", Type: "z"}})
+			case "cancel":
+				z.cancel()
+			}
+			select {
+			case ret := <-done:
+				if (ret.err != nil) != test.err {
+					t.Errorf("error %v, want error %v", ret.err, test.err)
+				}
+				if ret.err == nil && (ret.req == nil || ret.req.desc.Direct != "recv") {
+					t.Errorf("request %+v, want the recv request", ret.req)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("still waiting for a request")
+			}
+		})
+	}
+}
+
+func TestModemRetries(t *testing.T) {
+	block := func(num byte) []byte {
+		return append([]byte{xmodemSOH, num, ^num}, make([]byte, 130)...)
+	}
+	ack := []byte{0x06}
+	nak := []byte{xmodemNAK}
+	eot := []byte{xmodemEOT}
+	// each step is data written to the remote side, or read from it when read is set
+	type step struct {
+		read bool
+		data []byte
+	}
+	tests := []struct {
+		name    string
+		steps   []step
+		retries int
+	}{
+		{"send clean", []step{{true, nak}, {false, block(1)}, {true, ack}, {false, block(2)}, {true, ack}, {false, eot}, {true, nak}, {false, eot}, {true, ack}}, 0},
+		{"send nak", []step{{true, []byte{'C'}}, {false, block(1)}, {true, nak}, {false, block(1)}, {true, nak}, {false, block(1)}, {true, ack}}, 2},
+		{"receive clean", []step{{false, nak}, {true, block(1)}, {false, ack}, {true, block(2)}, {false, ack}, {true, eot}, {false, nak}, {true, eot}, {false, ack}}, 0},
+		{"receive nak", []step{{false, []byte{'C'}}, {true, block(1)}, {false, nak}, {true, block(1)}, {false, ack}}, 1},
+		{"receive repeated", []step{{false, nak}, {true, block(1)}, {false, ack}, {true, block(1)}, {false, ack}, {true, block(2)}, {false, ack}}, 1},
+		{"ymodem next file", []step{{false, []byte{'C'}}, {true, block(0)}, {false, ack}, {true, block(1)}, {false, ack}, {true, eot}, {false, ack}, {true, block(0)}, {false, ack}}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			progress := &modemProgress{m: &ModemShellSession{}}
+			r := &modemRetries{}
+			r.reset(progress)
+			for _, s := range test.steps {
+				if s.read {
+					r.read(s.data)
+				} else {
+					r.written(s.data)
+				}
+			}
+			if progress.event.Retries != test.retries {
+				t.Errorf("retries %d, want %d", progress.event.Retries, test.retries)
+			}
+		})
+	}
+}
@@ -16,7 +16,7 @@ require (
 	github.com/ncruces/zenity v0.10.6
 	github.com/pkg/browser v0.0.0-20210911075715-681adbf594b8
 	github.com/pkg/sftp v1.13.5
-	go.bug.st/serial v1.5.0
+	go.bug.st/serial v1.5.0 // pinned, adapter/serial reads the port handle of this version
 	golang.org/x/crypto v0.6.0
 	golang.org/x/sys v0.5.0
 )
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/azurity/go-onefile"
 	"github.com/google/shlex"
 	"github.com/gorilla/websocket"
@@ -15,12 +16,14 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strconv"
-	"sync/atomic"
 	"wterm/adapter/pty"
+	"wterm/adapter/raw"
 	"wterm/adapter/serial"
 	"wterm/adapter/ssh"
+	"wterm/adapter/telnet"
 	"wterm/core"
 	"wterm/ui"
 )
@@ -40,6 +43,12 @@ func initSettings() {
 		core.MainConfig.Settings.FontFamily = "consolas, monospace"
 	}
 	core.MainConfig.Settings.FontSize = 16
+	core.MainConfig.Settings.DetachTimeout = 600
+	core.MainConfig.Settings.Scrollback = 256 * 1024
+	if home, err := os.UserHomeDir(); err == nil {
+		core.MainConfig.Settings.RecordDir = filepath.Join(home, ".wterm_records")
+		core.MainConfig.Settings.LogDir = filepath.Join(home, ".wterm_logs")
+	}
 }
 
 var configFilename string
@@ -48,12 +57,16 @@ func initConfig() {
 	core.Helpers["PTY"] = &pty.ConfigHelper{}
 	core.Helpers["ssh"] = &ssh.ConfigHelper{}
 	core.Helpers["serial"] = &serial.ConfigHelper{}
+	core.Helpers["telnet"] = &telnet.ConfigHelper{}
+	core.Helpers["raw"] = &raw.ConfigHelper{}
 
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return
 	}
 	configFilename = home + "/.wterm_sessions"
+	core.ConfigFilename = configFilename
+	ssh.KnownHostsFile = home + "/.wterm_known_hosts"
 	core.LoadConfig(configFilename)
 }
 
@@ -73,7 +86,7 @@ func settingsService(writer http.ResponseWriter, request *http.Request) {
 			writer.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		settings := core.Settings{}
+		settings := core.MainConfig.Settings
 		err = json.Unmarshal(data, &settings)
 		if err != nil {
 			writer.WriteHeader(http.StatusBadRequest)
@@ -81,7 +94,11 @@ func settingsService(writer http.ResponseWriter, request *http.Request) {
 		}
 		core.MainConfig.Settings = settings
 		if configFilename != "" {
-			core.SaveConfig(configFilename)
+			if err := core.SaveConfig(configFilename); err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				writer.Write([]byte(err.Error()))
+				return
+			}
 		}
 		writer.WriteHeader(http.StatusOK)
 	} else if request.Method != http.MethodOptions {
@@ -108,6 +125,10 @@ func configService(writer http.ResponseWriter, request *http.Request) {
 			}
 			return
 		} else {
+			if core.VaultLocked() {
+				writer.WriteHeader(http.StatusLocked)
+				return
+			}
 			id, err := strconv.ParseUint(request.URL.Query().Get("id"), 10, 64)
 			if err != nil {
 				writer.WriteHeader(http.StatusBadRequest)
@@ -125,68 +146,41 @@ func configService(writer http.ResponseWriter, request *http.Request) {
 			writer.WriteHeader(http.StatusNotFound)
 		}
 	} else if request.Method == http.MethodPost {
-		data, err := io.ReadAll(request.Body)
-		if err != nil {
-			writer.WriteHeader(http.StatusBadRequest)
+		if core.VaultLocked() {
+			writer.WriteHeader(http.StatusLocked)
 			return
 		}
-		base := core.ConfigBase{}
-		err = json.Unmarshal(data, &base)
+		data, err := io.ReadAll(request.Body)
 		if err != nil {
 			writer.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		var full interface{}
-		if helper, ok := core.Helpers[base.Type]; ok {
-			full = helper.LoadConfig(data)
-			if full == nil {
-				writer.WriteHeader(http.StatusBadRequest)
-				return
-			}
-		} else {
-			writer.WriteHeader(http.StatusBadRequest)
-			return
-		}
 		if !request.URL.Query().Has("id") {
-			core.ConfigLock.Lock()
-			core.Configs = append(core.Configs, core.Record{
-				Id:   atomic.AddUint64(core.Id, 1),
-				Type: base.Type,
-				Full: full,
-			})
-			core.ConfigLock.Unlock()
-			if configFilename != "" {
-				core.SaveConfig(configFilename)
-			}
-			writer.WriteHeader(http.StatusOK)
+			_, err = core.AddConfig(data)
 		} else {
-			id, err := strconv.ParseUint(request.URL.Query().Get("id"), 10, 64)
+			var id uint64
+			id, err = strconv.ParseUint(request.URL.Query().Get("id"), 10, 64)
 			if err != nil {
 				writer.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			core.ConfigLock.Lock()
-			for index, item := range core.Configs {
-				if item.Id == id {
-					if item.Type != base.Type {
-						core.ConfigLock.Unlock()
-						writer.WriteHeader(http.StatusBadRequest)
-						return
-					}
-					core.Configs[index].Full = full
-					core.ConfigLock.Unlock()
-					if configFilename != "" {
-						core.SaveConfig(configFilename)
-					}
-					writer.WriteHeader(http.StatusOK)
-					return
-				}
-			}
+			err = core.UpdateConfig(id, data)
+		}
+		if errors.Is(err, core.ErrConfigNotFound) {
 			writer.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
 		}
 		if configFilename != "" {
-			core.SaveConfig(configFilename)
+			if err := core.SaveConfig(configFilename); err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				writer.Write([]byte(err.Error()))
+				return
+			}
 		}
+		writer.WriteHeader(http.StatusOK)
 	} else if request.Method == http.MethodDelete {
 		if !request.URL.Query().Has("id") {
 			writer.WriteHeader(http.StatusBadRequest)
@@ -210,9 +204,148 @@ func configService(writer http.ResponseWriter, request *http.Request) {
 			core.Configs = append(newList, core.Configs[index+1:]...)
 		}
 		core.ConfigLock.Unlock()
+		if configFilename != "" {
+			if err := core.SaveConfig(configFilename); err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				writer.Write([]byte(err.Error()))
+				return
+			}
+		}
 		writer.WriteHeader(http.StatusOK)
+	} else if request.Method != http.MethodOptions {
+		writer.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// importService imports hosts of an OpenSSH client config, hosts imported before are updated in place.
+func importService(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	writer.Header().Set("Access-Control-Allow-Methods", "*")
+	if request.Method == http.MethodPost {
+		if core.VaultLocked() {
+			writer.WriteHeader(http.StatusLocked)
+			return
+		}
+		filename := "~/.ssh/config"
+		if request.URL.Query().Has("path") {
+			filename = request.URL.Query().Get("path")
+		}
+		list, err := ssh.ImportOpenSSH(filename)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+		names := []string{}
+		for _, item := range list {
+			var id uint64
+			core.ConfigLock.RLock()
+			for _, it := range core.Configs {
+				if old, ok := it.Full.(*ssh.Config); ok && it.Type == "ssh" && old.Import == item.Import {
+					merged := *old
+					merged.MergeImport(item)
+					id = it.Id
+					item = &merged
+					break
+				}
+			}
+			core.ConfigLock.RUnlock()
+			data := core.Helpers["ssh"].StoreConfig(item)
+			if data == nil {
+				continue
+			}
+			if id != 0 {
+				err = core.UpdateConfig(id, data)
+			} else {
+				_, err = core.AddConfig(data)
+			}
+			if err == nil {
+				names = append(names, item.Name)
+			}
+		}
 		if configFilename != "" {
-			core.SaveConfig(configFilename)
+			if err := core.SaveConfig(configFilename); err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				writer.Write([]byte(err.Error()))
+				return
+			}
+		}
+		data, err := json.Marshal(names)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+		} else {
+			writer.Write(data)
+		}
+	} else if request.Method != http.MethodOptions {
+		writer.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+type vaultRequest struct {
+	Passphrase    string `json:"passphrase"`
+	NewPassphrase string `json:"newPassphrase"`
+}
+
+// vaultService reports the vault state, POST unlocks it and PUT changes the master passphrase.
+func vaultService(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	writer.Header().Set("Access-Control-Allow-Methods", "*")
+	if request.Method == http.MethodGet {
+		data, err := json.Marshal(core.VaultStatus())
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+		} else {
+			writer.Write(data)
+		}
+	} else if request.Method == http.MethodPost || request.Method == http.MethodPut {
+		data, err := io.ReadAll(request.Body)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req := vaultRequest{}
+		err = json.Unmarshal(data, &req)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if request.Method == http.MethodPost {
+			err = core.UnlockVault(req.Passphrase)
+		} else {
+			err = core.SetVault(req.Passphrase, req.NewPassphrase)
+		}
+		if errors.Is(err, core.ErrWrongPassphrase) {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		} else if errors.Is(err, core.ErrVaultLocked) {
+			writer.WriteHeader(http.StatusLocked)
+			return
+		} else if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+	} else if request.Method != http.MethodOptions {
+		writer.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func serialService(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	writer.Header().Set("Access-Control-Allow-Methods", "*")
+	if request.Method == http.MethodGet {
+		list, err := serial.ListPorts()
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+		data, err := json.Marshal(list)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+		} else {
+			writer.Write(data)
 		}
 	} else if request.Method != http.MethodOptions {
 		writer.WriteHeader(http.StatusBadRequest)
@@ -234,7 +367,11 @@ func layoutService(writer http.ResponseWriter, request *http.Request) {
 		}
 		core.MainConfig.Layout = string(data)
 		if configFilename != "" {
-			core.SaveConfig(configFilename)
+			if err := core.SaveConfig(configFilename); err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				writer.Write([]byte(err.Error()))
+				return
+			}
 		}
 	} else if request.Method != http.MethodOptions {
 		writer.WriteHeader(http.StatusBadRequest)
@@ -302,14 +439,17 @@ func uploadFileService(writer http.ResponseWriter, request *http.Request) {
 	}
 }
 
-func initMux() http.Handler {
-	mux := http.NewServeMux()
-	webFS, _ := fs.Sub(ui.FrontendFS, "frontend")
-	mux.Handle("/", onefile.New(webFS, &onefile.Overwrite{
-		Fsys: nil,
-		Pair: map[string]string{},
-	}, "/index.html"))
-	mux.HandleFunc("/ws", func(writer http.ResponseWriter, request *http.Request) {
+func hostService(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	writer.Header().Set("Access-Control-Allow-Methods", "*")
+	if request.Method == http.MethodGet {
+		data, err := json.Marshal(core.ListHosts())
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+		} else {
+			writer.Write(data)
+		}
+	} else if request.Method == http.MethodDelete {
 		if !request.URL.Query().Has("id") {
 			writer.WriteHeader(http.StatusBadRequest)
 			return
@@ -319,26 +459,185 @@ func initMux() http.Handler {
 			writer.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		var instance core.ServeInstance = nil
-		for _, item := range core.Configs {
-			if item.Id == id {
-				instance = core.Helpers[item.Type].New(item.Full)
-				break
-			}
+		host := core.LoadHost(id)
+		if host == nil {
+			writer.WriteHeader(http.StatusNotFound)
+			return
 		}
-		if instance == nil {
+		host.Close()
+		writer.WriteHeader(http.StatusOK)
+	} else if request.Method != http.MethodOptions {
+		writer.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func forwardService(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	writer.Header().Set("Access-Control-Allow-Methods", "*")
+	if request.Method == http.MethodOptions {
+		return
+	}
+	hostId, err := strconv.ParseUint(request.URL.Query().Get("host"), 10, 64)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	host := core.LoadHost(hostId)
+	if host == nil {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	instance, ok := host.Instance.(*ssh.Instance)
+	if !ok {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if request.Method == http.MethodGet {
+		data, err := json.Marshal(instance.Forwards())
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+		} else {
+			writer.Write(data)
+		}
+	} else if request.Method == http.MethodPost {
+		data, err := io.ReadAll(request.Body)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		config := ssh.ForwardConfig{}
+		err = json.Unmarshal(data, &config)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		info, err := instance.AddForward(config)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+		data, err = json.Marshal(info)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+		} else {
+			writer.Write(data)
+		}
+	} else if request.Method == http.MethodDelete {
+		id, err := strconv.ParseUint(request.URL.Query().Get("id"), 10, 64)
+		if err != nil {
 			writer.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		if instance.RemoveForward(id) {
+			writer.WriteHeader(http.StatusOK)
+		} else {
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	} else {
+		writer.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func recordService(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	writer.Header().Set("Access-Control-Allow-Methods", "*")
+	if request.Method == http.MethodGet {
+		list := []string{}
+		entries, err := os.ReadDir(core.MainConfig.Settings.RecordDir)
+		if err == nil {
+			for _, it := range entries {
+				// only recordings can be played back
+				if !it.IsDir() && filepath.Ext(it.Name()) == ".cast" {
+					list = append(list, it.Name())
+				}
+			}
+		}
+		data, err := json.Marshal(list)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+		} else {
+			writer.Write(data)
+		}
+	} else if request.Method != http.MethodOptions {
+		writer.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func initMux() http.Handler {
+	mux := http.NewServeMux()
+	webFS, _ := fs.Sub(ui.FrontendFS, "frontend")
+	mux.Handle("/", onefile.New(webFS, &onefile.Overwrite{
+		Fsys: nil,
+		Pair: map[string]string{},
+	}, "/index.html"))
+	mux.HandleFunc("/ws", func(writer http.ResponseWriter, request *http.Request) {
+		// recordings are replayed in a host of their own, which needs no config
+		playback := request.URL.Query().Has("playback")
+		var id uint64
+		if !playback {
+			if !request.URL.Query().Has("id") {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var err error
+			id, err = strconv.ParseUint(request.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if core.VaultLocked() {
+				writer.WriteHeader(http.StatusLocked)
+				return
+			}
+		}
+		var host *core.Host = nil
+		if request.URL.Query().Has("host") {
+			hostId, err := strconv.ParseUint(request.URL.Query().Get("host"), 10, 64)
+			if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			host = core.LoadHost(hostId)
+			if host == nil || host.ConfigId != id {
+				writer.WriteHeader(http.StatusNotFound)
+				return
+			}
+		} else if playback {
+			host = core.NewPlaybackHost()
+		} else {
+			core.ConfigLock.RLock()
+			for _, item := range core.Configs {
+				if item.Id == id {
+					host = core.NewHost(id, core.BaseOf(item.Full), core.Helpers[item.Type].New(id, item.Full))
+					break
+				}
+			}
+			core.ConfigLock.RUnlock()
+			if host == nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
 		c, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			host.Close()
+			return
+		}
 		defer c.Close()
-		core.ServeWS(c, instance)
+		core.ServeWS(c, host)
 	})
 	mux.HandleFunc("/api/config", configService)
+	mux.HandleFunc("/api/import", importService)
 	mux.HandleFunc("/api/layout", layoutService)
 	mux.HandleFunc("/api/download", downloadFileService)
 	mux.HandleFunc("/api/upload", uploadFileService)
 	mux.HandleFunc("/api/settings", settingsService)
+	mux.HandleFunc("/api/host", hostService)
+	mux.HandleFunc("/api/record", recordService)
+	mux.HandleFunc("/api/forward", forwardService)
+	mux.HandleFunc("/api/vault", vaultService)
+	mux.HandleFunc("/api/serial", serialService)
 	mux.HandleFunc("/api/launch", func(writer http.ResponseWriter, request *http.Request) {
 		writer.WriteHeader(http.StatusOK)
 		launch()
@@ -388,6 +687,7 @@ func main() {
 	ui.StartSystray(launch, func() {
 		ui.TauriClear()
 		server.Close()
+		core.CloseHosts()
 	})
 
 	server.ListenAndServe()
@@ -7,7 +7,7 @@ import Menu from './components/Menu';
 import Status from './components/Status';
 import { standardLayout, walkLayout } from './layout';
 import Term from './components/Term';
-import { Connection, connMan, FSHandle } from './connection';
+import { Connection, connMan, FSHandle, HostInfo, SessionType } from './connection';
 import Session from './components/Session';
 import { SessionInfo, SettingsType, StatusItem } from './struct';
 import AuthBox from './components/AuthBox';
@@ -16,6 +16,20 @@ import List from './components/List';
 import FS from './components/FS';
 import Settings from './components/Settings';
 import ModemBox from './components/ModemBox';
+import RecordBox from './components/RecordBox';
+import VaultBox from './components/VaultBox';
+
+// only answers of these questions are written back to the config
+const SAVABLE_QUESTIONS = ['username', 'password'];
+
+// recordings are replayed in a host of their own, config ids start at 1
+const PLAYBACK_INFO: SessionInfo = {
+  id: 0,
+  name: 'playback',
+  url: 'ws://localhost:32300/ws?playback',
+  protocol: 'standard',
+  fixSize: false,
+};
 
 const groups = {
   tool: {
@@ -118,6 +132,8 @@ function App() {
     setNewStatus(item);
   }
 
+  const [modemProgress, setModemProgress] = useState<string>('');
+
   const [settings, setSettings] = useState<SettingsType>();
 
   const refreshSettings = async () => {
@@ -136,6 +152,127 @@ function App() {
 
   useEffect(() => { refreshSettings(); }, []);
 
+  const unlockVault = async () => {
+    try {
+      let res = await fetch('http://localhost:32300/api/vault');
+      let data = await res.json();
+      if (!data.locked) {
+        return;
+      }
+    } catch (err: any) {
+      addStatus({
+        type: 'ERROR',
+        time: Date.now(),
+        info: `[vault] ${err}`,
+      });
+      return;
+    }
+    overlayInc();
+    overlayDockRef.current?.dockMove({
+      id: 'vault',
+      title: 'master passphrase',
+      content: <AuthBox
+        secret={true}
+        submit={async (passphrase) => {
+          overlayDockRef.current?.dockMove(overlayDockRef.current.find('vault') as TabData, null, 'remove');
+          overlayDec();
+          let res = await fetch('http://localhost:32300/api/vault', {
+            method: 'POST',
+            body: JSON.stringify({ passphrase }),
+          });
+          if (!res.ok) {
+            addStatus({
+              type: 'ERROR',
+              time: Date.now(),
+              info: `[vault] unlock failed: ${res.status == 403 ? 'wrong passphrase' : res.statusText}`,
+            });
+            unlockVault();
+          }
+        }}
+        cancel={() => {
+          overlayDockRef.current?.dockMove(overlayDockRef.current.find('vault') as TabData, null, 'remove');
+          overlayDec();
+        }} />,
+      group: 'common',
+    }, null, 'float');
+  };
+
+  useEffect(() => { unlockVault(); }, []);
+
+  const cancelVault = () => {
+    overlayDockRef.current?.dockMove(overlayDockRef.current.find('vault_settings') as TabData, null, 'remove');
+    overlayDec();
+  }
+
+  // openVault sets, changes or removes the master passphrase
+  const openVault = async () => {
+    if (overlay > 0) {
+      return;
+    }
+    let enabled = false;
+    try {
+      let res = await fetch('http://localhost:32300/api/vault');
+      let data = await res.json();
+      if (data.locked) {
+        unlockVault();
+        return;
+      }
+      enabled = data.enabled;
+    } catch (err: any) {
+      addStatus({
+        type: 'ERROR',
+        time: Date.now(),
+        info: `[vault] ${err}`,
+      });
+      return;
+    }
+    overlayInc();
+    overlayDockRef.current?.dockMove({
+      tabs: [{
+        id: 'vault_settings',
+        title: 'master passphrase',
+        content: <VaultBox
+          enabled={enabled}
+          cancel={cancelVault}
+          save={async (passphrase, newPassphrase) => {
+            cancelVault();
+            try {
+              let res = await fetch('http://localhost:32300/api/vault', {
+                method: 'PUT',
+                body: JSON.stringify({ passphrase, newPassphrase }),
+              });
+              if (!res.ok) {
+                addStatus({
+                  type: 'ERROR',
+                  time: Date.now(),
+                  info: `[vault] change failed: ${res.status == 403 ? 'wrong passphrase' : (await res.text() || res.statusText)}`,
+                });
+                return;
+              }
+              addStatus({
+                type: 'INFO',
+                time: Date.now(),
+                info: `[vault] ${newPassphrase == '' ? 'secrets are stored in plain text' : 'master passphrase saved'}`,
+              });
+            } catch (err: any) {
+              addStatus({
+                type: 'ERROR',
+                time: Date.now(),
+                info: `[vault] ${err}`,
+              });
+            }
+          }}
+        />,
+        group: 'common',
+        minHeight: 300,
+        minWidth: 600,
+      }],
+      w: 640,
+      h: 320,
+      y: 120,
+    }, null, 'float');
+  }
+
   useEffect(() => {
     updateSession();
     // refSets.forEach((it) => {
@@ -144,14 +281,14 @@ function App() {
     // });
   }, [settings]);
 
-  const newTerm = (name: string, conn: number) => {
+  const newTerm = (name: string, conn: number, ssId?: number, playback?: string, readOnly?: boolean) => {
     let mainpanel = dockRef.current?.find('main');
     let ref = React.createRef<Term>();
-    let localIndex = connMan.get(conn)!.sessionCount;
+    let localIndex = ssId ?? connMan.get(conn)!.sessionCount;
     let key = `term-${conn}-${localIndex}`;
     dockRef.current?.dockMove({
       id: key,
-      title: `${name}${localIndex != 0 ? ` - ${(localIndex + 1)}` : ''}`,
+      title: playback != undefined ? `playback - ${playback}` : `${name}${localIndex != 0 ? ` - ${(localIndex + 1)}` : ''}${readOnly ? ' (watching)' : ''}`,
       content: <Term
         key={key}
         ref={ref}
@@ -161,6 +298,9 @@ function App() {
           fontSize: settings?.fontSize ?? 16,
         }}
         connId={conn}
+        ssId={ssId}
+        playback={playback}
+        readOnly={readOnly}
         dispose={() => {
           dockRef.current?.dockMove(dockRef.current?.find(key) as TabData, null, 'remove');
           refSets.delete(key);
@@ -181,53 +321,149 @@ function App() {
     refSets?.set(key, ref);
   }
 
-  const openSession = (info: SessionInfo) => {
+  // connect opens a connection to the config, or to a host of it still running on the server
+  const connect = (info: SessionInfo, opened: () => void, hostId?: number) => {
+    let conn = new Connection(info.url, info.protocol, info.fixSize, opened, () => {
+      connMan.delete(info.id);
+    }, hostId);
+    conn.addEventListener('info', (event) => {
+      addStatus({
+        type: event.data.type,
+        time: Date.now(),
+        info: `[${info.name}] ${event.data.info}`,
+      } as StatusItem);
+    });
+    conn.addEventListener('modem', (event) => {
+      if (event.data.op == 'progress') {
+        let retries = event.data.retries > 0 ? `, ${event.data.retries} retries` : '';
+        setModemProgress(`${event.data.direct} ${event.data.name || ''} ${event.data.done}/${event.data.size}${retries}`);
+      } else if (event.data.op == 'detected') {
+        // sz or rz started without an armed transfer, the server waits for one
+        const term = refSets.get(`term-${info.id}-${event.id}`)?.current;
+        if (term && !term.readOnly && event.data.direct) {
+          openModemDialog(info.id, event.id, event.data.direct, true);
+        }
+      } else if (event.data.op == 'result') {
+        setModemProgress('');
+        if (overlayDockRef.current?.find('modem')) {
+          // the detected transfer ended before it was armed
+          cancelModemDialog();
+        }
+        addStatus({
+          type: event.data.error ? 'ERROR' : 'INFO',
+          time: Date.now(),
+          info: `[${info.name}] modem ${event.data.direct} ${event.data.error || 'finished'}`,
+        });
+      }
+    });
+    connMan.set(info.id, conn);
+    conn.addEventListener('auth', (event) => {
+      overlayInc();
+      overlayDockRef.current?.dockMove({
+        id: `auth-${info.id}`,
+        title: `${event.data} <${info.name}>`,
+        content: <AuthBox
+          secret={!event.data.startsWith('username') && !event.data.startsWith('unknown host key')}
+          savable={SAVABLE_QUESTIONS.includes(event.data)}
+          submit={(password, saved) => {
+            overlayDockRef.current?.dockMove(overlayDockRef.current.find(`auth-${info.id}`) as TabData, null, 'remove');
+            overlayDec();
+            conn.auth(event.data, password, saved);
+          }}
+          cancel={() => {
+            let key = `term-${info.id}-0`;
+            dockRef.current?.dockMove(dockRef.current?.find(key) as TabData, null, 'remove');
+            // refSets.delete(key);
+            overlayDec();
+          }}
+        />,
+        // cached: true,
+        group: 'common',
+      }, null, 'float');
+    });
+    return conn;
+  }
+
+  const openSession = async (info: SessionInfo) => {
     if (!connMan.has(info.id)) {
-      let conn = new Connection(info.url, info.protocol, info.fixSize, () => {
+      // sessions of this config still running on the server, e.g. left by a page reload
+      let detached: HostInfo | undefined;
+      if (info.protocol == 'standard') {
+        try {
+          let res = await fetch('http://localhost:32300/api/host');
+          let hosts = await res.json() as HostInfo[];
+          detached = hosts.find((it) => it.configId == info.id && !it.attached && it.sessions.length > 0);
+        } catch (err: any) {
+          addStatus({
+            type: 'ERROR',
+            time: Date.now(),
+            info: `[get host list] ${err}`,
+          });
+        }
+      }
+      if (connMan.has(info.id)) {
         newTerm(info.name, info.id);
-      }, () => {
-        connMan.delete(info.id);
+        return;
+      }
+      let conn = connect(info, () => {
+        let shells = detached?.sessions.filter((it) => it.type == SessionType.shell) ?? [];
+        // file managers are opened again by their terminals
+        detached?.sessions.filter((it) => it.type != SessionType.shell).forEach((it) => conn.discard(it.id, it.type));
+        if (shells.length == 0) {
+          newTerm(info.name, info.id);
+        }
+        shells.forEach((it) => newTerm(info.name, info.id, it.id));
+      }, detached?.id);
+    } else {
+      newTerm(info.name, info.id);
+    }
+  }
+
+  // watchSession joins the shells another client runs on a host of the config as a read-only viewer
+  const watchSession = async (info: SessionInfo) => {
+    if (info.protocol != 'standard') {
+      return;
+    }
+    if (connMan.has(info.id)) {
+      addStatus({
+        type: 'ERROR',
+        time: Date.now(),
+        info: `[${info.name}] already connected, close its terminals to watch another client`,
       });
-      conn.addEventListener('info', (event) => {
-        addStatus({
-          type: event.data.type,
-          time: Date.now(),
-          info: `[${info.name}] ${event.data.info}`,
-        } as StatusItem);
+      return;
+    }
+    let host: HostInfo | undefined;
+    try {
+      let res = await fetch('http://localhost:32300/api/host');
+      let hosts = await res.json() as HostInfo[];
+      host = hosts.find((it) => it.configId == info.id && it.sessions.some((ss) => ss.type == SessionType.shell));
+    } catch (err: any) {
+      addStatus({
+        type: 'ERROR',
+        time: Date.now(),
+        info: `[get host list] ${err}`,
       });
-      connMan.set(info.id, conn);
-      conn.addEventListener('auth', (event) => {
-        overlayInc();
-        overlayDockRef.current?.dockMove({
-          id: `auth-${info.id}`,
-          title: `${event.data} <${info.name}>`,
-          content: <AuthBox
-            secret={event.data == 'password'}
-            submit={(password) => {
-              overlayDockRef.current?.dockMove(overlayDockRef.current.find(`auth-${info.id}`) as TabData, null, 'remove');
-              overlayDec();
-              conn.auth(event.data, password, false);
-            }}
-            cancel={() => {
-              let key = `term-${info.id}-0`;
-              dockRef.current?.dockMove(dockRef.current?.find(key) as TabData, null, 'remove');
-              // refSets.delete(key);
-              overlayDec();
-            }}
-          />,
-          // cached: true,
-          group: 'common',
-        }, null, 'float');
+      return;
+    }
+    if (!host) {
+      addStatus({
+        type: 'ERROR',
+        time: Date.now(),
+        info: `[${info.name}] no running session to watch`,
       });
-    } else {
-      newTerm(info.name, info.id);
+      return;
     }
+    let shells = host.sessions.filter((it) => it.type == SessionType.shell);
+    connect(info, () => {
+      shells.forEach((it) => newTerm(info.name, info.id, it.id, undefined, true));
+    }, host.id);
   }
 
   const updateSession = () => {
     let newTab = { ...dockRef.current?.find('session_man') as TabData };
     newTab.content = <Session
       open={openSession}
+      watch={watchSession}
       edit={editConfig}
       del={delConfig}
       trigger={Date.now()}
@@ -425,6 +661,7 @@ function App() {
           title: "session list",
           content: <Session
             open={openSession}
+            watch={watchSession}
             edit={editConfig}
             del={delConfig}
             addStatus={addStatus}
@@ -553,12 +790,78 @@ function App() {
     openModemDialog(connId, termId, "recv");
   }
 
+  const modemCancel = () => {
+    const fileMan = dockRef.current?.find('file_man') as TabData;
+    const props = (fileMan.content as React.ReactElement).props;
+    connMan.get(props.connId)?.modemCancel(props.termId);
+  }
+
+  const cancelRecordDialog = () => {
+    overlayDockRef.current?.dockMove(overlayDockRef.current.find('record') as TabData, null, 'remove');
+    overlayDec();
+  }
+
+  const openRecording = async () => {
+    if (overlay > 0) {
+      return;
+    }
+    let names: string[] = [];
+    try {
+      let res = await fetch('http://localhost:32300/api/record');
+      names = await res.json();
+    } catch (err: any) {
+      addStatus({
+        type: 'ERROR',
+        time: Date.now(),
+        info: `[get record list] ${err}`,
+      });
+      return;
+    }
+    overlayInc();
+    overlayDockRef.current?.dockMove({
+      tabs: [{
+        id: 'record',
+        title: 'recordings',
+        content: <RecordBox
+          names={names}
+          open={(name) => {
+            cancelRecordDialog();
+            if (connMan.has(PLAYBACK_INFO.id)) {
+              newTerm('', PLAYBACK_INFO.id, undefined, name);
+            } else {
+              connect(PLAYBACK_INFO, () => {
+                newTerm('', PLAYBACK_INFO.id, undefined, name);
+              });
+            }
+          }}
+          fin={cancelRecordDialog}
+        />,
+        group: 'common',
+        minHeight: 400,
+        minWidth: 600,
+      }],
+      w: 640,
+      h: 480,
+      y: 120,
+    }, null, 'float');
+  }
+
+  const toggleShare = () => {
+    const fileMan = dockRef.current?.find('file_man') as TabData;
+    const props = (fileMan.content as React.ReactElement).props;
+    const term = refSets.get(`term-${props.connId}-${props.termId}`)?.current;
+    if (term && !term.readOnly) {
+      term.shared = !term.shared;
+      connMan.get(props.connId)?.share(props.termId, term.shared);
+    }
+  }
+
   const cancelModemDialog = () => {
     overlayDockRef.current?.dockMove(overlayDockRef.current.find('modem') as TabData, null, 'remove');
     overlayDec();
   }
 
-  const openModemDialog = (connId: number, termId: number, type: "send"|"recv") => {
+  const openModemDialog = (connId: number, termId: number, type: "send"|"recv", detected: boolean = false) => {
     if (overlay > 0) {
       return;
     }
@@ -570,6 +873,7 @@ function App() {
           connId={connId}
           termId={termId}
           direct={type}
+          detected={detected}
           fin={cancelModemDialog}
         />,
         // cached: true,
@@ -603,6 +907,18 @@ function App() {
                 title: "settings",
                 action: openSettings,
               },
+              {
+                title: "master passphrase",
+                action: openVault,
+              },
+              {
+                title: "share input",
+                action: toggleShare,
+              },
+              {
+                title: "open recording",
+                action: openRecording,
+              },
             ]
           },
           {
@@ -635,6 +951,10 @@ function App() {
                 title: "recv file",
                 action: modemRecv,
               },
+              {
+                title: "cancel transfer",
+                action: modemCancel,
+              },
             ],
           },
         ]} />
@@ -659,7 +979,7 @@ function App() {
           style={layoutStyle(custom)}
         />
       </div>
-      <Status list={statusList} />
+      <Status list={statusList} modem={modemProgress} />
     </div>
   );
   // return (
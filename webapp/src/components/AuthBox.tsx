@@ -2,7 +2,8 @@ import { useState } from "react";
 
 interface Props {
     secret: boolean
-    submit: (password: string) => void;
+    savable?: boolean
+    submit: (password: string, saved: boolean) => void;
     cancel: () => void;
 }
 
@@ -26,6 +27,7 @@ const buttonStyle: React.CSSProperties = {
 
 function AuthBox(props: Props) {
     const [value, setValue] = useState<string>("");
+    const [saved, setSaved] = useState<boolean>(false);
 
     return (
         <div style={{ width: '100%', height: '100%', display: 'flex', flexDirection: 'column', justifyContent: 'center', alignItems: 'center' }}>
@@ -37,6 +39,15 @@ function AuthBox(props: Props) {
                 onChange={(event) => {
                     setValue(event.target.value);
                 }}></input>
+            {props.savable && <label style={{ marginTop: '8px', userSelect: 'none' }}>
+                <input
+                    type="checkbox"
+                    checked={saved}
+                    onChange={(event) => {
+                        setSaved(event.target.checked);
+                    }}></input>
+                save
+            </label>}
             <div style={buttonGroupStyle}>
                 <div
                     style={buttonStyle}
@@ -46,7 +57,7 @@ function AuthBox(props: Props) {
                 <div
                     style={buttonStyle}
                     onClick={() => {
-                        props.submit(value);
+                        props.submit(value, saved);
                     }}>sure</div>
             </div>
         </div>
@@ -4,6 +4,8 @@ import "./ConfigBox.css";
 import SSHConfig, { checkSSH, formatSSH } from "./configs/SSHConfig";
 import PTYConfig, { checkPTY, formatPTY } from "./configs/PTYConfig";
 import SerialConfig, { checkSerial, formatSerial } from "./configs/SerialConfig";
+import TelnetConfig, { checkTelnet, formatTelnet } from "./configs/TelnetConfig";
+import RawConfig, { checkRaw, formatRaw } from "./configs/RawConfig";
 
 interface Props {
     infoId: number;
@@ -24,6 +26,8 @@ const ConfigDetail: [string, ConfigDetailType][] = [
     ["PTY", { Component: PTYConfig, check: checkPTY, format: formatPTY }],
     ["ssh", { Component: SSHConfig, check: checkSSH, format: formatSSH }],
     ["serial", { Component: SerialConfig, check: checkSerial, format: formatSerial }],
+    ["telnet", { Component: TelnetConfig, check: checkTelnet, format: formatTelnet }],
+    ["raw", { Component: RawConfig, check: checkRaw, format: formatRaw }],
 ];
 
 const ConfigDetailMap = new Map([["", { Component: () => <div></div>, check: () => false, format: (data) => data }], ...ConfigDetail]);
@@ -51,6 +55,18 @@ function ConfigBox(props: Props) {
                 </div> : ''}
             <div className="container">
                 {React.createElement(ConfigDetailMap.get(type)!.Component, { data, onChange: setData })}
+                {type != "" ? <div style={{
+                    width: '100%',
+                    display: 'grid',
+                    gridGap: '8px',
+                    gridTemplateColumns: '120px auto',
+                    marginTop: 8,
+                }}>
+                    <label>always record</label>
+                    <input type="checkbox" checked={data.record ?? false} onChange={(event) => {
+                        setData({ ...data, record: event.currentTarget.checked });
+                    }} />
+                </div> : ''}
                 <div className="button-group">
                     <div onClick={props.cancel}>cancel</div>
                     {
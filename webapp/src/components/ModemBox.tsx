@@ -1,20 +1,27 @@
 import React, { useMemo, useState } from "react";
-import { connMan, ModemFn } from "../connection";
+import { connMan, ModemFn, ModemSource } from "../connection";
 import "./ModemBox.css";
 
 interface Props {
     connId: number;
     termId: number;
     direct: "send" | "recv";
+    // sz or rz already started and waits for this dialog, only zmodem applies
+    detected?: boolean;
     fin: () => void;
 }
 
 function ModemBox(props: Props) {
-    const [type, setType] = useState<string>("x");
+    const [type, setType] = useState<string>(props.detected ? "z" : "x");
     const [use1k, setUse1k] = useState<boolean>(false);
     const [useCRC, setUseCRC] = useState<boolean>(false);
     const [useCAN, setUseCAN] = useState<boolean>(false);
     const [useG, setUseG] = useState<boolean>(false);
+    const [source, setSource] = useState<ModemSource>("dialog");
+    const [paths, setPaths] = useState<string>("");
+    const [files, setFiles] = useState<File[]>([]);
+    // the file manager of the terminal, for transfers from or to its filesystem
+    const sftp = connMan.get(props.connId)?.sftphandles.get(props.termId);
 
     return (
         <div className="modem-box container">
@@ -24,30 +31,55 @@ function ModemBox(props: Props) {
                 gridGap: '8px',
                 gridTemplateColumns: '16px auto',
             }}>
-                <input type="radio" name="protocol" value="x" onChange={() => { setType('x') }} checked={type == "x"} />
+                <input type="radio" name="protocol" value="x" onChange={() => { setType('x') }} checked={type == "x"} disabled={props.detected} />
                 <label>XModem</label>
-                <input type="radio" name="protocol" value="y" onChange={() => { setType('y') }} checked={type == "y"} />
+                <input type="radio" name="protocol" value="y" onChange={() => { setType('y') }} checked={type == "y"} disabled={props.detected} />
                 <label>YModem</label>
+                <input type="radio" name="protocol" value="z" onChange={() => { setType('z') }} checked={type == "z"} />
+                <label>{props.detected ? `ZModem (${props.direct == "send" ? "rz" : "sz"} is waiting)` : "ZModem (starts with sz/rz)"}</label>
+                {props.direct == "send" && !props.detected && <>
+                    <input type="radio" name="protocol" value="text" onChange={() => { setType('text') }} checked={type == "text"} />
+                    <label>plain text (typed as input, paced on serial)</label>
+                </>}
                 <label>&nbsp;</label>
                 <label>&nbsp;</label>
-                <input type="checkbox" name="1k" onChange={() => { setUse1k(!use1k) }} checked={use1k || type == 'y'} disabled={type == 'y'} />
+                <input type="checkbox" name="1k" onChange={() => { setUse1k(!use1k) }} checked={use1k || type == 'y'} disabled={type == 'y' || type == 'text'} />
                 <label>1K block</label>
-                <input type="checkbox" name="CRC" onChange={() => { setUseCRC(!useCRC) }} checked={useCRC || type == 'y'} disabled={type == 'y'} />
+                <input type="checkbox" name="CRC" onChange={() => { setUseCRC(!useCRC) }} checked={useCRC || type == 'y'} disabled={type == 'y' || type == 'text'} />
                 <label>CRC</label>
-                <input type="checkbox" name="CANbreak" onChange={() => { setUseCAN(!useCAN) }} checked={useCAN || type == 'y'} disabled={type == 'y'} />
+                <input type="checkbox" name="CANbreak" onChange={() => { setUseCAN(!useCAN) }} checked={useCAN || type == 'y'} disabled={type == 'y' || type == 'text'} />
                 <label>double CAN break</label>
                 <input type="checkbox" name="g" onChange={() => { setUseG(!useG) }} checked={useG && type == 'y'} disabled={type != 'y'} />
                 <label>g-option</label>
+                <label>&nbsp;</label>
+                <label>&nbsp;</label>
+                <input type="radio" name="source" value="dialog" onChange={() => { setSource('dialog') }} checked={source == "dialog"} />
+                <label>native dialog</label>
+                <input type="radio" name="source" value="stream" onChange={() => { setSource('stream') }} checked={source == "stream"} />
+                <label>{props.direct == "send" ? "browser file" : "browser download"}</label>
+                <input type="radio" name="source" value="path" onChange={() => { setSource('path') }} checked={source == "path"} />
+                <label>{props.direct == "send" ? "paths, one per line" : (type == "x" ? "save to file" : "save to directory")}</label>
+                <input type="radio" name="source" value="fs" onChange={() => { setSource('fs'); if (paths == "" && sftp) setPaths(sftp.cwd) }} checked={source == "fs"} disabled={!sftp} />
+                <label>in the file manager's filesystem</label>
+                <label>&nbsp;</label>
+                {(source == "path" || source == "fs") && <textarea value={paths} onChange={(e) => { setPaths(e.target.value) }} />}
+                {source == "stream" && props.direct == "send" && <input type="file" multiple={type != "x" && type != "text"} onChange={(e) => { setFiles(Array.from(e.target.files || [])) }} />}
             </div>
             <div className="button-group">
-                <div onClick={props.fin}>cancel</div>
+                <div onClick={() => {
+                    if (props.detected) {
+                        connMan.get(props.connId)?.modemCancel(props.termId);
+                    }
+                    props.fin();
+                }}>cancel</div>
                 <div onClick={() => {
                     let fn = 0;
                     if (use1k) fn |= ModemFn.ModemFn1k;
                     if (useCRC) fn |= ModemFn.ModemFnCRC;
                     if (useCAN) fn |= ModemFn.ModemFnCANCAN;
                     if (useG) fn |= ModemFn.ModemFnG;
-                    connMan.get(props.connId)?.modem(props.termId, props.direct, type, fn);
+                    let pathList = paths.split("\n").map((item) => item.trim()).filter((item) => item != "");
+                    connMan.get(props.connId)?.modem(props.termId, props.direct, type, fn, source, pathList, files, sftp?.ssid);
                     props.fin();
                 }}>{props.direct}</div>
             </div>
@@ -0,0 +1,26 @@
+import React from "react";
+import List from "./List";
+import "./RecordBox.css";
+
+interface Props {
+    names: string[];
+    open: (name: string) => void;
+    fin: () => void;
+}
+
+function RecordBox(props: Props) {
+    return (
+        <div className="record-box container">
+            <List list={props.names.map((name) => ({
+                key: `record-${name}`,
+                title: name,
+                action: () => { props.open(name); },
+            }))} />
+            <div className="button-group">
+                <div onClick={props.fin}>cancel</div>
+            </div>
+        </div>
+    );
+}
+
+export default RecordBox;
@@ -5,6 +5,7 @@ import List, { ListItem } from './List';
 
 interface SessionProps {
     open: (info: SessionInfo) => void;
+    watch: (info: SessionInfo) => void;
     edit: (id: number) => void;
     del: (id: number) => void;
     trigger?: number;
@@ -51,6 +52,9 @@ function Session(props: SessionProps) {
                 action: action,
                 menu: [
                     {
+                        title: 'watch',
+                        action: () => { props.watch(it); },
+                    }, {
                         title: 'edit',
                         action: () => { props.edit(it.id); },
                     }, {
@@ -2,6 +2,7 @@ import { StatusItem } from "../struct";
 
 interface Props {
     list: StatusItem[];
+    modem?: string;
 }
 
 function Status(props: Props) {
@@ -29,6 +30,11 @@ function Status(props: Props) {
                 textAlign: 'center',
                 userSelect: 'none',
             }}>INFO:{props.list.filter((it) => it.type == 'INFO').length}</div>
+            {props.modem ? <div style={{
+                color: 'gray',
+                paddingRight: 16,
+                userSelect: 'none',
+            }}>{props.modem}</div> : ''}
             {props.list.length > 0 ? <div style={{
                 color: props.list[0].type == 'ERROR' ? 'orange' : 'gray',
             }}>{`[${props.list[0].type} ${new Date(props.list[0].time).toLocaleString()}] ${props.list[0].info}`}</div> : ''}
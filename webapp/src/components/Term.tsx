@@ -3,16 +3,28 @@ import { Terminal, ITerminalOptions, ITerminalInitOnlyOptions } from 'xterm'
 import { FitAddon } from 'xterm-addon-fit';
 import { Unicode11Addon } from 'xterm-addon-unicode11';
 import 'xterm/css/xterm.css'
-import { connMan } from '../connection';
+import { connMan, PlaybackStateType, Role } from '../connection';
 
 interface Props {
     connId: number;
+    // session still alive on the server to attach to, a new shell is opened when omitted
+    ssId?: number;
     dispose: () => void;
     created?: () => void;
     options?: ITerminalOptions & ITerminalInitOnlyOptions;
+    // recording to replay instead of opening a shell
+    playback?: string;
+    // watch the session of another client, ssId must be set
+    readOnly?: boolean;
 }
 
-class Term extends React.Component<Props> {
+interface State {
+    playback?: PlaybackStateType;
+}
+
+const PLAYBACK_SPEEDS = [0.5, 1, 2, 4, 8];
+
+class Term extends React.Component<Props, State> {
     connId: number;
     ssId: number;
     terminalRef: React.RefObject<HTMLDivElement>;
@@ -22,6 +34,12 @@ class Term extends React.Component<Props> {
     disposer: () => void;
     created: () => void;
     fixSize: boolean;
+    attachId?: number;
+    opened = false;
+    readOnly = false;
+    shared = false;
+    state: State = {};
+    playbackTimer: number = 0;
 
     // finalReg = new FinalizationRegistry((ssid: number) => {
     //     if (ssid >= 0) {
@@ -44,6 +62,7 @@ class Term extends React.Component<Props> {
         this.terminal.loadAddon(this.fitAddon);
         this.terminal.loadAddon(this.unicode11Addon);
         this.connId = props.connId;
+        this.attachId = props.ssId;
         this.ssId = -1;
     }
 
@@ -53,7 +72,11 @@ class Term extends React.Component<Props> {
             if (!conn) {
                 return;
             }
-            this.ssId = conn.newShell();
+            if (this.props.playback != undefined) {
+                this.ssId = conn.newPlayback();
+            } else {
+                this.ssId = this.attachId != undefined ? conn.attach(this.attachId, this.props.readOnly ? Role.readOnly : Role.readWrite) : conn.newShell();
+            }
             conn.addEventListener("new_session", (event) => {
                 if (event.id != this.ssId) {
                     return;
@@ -63,7 +86,22 @@ class Term extends React.Component<Props> {
                     this.disposer();
                     return;
                 }
-                this.created();
+                if (this.opened) {
+                    // reattached after the websocket dropped, the scrollback is replayed from the server
+                    this.terminal.reset();
+                    conn?.resize(this.ssId, this.terminal.rows, this.terminal.cols);
+                    return;
+                }
+                this.opened = true;
+                if (this.props.playback != undefined) {
+                    conn?.playback(this.ssId, 'open', this.props.playback);
+                    // the player only reports its state when asked
+                    this.playbackTimer = window.setInterval(() => {
+                        conn?.playback(this.ssId, 'state');
+                    }, 500);
+                } else if (!this.props.readOnly) {
+                    this.created();
+                }
                 this.terminal.open(this.terminalRef.current!);
                 if (!this.fixSize) {
                     this.fitAddon.fit();
@@ -76,7 +114,31 @@ class Term extends React.Component<Props> {
                 }
                 this.terminal.write(new Uint8Array(event.data));
             });
+            conn.addEventListener("playback", (event) => {
+                if (event.id != this.ssId) {
+                    return;
+                }
+                this.setState({ playback: event.data });
+            });
+            conn.addEventListener("role", (event) => {
+                if (event.id != this.ssId) {
+                    return;
+                }
+                if (event.data.role != Role.readWrite && !this.readOnly) {
+                    this.terminal.write("\r\n[read-only viewer, input is ignored]\r\n");
+                } else if (event.data.role == Role.readWrite && this.readOnly) {
+                    this.terminal.write("\r\n[input enabled]\r\n");
+                }
+                this.readOnly = event.data.role != Role.readWrite;
+                this.shared = event.data.shared;
+            });
+            conn.addEventListener("close", () => {
+                this.terminal.write("\r\n[disconnected]\r\n");
+            });
             this.terminal.onData((data) => {
+                if (this.readOnly || this.props.playback != undefined) {
+                    return;
+                }
                 conn?.termData(this.ssId, data);
             });
             this.terminal.onBinary((data) => {
@@ -84,6 +146,9 @@ class Term extends React.Component<Props> {
                 for (let i = 0; i < data.length; i++) {
                     buffer[i + 4] = data.charCodeAt(i);
                 }
+                if (this.readOnly) {
+                    return;
+                }
                 conn?.termData(this.ssId, buffer);
             });
             this.terminal.onResize(({ rows, cols }) => {
@@ -95,6 +160,10 @@ class Term extends React.Component<Props> {
 
     dispose(): void {
         console.log('dispose');
+        if (this.playbackTimer != 0) {
+            clearInterval(this.playbackTimer);
+            this.playbackTimer = 0;
+        }
         if (this.ssId >= 0) {
             connMan.get(this.connId)?.close(this.ssId);
             this.ssId = -1;
@@ -114,10 +183,33 @@ class Term extends React.Component<Props> {
         }, 100);
     }
 
+    renderPlayback(): React.ReactNode {
+        const conn = connMan.get(this.connId);
+        const state = this.state.playback ?? { duration: 0, time: 0, speed: 1, paused: true };
+        return (
+            <div style={{ height: 24, display: 'flex', alignItems: 'center', gap: 8, color: 'white', userSelect: 'none' }}>
+                <div style={{ width: 48, cursor: 'pointer' }} onClick={() => {
+                    conn?.playback(this.ssId, state.paused ? 'resume' : 'pause');
+                }}>{state.paused ? 'play' : 'pause'}</div>
+                <input type="range" style={{ flex: 1 }} min={0} max={state.duration} step={0.1} value={state.time} onChange={(event) => {
+                    conn?.playback(this.ssId, 'seek', '', parseFloat(event.currentTarget.value));
+                }} />
+                <span>{`${state.time.toFixed(1)}/${state.duration.toFixed(1)}s`}</span>
+                <select value={state.speed} onChange={(event) => {
+                    conn?.playback(this.ssId, 'speed', '', 0, parseFloat(event.currentTarget.value));
+                }}>
+                    {PLAYBACK_SPEEDS.map((it) => <option key={it} value={it}>{`${it}x`}</option>)}
+                </select>
+            </div>
+        );
+    }
+
     render(): React.ReactNode {
+        const playback = this.props.playback != undefined;
         return (
             <div style={{ height: '100%', background: 'black', boxSizing: 'border-box', padding: 8, paddingRight: 0 }}>
-                <div ref={this.terminalRef} style={{ height: '100%' }}></div>
+                {playback ? this.renderPlayback() : ''}
+                <div ref={this.terminalRef} style={{ height: playback ? 'calc(100% - 24px)' : '100%' }}></div>
             </div>
         );
     }
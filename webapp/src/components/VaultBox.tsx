@@ -0,0 +1,60 @@
+import { useState } from "react";
+import "./Settings.css";
+
+interface Props {
+    // a master passphrase is set, the current one is needed to change it
+    enabled: boolean
+    cancel: () => void
+    save: (passphrase: string, newPassphrase: string) => void
+}
+
+function VaultBox(props: Props) {
+    const [passphrase, setPassphrase] = useState<string>("");
+    const [newPassphrase, setNewPassphrase] = useState<string>("");
+    const [confirm, setConfirm] = useState<string>("");
+    const mismatch = newPassphrase != confirm;
+    return (
+        <div className="settings">
+            <div className="container">
+                <div style={{
+                    width: '100%',
+                    display: 'grid',
+                    gridGap: '8px',
+                    gridTemplateColumns: '160px auto',
+                }}>
+                    <label></label>
+                    <div style={{ textAlign: 'start' }}>
+                        {props.enabled
+                            ? 'secrets are encrypted, leave the new passphrase empty to store them in plain text'
+                            : 'set a master passphrase to encrypt the saved secrets'}
+                    </div>
+                    <label className={!props.enabled ? "disabled" : ""}>current passphrase</label>
+                    <input disabled={!props.enabled} type="password" value={passphrase} onInput={(event) => {
+                        setPassphrase(event.currentTarget.value);
+                    }} />
+                    <label>new passphrase</label>
+                    <input type="password" value={newPassphrase} onInput={(event) => {
+                        setNewPassphrase(event.currentTarget.value);
+                    }} />
+                    <label>confirm</label>
+                    <input type="password" value={confirm} onInput={(event) => {
+                        setConfirm(event.currentTarget.value);
+                    }} />
+                    <label></label>
+                    <div style={{ textAlign: 'start', visibility: mismatch ? 'visible' : 'hidden' }}>passphrases do not match</div>
+                </div>
+                <div className="button-group">
+                    <div onClick={props.cancel}>cancel</div>
+                    <div className={mismatch || (!props.enabled && newPassphrase == "") ? "disabled" : ""} onClick={() => {
+                        if (mismatch || (!props.enabled && newPassphrase == "")) {
+                            return;
+                        }
+                        props.save(passphrase, newPassphrase);
+                    }}>save</div>
+                </div>
+            </div>
+        </div>
+    );
+}
+
+export default VaultBox;
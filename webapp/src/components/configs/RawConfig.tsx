@@ -0,0 +1,93 @@
+import { ConfigRaw } from "../../struct";
+
+interface Props {
+    data?: ConfigRaw;
+    onChange: (data: ConfigRaw) => void;
+}
+
+const inputStyle: React.CSSProperties = {
+    color: 'white',
+    border: '1px solid rgb(127 127 127 / 0.3)',
+}
+
+function RawConfig(props: Props) {
+    const data = Object.assign({
+        type: "raw",
+        name: "",
+        network: "tcp",
+        address: "",
+        tls: false,
+        newline: "cr",
+        implicitCR: false,
+    }, props.data);
+    return (
+        <>
+            <h4>Raw</h4>
+            <div style={{
+                width: '100%',
+                display: 'grid',
+                gridGap: '8px',
+                gridTemplateColumns: '120px auto',
+            }}>
+                <label>name</label>
+                <input style={inputStyle} value={data.name} onInput={(event) => {
+                    let ret = { ...data };
+                    ret.name = event.currentTarget.value;
+                    props.onChange(ret);
+                }} />
+                <label>network</label>
+                <select style={inputStyle} value={data.network} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.network = event.currentTarget.value as ConfigRaw['network'];
+                    props.onChange(ret);
+                }}>
+                    <option value="tcp">tcp</option>
+                    <option value="unix">unix</option>
+                </select>
+                <label>address</label>
+                <input style={inputStyle} value={data.address} onInput={(event) => {
+                    let ret = { ...data };
+                    ret.address = event.currentTarget.value;
+                    props.onChange(ret);
+                }} />
+                <label>tls</label>
+                <input type="checkbox" checked={data.tls} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.tls = event.currentTarget.checked;
+                    props.onChange(ret);
+                }} />
+                <label>newline</label>
+                <select style={inputStyle} value={data.newline} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.newline = event.currentTarget.value as ConfigRaw['newline'];
+                    props.onChange(ret);
+                }}>
+                    <option value="cr">CR</option>
+                    <option value="lf">LF</option>
+                    <option value="crlf">CRLF</option>
+                </select>
+                <label>implicit CR</label>
+                <input type="checkbox" checked={data.implicitCR} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.implicitCR = event.currentTarget.checked;
+                    props.onChange(ret);
+                }} />
+            </div>
+        </>
+    )
+}
+
+export function checkRaw(data: ConfigRaw) {
+    return data.address != "";
+}
+
+export function formatRaw(data: ConfigRaw): ConfigRaw {
+    let ret = { ...data };
+    ret.type = "raw";
+    if (ret.name == "") {
+        ret.name = ret.address;
+    }
+    return ret;
+}
+
+export default RawConfig;
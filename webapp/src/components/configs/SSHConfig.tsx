@@ -1,4 +1,5 @@
-import { ConfigSSH } from "../../struct";
+import { useState } from "react";
+import { ConfigSSH, JumpSSH } from "../../struct";
 
 interface Props {
     data?: ConfigSSH;
@@ -10,6 +11,51 @@ const inputStyle: React.CSSProperties = {
     border: '1px solid rgb(127 127 127 / 0.3)',
 }
 
+// formatJump writes a jump host as a line, "#id" for a saved config or [user@]host[:port]
+function formatJump(jump: JumpSSH): string {
+    if (jump.ref) {
+        return `#${jump.ref}`;
+    }
+    let host = jump.host ?? "";
+    if (host.includes(":")) {
+        host = `[${host}]`;
+    }
+    return `${jump.username ? `${jump.username}@` : ""}${host}${jump.port ? `:${jump.port}` : ""}`;
+}
+
+// parseJumps reads one jump host per line, a line unchanged keeps the secrets of its jump host
+function parseJumps(text: string, old: JumpSSH[]): JumpSSH[] {
+    return text.split("\n").map((line) => line.trim()).filter((line) => line != "").map((line) => {
+        const kept = old.find((jump) => formatJump(jump) == line);
+        if (kept) {
+            return kept;
+        }
+        if (/^#\d+$/.test(line)) {
+            return { ref: parseInt(line.slice(1)) };
+        }
+        let ret: JumpSSH = {};
+        const at = line.lastIndexOf("@");
+        if (at >= 0) {
+            ret.username = line.slice(0, at);
+            line = line.slice(at + 1);
+        }
+        const matched = line.match(/^\[(.*)\](?::(\d+))?$/) ?? line.match(/^([^:]*)(?::(\d+))?$/);
+        if (matched) {
+            ret.host = matched[1];
+            if (matched[2]) {
+                ret.port = parseInt(matched[2]);
+            }
+        } else {
+            ret.host = line;
+        }
+        return ret;
+    });
+}
+
+function parseAuthMethods(text: string): string[] {
+    return text.split(",").map((item) => item.trim()).filter((item) => item != "");
+}
+
 function SSHConfig(props: Props) {
     const data = Object.assign({
         type: "ssh",
@@ -20,6 +66,9 @@ function SSHConfig(props: Props) {
         username: "",
         password: "",
     }, props.data);
+    // the lists are edited as text, so a half typed line is not formatted away
+    const [authMethods, setAuthMethods] = useState<string>((data.authMethods ?? []).join(", "));
+    const [jumps, setJumps] = useState<string>((data.jumps ?? []).map(formatJump).join("\n"));
     return (
         <>
             <h4>SSH</h4>
@@ -65,6 +114,32 @@ function SSHConfig(props: Props) {
                     ret.password = event.currentTarget.value;
                     props.onChange(ret);
                 }} />
+                <label>key file</label>
+                <input style={inputStyle} value={data.keyFile ?? ""} onInput={(event) => {
+                    let ret = { ...data };
+                    ret.keyFile = event.currentTarget.value;
+                    props.onChange(ret);
+                }} />
+                <label>key passphrase</label>
+                <input style={inputStyle} value={data.passphrase ?? ""} onInput={(event) => {
+                    let ret = { ...data };
+                    ret.passphrase = event.currentTarget.value;
+                    props.onChange(ret);
+                }} />
+                <label>auth methods</label>
+                <input style={inputStyle} value={authMethods} placeholder="publickey, agent, password, keyboard-interactive" onInput={(event) => {
+                    setAuthMethods(event.currentTarget.value);
+                    let ret = { ...data };
+                    ret.authMethods = parseAuthMethods(event.currentTarget.value);
+                    props.onChange(ret);
+                }} />
+                <label>jump hosts</label>
+                <textarea style={inputStyle} value={jumps} placeholder={"one per line, [user@]host[:port] or #id of a saved config"} onChange={(event) => {
+                    setJumps(event.currentTarget.value);
+                    let ret = { ...data };
+                    ret.jumps = parseJumps(event.currentTarget.value, data.jumps ?? []);
+                    props.onChange(ret);
+                }} />
             </div>
         </>
     )
@@ -74,6 +149,7 @@ export function checkSSH(data: ConfigSSH) {
     return data.host != "" && data.port > 0 && data.port <= 65535;
 }
 
+// formatSSH keeps the fields the form does not show, such as forwards, keepAlive and import
 export function formatSSH(data: ConfigSSH): ConfigSSH {
     let ret = { ...data };
     ret.type = "ssh";
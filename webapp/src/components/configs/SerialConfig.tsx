@@ -1,4 +1,5 @@
-import { ConfigSerial } from "../../struct";
+import { useEffect, useState } from "react";
+import { ConfigSerial, SerialPortInfo } from "../../struct";
 
 interface Props {
     data?: ConfigSerial;
@@ -11,11 +12,26 @@ const inputStyle: React.CSSProperties = {
 }
 
 function SerialConfig(props: Props) {
+    const [ports, setPorts] = useState<SerialPortInfo[]>([]);
+    useEffect(() => {
+        (async () => {
+            try {
+                let res = await fetch('http://localhost:32300/api/serial');
+                setPorts(await res.json());
+            } catch (err: any) {
+                setPorts([]);
+            }
+        })();
+    }, []);
     const data = Object.assign({
         type: "serial",
         name: "",
         serial: "",
         rate: 115200,
+        dataBits: 8,
+        parity: "none",
+        stopBits: "1",
+        flow: "none",
     }, props.data);
     return (
         <>
@@ -32,32 +48,142 @@ function SerialConfig(props: Props) {
                     ret.name = event.currentTarget.value;
                     props.onChange(ret);
                 }} />
+                <label>port</label>
+                <select style={inputStyle} value="" onChange={(event) => {
+                    let port = ports.find((it) => it.name == event.currentTarget.value);
+                    if (port) {
+                        let ret = { ...data };
+                        ret.serial = port.name;
+                        ret.usbSerial = data.usbSerial ? port.serialNumber : "";
+                        props.onChange(ret);
+                    }
+                }}>
+                    <option value="">select a port...</option>
+                    {ports.map((it) => <option key={it.name} value={it.name}>
+                        {it.isUSB ? `${it.name} (${it.product} ${it.vid}:${it.pid} ${it.serialNumber})` : it.name}
+                    </option>)}
+                </select>
                 <label>serial</label>
                 <input style={inputStyle} value={data.serial} onInput={(event) => {
                     let ret = { ...data };
                     ret.serial = event.currentTarget.value;
                     props.onChange(ret);
                 }} />
+                <label>reconnect</label>
+                <input type="checkbox" checked={data.reconnect ?? false} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.reconnect = event.currentTarget.checked;
+                    props.onChange(ret);
+                }} />
+                <label>log</label>
+                <input type="checkbox" checked={data.log ?? false} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.log = event.currentTarget.checked;
+                    props.onChange(ret);
+                }} />
+                <label>log time</label>
+                <select style={inputStyle} value={data.logTime ?? "wall"} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.logTime = event.currentTarget.value as ConfigSerial['logTime'];
+                    props.onChange(ret);
+                }}>
+                    <option value="wall">wall clock</option>
+                    <option value="relative">relative</option>
+                </select>
+                <label>log hex</label>
+                <input type="checkbox" checked={data.logHex ?? false} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.logHex = event.currentTarget.checked;
+                    props.onChange(ret);
+                }} />
+                <label>char delay (ms)</label>
+                <input style={inputStyle} value={data.charDelay ?? 0} type="number" onInput={(event) => {
+                    let ret = { ...data };
+                    ret.charDelay = Math.max(0, parseInt(event.currentTarget.value));
+                    props.onChange(ret);
+                }} />
+                <label>line delay (ms)</label>
+                <input style={inputStyle} value={data.lineDelay ?? 0} type="number" onInput={(event) => {
+                    let ret = { ...data };
+                    ret.lineDelay = Math.max(0, parseInt(event.currentTarget.value));
+                    props.onChange(ret);
+                }} />
+                <label>line wait</label>
+                <select style={inputStyle} value={data.lineWait ?? ""} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.lineWait = event.currentTarget.value as ConfigSerial['lineWait'];
+                    props.onChange(ret);
+                }}>
+                    <option value="">none</option>
+                    <option value="echo">echo</option>
+                    <option value="prompt">prompt</option>
+                </select>
+                <label>prompt</label>
+                <input style={inputStyle} value={data.prompt ?? ""} onInput={(event) => {
+                    let ret = { ...data };
+                    ret.prompt = event.currentTarget.value;
+                    props.onChange(ret);
+                }} />
+                <label>usb serial</label>
+                <input style={inputStyle} value={data.usbSerial ?? ""} placeholder="bind by usb serial number" onInput={(event) => {
+                    let ret = { ...data };
+                    ret.usbSerial = event.currentTarget.value;
+                    props.onChange(ret);
+                }} />
                 <label>rate</label>
                 <input style={inputStyle} value={data.rate} type="number" onInput={(event) => {
                     let ret = { ...data };
                     ret.rate = parseInt(event.currentTarget.value);
                     props.onChange(ret);
                 }} />
+                <label>data bits</label>
+                <select style={inputStyle} value={data.dataBits} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.dataBits = parseInt(event.currentTarget.value);
+                    props.onChange(ret);
+                }}>
+                    {[5, 6, 7, 8].map((it) => <option key={it} value={it}>{it}</option>)}
+                </select>
+                <label>parity</label>
+                <select style={inputStyle} value={data.parity} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.parity = event.currentTarget.value as ConfigSerial['parity'];
+                    props.onChange(ret);
+                }}>
+                    {["none", "odd", "even", "mark", "space"].map((it) => <option key={it} value={it}>{it}</option>)}
+                </select>
+                <label>stop bits</label>
+                <select style={inputStyle} value={data.stopBits} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.stopBits = event.currentTarget.value as ConfigSerial['stopBits'];
+                    props.onChange(ret);
+                }}>
+                    {["1", "1.5", "2"].map((it) => <option key={it} value={it}>{it}</option>)}
+                </select>
+                <label>flow control</label>
+                <select style={inputStyle} value={data.flow} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.flow = event.currentTarget.value as ConfigSerial['flow'];
+                    props.onChange(ret);
+                }}>
+                    <option value="none">none</option>
+                    <option value="rtscts">RTS/CTS</option>
+                    <option value="xonxoff">XON/XOFF</option>
+                </select>
             </div>
         </>
     )
 }
 
 export function checkSerial(data: ConfigSerial) {
-    return data.serial != "" && data.rate > 0;
+    return (data.serial != "" || (data.usbSerial ?? "") != "") && data.rate > 0 && (data.lineWait != "prompt" || (data.prompt ?? "") != "");
 }
 
 export function formatSerial(data: ConfigSerial): ConfigSerial {
     let ret = { ...data };
     ret.type = "serial";
     if (ret.name == "") {
-        ret.name = ret.serial;
+        ret.name = ret.usbSerial ? ret.usbSerial : ret.serial;
     }
     return ret;
 }
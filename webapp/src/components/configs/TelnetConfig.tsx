@@ -0,0 +1,93 @@
+import { ConfigTelnet } from "../../struct";
+
+interface Props {
+    data?: ConfigTelnet;
+    onChange: (data: ConfigTelnet) => void;
+}
+
+const inputStyle: React.CSSProperties = {
+    color: 'white',
+    border: '1px solid rgb(127 127 127 / 0.3)',
+}
+
+function TelnetConfig(props: Props) {
+    const data = Object.assign({
+        type: "telnet",
+        name: "",
+        termType: "xterm-256color",
+        host: "",
+        port: 23,
+        login: false,
+        username: "",
+        password: "",
+    }, props.data);
+    return (
+        <>
+            <h4>Telnet</h4>
+            <div style={{
+                width: '100%',
+                display: 'grid',
+                gridGap: '8px',
+                gridTemplateColumns: '120px auto',
+            }}>
+                <label>name</label>
+                <input style={inputStyle} value={data.name} onInput={(event) => {
+                    let ret = { ...data };
+                    ret.name = event.currentTarget.value;
+                    props.onChange(ret);
+                }} />
+                <label>term type</label>
+                <input style={inputStyle} value={data.termType} onInput={(event) => {
+                    let ret = { ...data };
+                    ret.termType = event.currentTarget.value;
+                    props.onChange(ret);
+                }} />
+                <label>host</label>
+                <input style={inputStyle} value={data.host} onInput={(event) => {
+                    let ret = { ...data };
+                    ret.host = event.currentTarget.value;
+                    props.onChange(ret);
+                }} />
+                <label>port</label>
+                <input style={inputStyle} value={data.port} type="number" onInput={(event) => {
+                    let ret = { ...data };
+                    ret.port = Math.min(65535, Math.max(1, parseInt(event.currentTarget.value)));
+                    props.onChange(ret);
+                }} />
+                <label>auto login</label>
+                <input type="checkbox" checked={data.login} onChange={(event) => {
+                    let ret = { ...data };
+                    ret.login = event.currentTarget.checked;
+                    props.onChange(ret);
+                }} />
+                <label>username</label>
+                <input style={inputStyle} value={data.username} onInput={(event) => {
+                    let ret = { ...data };
+                    ret.username = event.currentTarget.value;
+                    props.onChange(ret);
+                }} />
+                <label>password</label>
+                <input style={inputStyle} value={data.password} onInput={(event) => {
+                    let ret = { ...data };
+                    ret.password = event.currentTarget.value;
+                    props.onChange(ret);
+                }} />
+            </div>
+        </>
+    )
+}
+
+export function checkTelnet(data: ConfigTelnet) {
+    return data.host != "" && data.port > 0 && data.port <= 65535;
+}
+
+export function formatTelnet(data: ConfigTelnet): ConfigTelnet {
+    let ret = { ...data };
+    ret.type = "telnet";
+    if (ret.name == "") {
+        ret.name = ret.host;
+    }
+    return ret;
+}
+
+export default TelnetConfig;
@@ -16,12 +16,23 @@ enum MsgType {
     fs_operation,
     info,
     modem,
+    host, // Recv only
+    playback,
+    serial,
+    role,
     resize = 0x0100,
 }
 
-enum SessionType {
+export enum SessionType {
     shell = 0,
     sftp = 1,
+    playback = 2,
+}
+
+// role asked for when opening or attaching a session, the server decides the one granted
+export enum Role {
+    readWrite = 0,
+    readOnly = 1,
 }
 
 enum FSOP {
@@ -47,6 +58,61 @@ export interface FSOPEventType {
     data: string | DirEntry[] | string[];
 }
 
+export interface SerialStatusType {
+    dtr: boolean;
+    rts: boolean;
+    cts: boolean;
+    dsr: boolean;
+    ri: boolean;
+    dcd: boolean;
+    log: string;
+}
+
+export interface PlaybackStateType {
+    duration: number;
+    time: number;
+    speed: number;
+    paused: boolean;
+}
+
+export interface RoleType {
+    role: Role;
+    shared: boolean;
+}
+
+export interface ModemEventType {
+    op: 'read' | 'file' | 'data' | 'close' | 'progress' | 'result' | 'detected';
+    file: number;
+    name?: string;
+    offset: number;
+    size: number;
+    data?: string;
+    direct?: 'send' | 'recv';
+    type?: string;
+    done: number;
+    retries: number;
+    error?: string;
+}
+
+export type ModemSource = 'dialog' | 'path' | 'stream' | 'fs';
+
+function encodeBase64(data: Uint8Array): string {
+    let binary = '';
+    for (let i = 0; i < data.length; i += 0x8000) {
+        binary += String.fromCharCode.apply(null, Array.from(data.subarray(i, i + 0x8000)));
+    }
+    return btoa(binary);
+}
+
+function decodeBase64(data: string): Uint8Array {
+    let binary = atob(data);
+    let ret = new Uint8Array(binary.length);
+    for (let i = 0; i < binary.length; i++) {
+        ret[i] = binary.charCodeAt(i);
+    }
+    return ret;
+}
+
 export interface InfoType {
     type: string;
     info: string;
@@ -58,6 +124,10 @@ interface ConnectionEventMap {
     term_data: DataEvent<ArrayBuffer>;
     fs_operation: DataEvent<FSOPEventType>;
     info: DataEvent<InfoType>;
+    serial: DataEvent<SerialStatusType>;
+    modem: DataEvent<ModemEventType>;
+    role: DataEvent<RoleType>;
+    playback: DataEvent<PlaybackStateType>;
 }
 
 interface ConnectionEventTarget extends EventTarget {
@@ -75,39 +145,88 @@ interface ConnectionEventTarget extends EventTarget {
 
 const typedEventTarget = EventTarget as { new(): ConnectionEventTarget; prototype: ConnectionEventTarget };
 
+export interface HostSessionInfo {
+    id: number;
+    type: number;
+}
+
+export interface HostInfo {
+    id: number;
+    configId: number;
+    sessions: HostSessionInfo[];
+    attached: boolean;
+}
+
+// attempts to reattach a dropped websocket to its host before giving up
+const RECONNECT_LIMIT = 5;
+const RECONNECT_DELAY = 1000;
+
 export class Connection extends typedEventTarget {
     private socket: WebSocket;
+    private url: string;
     private protocol: 'standard' | 'goTTYd';
     private sessionTotal: number = 0;
     sessionCount: number = 0;
     sftphandles = new Map<number, FSHandle>();
     isWindowsPath = false;
     fixSzie: boolean;
+    // the server side host the sessions live in, a dropped websocket reattaches to it
+    hostId: number = 0;
+    private sessions = new Map<number, { type: SessionType, role: Role }>();
+    private closing = false;
+    private retries = 0;
 
     private disposer: () => void;
 
-    constructor(url: string, protocol: 'standard' | 'goTTYd', fixSize: boolean, callback: (ss: Connection) => void, dispose: () => void) {
+    constructor(url: string, protocol: 'standard' | 'goTTYd', fixSize: boolean, callback: (ss: Connection) => void, dispose: () => void, hostId: number = 0) {
         super();
         this.disposer = dispose;
         // console.log('construct', url);
+        this.url = url;
         this.protocol = protocol;
         this.fixSzie = fixSize;
-        this.socket = new WebSocket(url);
-        // this.socket.addEventListener('error', (e) => {
+        this.hostId = hostId;
+        this.socket = this.connect(() => {
+            callback(this);
+        });
+    }
+
+    private connect(opened: () => void): WebSocket {
+        let socket = new WebSocket(this.hostId != 0 ? `${this.url}&host=${this.hostId}` : this.url);
+        // socket.addEventListener('error', (e) => {
         //     console.log(e);
         // })
-        this.socket.binaryType = "arraybuffer";
-        this.socket.addEventListener('open', () => {
-            callback(this);
+        socket.binaryType = "arraybuffer";
+        socket.addEventListener('open', () => {
+            this.retries = 0;
+            opened();
         });
-        this.socket.addEventListener('close', () => {
+        socket.addEventListener('close', () => {
+            if (!this.closing && this.protocol == 'standard' && this.hostId != 0 && this.retries < RECONNECT_LIMIT) {
+                this.retries += 1;
+                setTimeout(() => { this.reconnect(); }, RECONNECT_DELAY);
+                return;
+            }
             this.dispatchEvent(new Event('close'));
-        })
-        if (protocol == 'goTTYd') {
-            this.socket.addEventListener('message', this.ttyd_recv);
+            if (!this.closing) {
+                this.closing = true;
+                this.disposer();
+            }
+        });
+        if (this.protocol == 'goTTYd') {
+            socket.addEventListener('message', this.ttyd_recv);
         } else {
-            this.socket.addEventListener('message', this.std_recv);
+            socket.addEventListener('message', this.std_recv);
         }
+        return socket;
+    }
+
+    private reconnect() {
+        this.socket = this.connect(() => {
+            for (let [id, { type, role }] of this.sessions) {
+                this.send(MsgType.new_session, id, new Uint8Array([type, 0, role]));
+            }
+        });
     }
 
     private ttyd_recv = (event: MessageEvent) => {
@@ -128,6 +247,9 @@ export class Connection extends typedEventTarget {
                     this.isWindowsPath = true;
                 }
                 let result = new Uint8Array(data)[0] != 0;
+                if (!result) {
+                    this.sessions.delete(view[1]);
+                }
                 this.dispatchEvent(new DataEvent<boolean>(MsgType[MsgType.new_session], view[1], result));
                 if (!result) {
                     for (let [key, value] of this.sftphandles) {
@@ -149,9 +271,28 @@ export class Connection extends typedEventTarget {
                     data: JSON.parse(this.decoder.decode(data)) as any,
                 } as FSOPEventType));
                 break;
+            case MsgType.host:
+                this.hostId = JSON.parse(this.decoder.decode(data)).id;
+                break;
             case MsgType.info:
                 this.dispatchEvent(new DataEvent<InfoType>(MsgType[MsgType.info], view[1], JSON.parse(this.decoder.decode(data))));
                 break;
+            case MsgType.serial:
+                this.dispatchEvent(new DataEvent<SerialStatusType>(MsgType[MsgType.serial], view[1], JSON.parse(this.decoder.decode(data))));
+                break;
+            case MsgType.playback:
+                this.dispatchEvent(new DataEvent<PlaybackStateType>(MsgType[MsgType.playback], view[1], JSON.parse(this.decoder.decode(data))));
+                break;
+            case MsgType.role:
+                this.dispatchEvent(new DataEvent<RoleType>(MsgType[MsgType.role], view[1], JSON.parse(this.decoder.decode(data))));
+                break;
+            case MsgType.modem:
+                {
+                    let event = JSON.parse(this.decoder.decode(data)) as ModemEventType;
+                    this.modemStream(view[1], event);
+                    this.dispatchEvent(new DataEvent<ModemEventType>(MsgType[MsgType.modem], view[1], event));
+                }
+                break;
             default:
         }
     }
@@ -170,13 +311,16 @@ export class Connection extends typedEventTarget {
     close(id: number) {
         if (this.protocol == 'standard') {
             this.send(MsgType.close_session, id, "");
+            this.sessions.delete(id);
             if (this.sftphandles.has(id)) {
                 this.send(MsgType.close_session, this.sftphandles.get(id)!.ssid, "");
+                this.sessions.delete(this.sftphandles.get(id)!.ssid);
                 this.sessionTotal -= 1;
             }
         }
         this.sessionTotal -= 1;
         if (this.sessionTotal == 0) {
+            this.closing = true;
             this.socket.close();
             this.disposer();
         }
@@ -200,18 +344,37 @@ export class Connection extends typedEventTarget {
                 return 0;
             }
         } else {
-            this.send(MsgType.new_session, this.sessionCount, new Uint8Array([SessionType.shell, 0]));
-            this.sessionCount += 1;
-            this.sessionTotal += 1;
-            return this.sessionCount - 1;
+            return this.open(this.sessionCount, SessionType.shell);
         }
     }
 
     newSftp(): number {
-        this.send(MsgType.new_session, this.sessionCount, new Uint8Array([SessionType.sftp, 0]));
-        this.sessionCount += 1;
+        return this.open(this.sessionCount, SessionType.sftp);
+    }
+
+    newPlayback(): number {
+        return this.open(this.sessionCount, SessionType.playback);
+    }
+
+    // attach opens a session of the host that is still alive on the server, e.g. after a page reload,
+    // or the session of another client to watch it read-only
+    attach(id: number, role: Role = Role.readWrite): number {
+        return this.open(id, SessionType.shell, role);
+    }
+
+    // discard closes a session of the host that is left on the server and not wanted any more
+    discard(id: number, type: SessionType) {
+        this.send(MsgType.new_session, id, new Uint8Array([type, 0]));
+        this.send(MsgType.close_session, id, "");
+        this.sessionCount = Math.max(this.sessionCount, id + 1);
+    }
+
+    private open(id: number, type: SessionType, role: Role = Role.readWrite): number {
+        this.send(MsgType.new_session, id, new Uint8Array([type, 0, role]));
+        this.sessions.set(id, { type, role });
+        this.sessionCount = Math.max(this.sessionCount, id + 1);
         this.sessionTotal += 1;
-        return this.sessionCount - 1;
+        return id;
     }
 
     termData(id: number, data: string | Uint8Array) {
@@ -229,14 +392,93 @@ export class Connection extends typedEventTarget {
         }));
     }
 
-    modem(id: number, direct: 'send' | 'recv', type: string, fn: ModemFn) {
+    serial(id: number, op: 'break' | 'dtr' | 'rts' | 'log' | 'status', value: boolean = false, duration: number = 0) {
+        this.send(MsgType.serial, id, JSON.stringify({
+            op,
+            value,
+            duration,
+        }));
+    }
+
+    playback(id: number, op: 'open' | 'pause' | 'resume' | 'seek' | 'speed' | 'state', path: string = '', time: number = 0, speed: number = 1) {
+        this.send(MsgType.playback, id, JSON.stringify({
+            op,
+            path,
+            time,
+            speed,
+        }));
+    }
+
+    // share lets every viewer of the session type, only a writer can change it
+    share(id: number, shared: boolean) {
+        this.send(MsgType.role, id, JSON.stringify({ role: 0, shared }));
+    }
+
+    // files streamed to a modem send and files being received from a modem, by session
+    private modemSending = new Map<number, File[]>();
+    private modemReceiving = new Map<number, { name: string, parts: Uint8Array[] }>();
+
+    private async modemStream(id: number, event: ModemEventType) {
+        switch (event.op) {
+            case 'read':
+                {
+                    let file = this.modemSending.get(id)?.[event.file];
+                    let data = new Uint8Array();
+                    if (file) {
+                        data = new Uint8Array(await file.slice(event.offset, event.offset + event.size).arrayBuffer());
+                    }
+                    this.send(MsgType.modem, id, JSON.stringify({
+                        op: 'data',
+                        file: event.file,
+                        offset: event.offset,
+                        data: encodeBase64(data),
+                    }));
+                }
+                break;
+            case 'file':
+                this.modemReceiving.set(id, { name: event.name || 'download', parts: [] });
+                break;
+            case 'data':
+                this.modemReceiving.get(id)?.parts.push(decodeBase64(event.data || ''));
+                break;
+            case 'close':
+                {
+                    let file = this.modemReceiving.get(id);
+                    this.modemReceiving.delete(id);
+                    if (file) {
+                        let downloader = document.createElement("a");
+                        downloader.style.display = "none";
+                        downloader.href = URL.createObjectURL(new Blob(file.parts));
+                        downloader.download = file.name;
+                        document.body.appendChild(downloader);
+                        downloader.click();
+                        document.body.removeChild(downloader);
+                        URL.revokeObjectURL(downloader.href);
+                    }
+                }
+                break;
+        }
+    }
+
+    modem(id: number, direct: 'send' | 'recv', type: string, fn: ModemFn, source: ModemSource = 'dialog', paths: string[] = [], files: File[] = [], fs: number = 0) {
+        if (source == 'stream' && direct == 'send') {
+            this.modemSending.set(id, files);
+        }
         this.send(MsgType.modem, id, JSON.stringify({
             direct,
             type,
             fn,
+            source,
+            paths,
+            files: files.map((file) => ({ name: file.name, size: file.size, modTime: file.lastModified })),
+            fs,
         }));
     }
 
+    modemCancel(id: number) {
+        this.send(MsgType.modem, id, JSON.stringify({ op: 'cancel' }));
+    }
+
     resize(id: number, rows: number, cols: number) {
         if (this.protocol == 'goTTYd') {
             this.send(2, id, JSON.stringify({ rows, cols }));
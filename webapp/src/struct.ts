@@ -9,6 +9,7 @@ export interface SessionInfo {
 export interface ConfigBase {
     type: string;
     name: string;
+    record?: boolean;
 }
 
 export type ConfigPTY = ConfigBase & {
@@ -16,17 +17,73 @@ export type ConfigPTY = ConfigBase & {
     termType: string;
 }
 
+// a jump host is a saved ssh config by ref or an inline host
+export interface JumpSSH {
+    ref?: number;
+    host?: string;
+    port?: number;
+    username?: string;
+    password?: string;
+    keyFile?: string;
+    passphrase?: string;
+    authMethods?: string[];
+}
+
 export type ConfigSSH = ConfigBase & {
     termType: string;
     host: string;
     port: number;
     username: string;
     password: string;
+    keyFile?: string;
+    passphrase?: string;
+    authMethods?: string[];
+    jumps?: JumpSSH[];
+}
+
+export type ConfigTelnet = ConfigBase & {
+    termType: string;
+    host: string;
+    port: number;
+    login: boolean;
+    username: string;
+    password: string;
+}
+
+export type ConfigRaw = ConfigBase & {
+    network: 'tcp' | 'unix';
+    address: string;
+    tls: boolean;
+    newline: 'cr' | 'lf' | 'crlf';
+    implicitCR: boolean;
 }
 
 export type ConfigSerial = ConfigBase & {
     serial: string;
+    usbSerial?: string;
+    reconnect?: boolean;
+    log?: boolean;
+    logTime?: 'wall' | 'relative';
+    logHex?: boolean;
+    charDelay?: number;
+    lineDelay?: number;
+    lineWait?: '' | 'echo' | 'prompt';
+    prompt?: string;
+    waitTimeout?: number;
     rate: number;
+    dataBits: number;
+    parity: 'none' | 'odd' | 'even' | 'mark' | 'space';
+    stopBits: '1' | '1.5' | '2';
+    flow: 'none' | 'rtscts' | 'xonxoff';
+}
+
+export interface SerialPortInfo {
+    name: string;
+    isUSB: boolean;
+    vid: string;
+    pid: string;
+    serialNumber: string;
+    product: string;
 }
 
 export interface StatusItem {